@@ -1,13 +1,11 @@
 package main
 
 import (
-	"context"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	wkproto "github.com/WuKongIM/WuKongIMGoProto"
@@ -15,13 +13,18 @@ import (
 	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
 	"github.com/WuKongIM/plugins/search/search"
 	"github.com/WuKongIM/wklog"
-	"golang.org/x/sync/errgroup"
+	"go.uber.org/zap"
 )
 
 var pluginNo = "wk.plugin.search" // 插件编号
 var Version = "0.0.1"             // 插件版本
 var Priority = int32(1)           // 插件优先级
 
+const (
+	defaultNodeTimeout = time.Second * 5  // 多节点搜索默认的超时时间
+	maxNodeTimeout     = time.Second * 60 // 多节点搜索最大的超时时间
+)
+
 func main() {
 	err := pdk.RunServer(New, pluginNo, pdk.WithVersion(Version), pdk.WithPriority(Priority))
 	if err != nil {
@@ -29,8 +32,32 @@ func main() {
 	}
 }
 
+// 插件配置，可以在WuKongIM后台修改
+type Config struct {
+	Pinyin            bool   `json:"pinyin" label:"拼音搜索（全拼、首字母）"`
+	Traditional       bool   `json:"traditional" label:"繁简体互搜"`
+	Language          string `json:"language" label:"分词语言（zh、ja、en、standard、cjk）"`
+	DetectLanguage    bool   `json:"detect_language" label:"自动识别每条消息的语言"`
+	UserDict          string `json:"user_dict" label:"自定义词典（逗号或换行分隔，可附加词频，如：悟空IM 1000）"`
+	StopWords         string `json:"stop_words" label:"停用词（逗号或换行分隔）"`
+	RetentionDays     int    `json:"retention_days" label:"消息索引保留天数（0为永久保留）"`
+	RetentionByType   string `json:"retention_by_type" label:"按频道类型的保留天数（频道类型:天数，逗号分隔，如：1:30,2:365）"`
+	BackupDir         string `json:"backup_dir" label:"备份目录（为空时使用插件沙盒中的backup目录，建议使用沙盒外的目录）"`
+	BackupAutoRestore bool   `json:"backup_auto_restore" label:"启动时沙盒数据丢失，自动从最新的备份恢复"`
+	IndexBuckets      int    `json:"index_buckets" label:"索引的bucket数量（默认10，最大256）"`
+	IndexQueueSize    int    `json:"index_queue_size" label:"每个bucket的索引队列容量（默认1000）"`
+	IndexBatchSize    int    `json:"index_batch_size" label:"每批拉取消息的频道数量（默认100）"`
+	IndexPullLimit    int    `json:"index_pull_limit" label:"每个频道每次拉取的消息数量（默认500）"`
+	IndexPullInterval int    `json:"index_pull_interval" label:"频道还有消息时再次拉取的间隔，单位毫秒（默认500）"`
+	SearchRequireUid  bool   `json:"search_require_uid" label:"必须指定uid，只能访问uid所在的频道（关闭时/search、/message/context、/suggest/channels不指定uid可以访问所有频道）"`
+	HideBeforeJoin    bool   `json:"hide_before_join" label:"不返回用户加入频道之前的消息（加入时间通过/member/join设置）"`
+	PayloadDecoders   string `json:"payload_decoders" label:"非JSON消息内容的解码器（逗号分隔，按顺序尝试，可选：base64_json、text，为空时全部启用）"`
+	MetadataRules     string `json:"metadata_rules" label:"提取文件名、链接等元数据的规则（JSON数组，如：[{\"payload_types\":[8],\"kind\":\"file\",\"name_path\":\"name\"}]，为空时使用默认规则，修改后重建索引可以应用到已有消息）"`
+}
+
 type Search struct {
-	s *search.Search
+	s      *search.Search
+	Config Config // 名字必须为Config
 	wklog.Log
 }
 
@@ -39,7 +66,67 @@ func New() interface{} {
 	return &Search{
 		s:   search.New(),
 		Log: wklog.NewWKLog("search"),
+		Config: Config{
+			Language: search.LangZh,
+		},
+	}
+}
+
+// ConfigUpdate 配置更新（启动时也会调用）
+// 拼音、繁简体和分词选项修改后索引会在后台迁移
+func (s Search) ConfigUpdate() {
+	s.Info("config update", zap.Any("config", s.Config))
+	search.SetChineseOptions(search.ChineseOptions{
+		Pinyin:      s.Config.Pinyin,
+		Traditional: s.Config.Traditional,
+	})
+	channelTypeDays, err := search.ParseChannelTypeDays(s.Config.RetentionByType)
+	if err != nil {
+		s.Error("parse retention by type error", zap.Error(err))
+	} else {
+		search.SetRetentionOptions(search.RetentionOptions{
+			Days:            s.Config.RetentionDays,
+			ChannelTypeDays: channelTypeDays,
+		})
+	}
+	search.SetAccessOptions(search.AccessOptions{
+		RequireUid:     s.Config.SearchRequireUid,
+		HideBeforeJoin: s.Config.HideBeforeJoin,
+	})
+	search.SetBackupOptions(search.BackupOptions{
+		Dir:         strings.TrimSpace(s.Config.BackupDir),
+		AutoRestore: s.Config.BackupAutoRestore,
+	})
+	err = s.s.SetIndexOptions(search.IndexOptions{
+		Buckets:      s.Config.IndexBuckets,
+		QueueSize:    s.Config.IndexQueueSize,
+		BatchSize:    s.Config.IndexBatchSize,
+		PullLimit:    s.Config.IndexPullLimit,
+		PullInterval: time.Duration(s.Config.IndexPullInterval) * time.Millisecond,
+	})
+	if err != nil {
+		s.Error("set index options error", zap.Error(err))
 	}
+	err = search.SetPayloadDecoders(search.ParseWords(s.Config.PayloadDecoders))
+	if err != nil {
+		s.Error("set payload decoders error", zap.Error(err))
+	}
+	metadataRules, err := search.ParseMetadataRules(s.Config.MetadataRules)
+	if err != nil {
+		s.Error("parse metadata rules error", zap.Error(err))
+	} else {
+		search.SetMetadataRules(metadataRules)
+	}
+	err = search.SetAnalysisOptions(search.AnalysisOptions{
+		Language:       strings.TrimSpace(s.Config.Language),
+		DetectLanguage: s.Config.DetectLanguage,
+		UserDict:       search.ParseWords(s.Config.UserDict),
+		StopWords:      search.ParseWords(s.Config.StopWords),
+	})
+	if err != nil {
+		s.Error("set analysis options error", zap.Error(err))
+	}
+	s.s.ReloadAnalysis()
 }
 
 // Setup 插件初始化
@@ -54,30 +141,449 @@ func (s Search) Route(r *pdk.Route) {
 
 	// 搜索指定用户消息
 	r.POST("/usersearch", s.usersearch)
+
+	// 用户加入频道的时间（不返回加入之前的消息）
+	r.POST("/member/join", s.memberJoin)
+
+	// 搜索补全
+	r.POST("/suggest", s.suggest)
+	// 在指定频道内补全（suggest转发到各节点）
+	r.POST("/suggest/channels", s.suggestChannels)
+
+	// 搜索历史
+	r.POST("/history/add", s.historyAdd)
+	r.POST("/history/list", s.historyList)
+	r.POST("/history/delete", s.historyDelete)
+	r.POST("/history/clear", s.historyClear)
+
+	// 保存的搜索
+	r.POST("/saved/list", s.savedList)
+	r.POST("/saved/add", s.savedAdd)
+	r.POST("/saved/update", s.savedUpdate)
+	r.POST("/saved/delete", s.savedDelete)
+	// 执行保存的搜索（在用户所有会话中搜索）
+	r.POST("/saved/run", s.savedRun)
+
+	// 消息前后的消息（跳转到上下文）
+	r.POST("/message/context", s.messageContext)
+
+	// 消息撤回、编辑、删除事件
+	r.POST("/message/event", s.messageEvent)
+
+	// 清除指定消息的索引
+	r.POST("/message/purge", s.messagePurge)
+
+	// 重建索引，会先删除频道已有的索引（all只重建当前节点的频道，集群中需要对每个节点分别调用）
+	r.POST("/reindex", s.reindex)
+	// 重建索引进度
+	r.GET("/reindex/status", s.reindexStatus)
+	// 暂停重建索引
+	r.POST("/reindex/pause", s.reindexPause)
+	// 继续重建索引
+	r.POST("/reindex/resume", s.reindexResume)
+	// 取消重建索引
+	r.POST("/reindex/cancel", s.reindexCancel)
+
+	// 立即清理超过保留时间的消息（当前节点）
+	r.POST("/retention/cleanup", s.retentionCleanup)
+	// 索引的分区
+	r.GET("/retention/partitions", s.retentionPartitions)
+
+	// 备份索引（当前节点）
+	r.POST("/backup", s.backup)
+	// 备份列表
+	r.GET("/backup/list", s.backupList)
+	// 从备份恢复
+	r.POST("/backup/restore", s.backupRestore)
+
+	// 当前节点的指标（Prometheus文本格式）
+	r.GET("/metrics", s.metrics)
+	// 当前节点的索引状态
+	r.GET("/status", s.status)
 }
 
 // PersistAfter 持久化消息后，更新索引
 func (s Search) PersistAfter(c *pdk.Context) {
 	for _, message := range c.Messages {
+		// 撤回、编辑、删除的命令消息
+		if event := search.ParseMessageEvent(message); event != nil {
+			if err := s.s.HandleMessageEvent(event); err != nil {
+				s.Error("handle message event error", zap.Error(err), zap.String("type", string(event.Type)))
+			}
+		}
 		s.s.MakeIndex(message.ChannelId, uint8(message.ChannelType))
 	}
 }
 
 func (s Search) search(c *pdk.HttpContext) {
-	var req search.SearchReq
+	var req searchBody
 	if err := c.BindJSON(&req); err != nil {
 		c.ResponseError(err)
 		return
 	}
+	if err := search.CheckSearchUid(req.Uid); err != nil {
+		responseSearchError(c, err)
+		return
+	}
 
-	result, err := s.s.Search(req)
+	var (
+		result *search.SearchResp
+		err    error
+	)
+	if strings.TrimSpace(req.Uid) == "" {
+		result, err = s.s.Search(req.SearchReq)
+	} else {
+		result, err = s.searchAs(req.Uid, req.SearchReq)
+	}
 	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// /search的请求，指定uid后只能搜索uid所在的频道
+type searchBody struct {
+	Uid string `json:"uid"`
+	search.SearchReq
+}
+
+// 在uid所在的频道中搜索当前节点的消息，请求了其他频道返回403
+func (s Search) searchAs(uid string, req search.SearchReq) (*search.SearchResp, error) {
+	// 个人频道的channel_id可以是对方的uid
+	if strings.TrimSpace(req.ChannelId) != "" && req.ChannelType == wkproto.ChannelTypePerson && !isPersonChannelOf(uid, req.ChannelId) {
+		req.ChannelId = pdk.GetFakeChannelIDWith(uid, req.ChannelId)
+	}
+	conversationChannelResp, err := pdk.S.ConversationChannels(uid)
+	if err != nil {
+		return nil, err
+	}
+	return s.s.SearchAs(uid, conversationChannelResp.Channels, req)
+}
+
+// 请求参数错误返回400，没有权限返回403，其他错误返回502
+func responseSearchError(c *pdk.HttpContext, err error) {
+	if search.IsBadRequest(err) {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"msg":    err.Error(),
+			"status": http.StatusBadRequest,
+		})
+		return
+	}
+	if search.IsForbidden(err) {
+		c.JSON(http.StatusForbidden, map[string]interface{}{
+			"msg":    err.Error(),
+			"status": http.StatusForbidden,
+		})
+		return
+	}
+	c.ResponseError(err)
+}
+
+func (s Search) memberJoin(c *pdk.HttpContext) {
+	var req struct {
+		Uid         string `json:"uid"`
+		ChannelId   string `json:"channel_id"`
+		ChannelType uint8  `json:"channel_type"`
+		JoinedAt    uint32 `json:"joined_at"` // 加入时间（秒），为0时使用当前时间，不能早于当前时间
+	}
+	if err := c.BindJSON(&req); err != nil {
 		c.ResponseError(err)
 		return
 	}
+	if strings.TrimSpace(req.Uid) == "" || strings.TrimSpace(req.ChannelId) == "" {
+		c.ResponseError(fmt.Errorf("uid or channel_id is empty"))
+		return
+	}
+
+	// 保存在频道所属节点，与频道的索引在一起
+	if s.forwardToChannelNode(c, req.ChannelId, req.ChannelType) {
+		return
+	}
+
+	if err := s.s.SetMemberJoined(req.Uid, req.ChannelId, req.ChannelType, req.JoinedAt); err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": http.StatusOK,
+	})
+}
+
+func (s Search) messageContext(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"` // 指定后只能获取uid所在频道的消息，个人频道必须指定，channel_id为对方的uid
+		search.ContextReq
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	if err := search.CheckSearchUid(req.Uid); err != nil {
+		responseSearchError(c, err)
+		return
+	}
+
+	channelId := req.ChannelId
+	if req.ChannelType == wkproto.ChannelTypePerson {
+		if strings.TrimSpace(req.Uid) == "" {
+			responseSearchError(c, search.ErrUidRequired)
+			return
+		}
+		channelId = pdk.GetFakeChannelIDWith(req.Uid, req.ChannelId)
+	}
+
+	if s.forwardToChannelNode(c, channelId, req.ChannelType) {
+		return
+	}
+
+	contextReq := req.ContextReq
+	contextReq.ChannelId = channelId
+	result, err := s.messageContextAs(req.Uid, contextReq)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	// 个人频道替换成真实频道
+	if req.ChannelType == wkproto.ChannelTypePerson {
+		for _, msg := range result.Messages {
+			msg.ChannelId = getRealChannelId(req.Uid, msg.ChannelId)
+		}
+	}
 	c.JSON(http.StatusOK, result)
 }
 
+// 指定了uid时只能获取uid所在频道的消息
+func (s Search) messageContextAs(uid string, req search.ContextReq) (*search.ContextResp, error) {
+	if strings.TrimSpace(uid) == "" {
+		return s.s.MessageContext(req)
+	}
+	conversationChannelResp, err := pdk.S.ConversationChannels(uid)
+	if err != nil {
+		return nil, err
+	}
+	return s.s.MessageContextAs(uid, conversationChannelResp.Channels, req)
+}
+
+func (s Search) messageEvent(c *pdk.HttpContext) {
+	var req struct {
+		ChannelId   string `json:"channel_id"`   // 消息所属频道，指定后转发到频道所属节点处理
+		ChannelType uint8  `json:"channel_type"` // 频道类型
+		search.MessageEvent
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := req.Check(); err != nil {
+		c.ResponseError(err)
+		return
+	}
+
+	if s.forwardToChannelNode(c, req.ChannelId, req.ChannelType) {
+		return
+	}
+
+	if err := s.s.HandleMessageEvent(&req.MessageEvent); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": http.StatusOK,
+	})
+}
+
+func (s Search) messagePurge(c *pdk.HttpContext) {
+	var req struct {
+		ChannelId   string  `json:"channel_id"`   // 消息所属频道，指定后转发到频道所属节点处理
+		ChannelType uint8   `json:"channel_type"` // 频道类型
+		MessageIds  []int64 `json:"message_ids"`  // 需要清除的消息id
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if len(req.MessageIds) == 0 {
+		c.ResponseError(fmt.Errorf("message_ids is empty"))
+		return
+	}
+
+	if s.forwardToChannelNode(c, req.ChannelId, req.ChannelType) {
+		return
+	}
+
+	if err := s.s.RemoveIndex(req.MessageIds); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": http.StatusOK,
+		"count":  len(req.MessageIds),
+	})
+}
+
+func (s Search) reindex(c *pdk.HttpContext) {
+	var req search.ReindexReq
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+
+	// 单个频道在频道所属节点重建
+	if len(req.Channels) == 0 && !req.All && s.forwardToChannelNode(c, req.ChannelId, req.ChannelType) {
+		return
+	}
+
+	progress, err := s.s.StartReindex(req)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+func (s Search) reindexStatus(c *pdk.HttpContext) {
+	s.responseReindexProgress(c, s.s.ReindexProgress)
+}
+
+func (s Search) reindexPause(c *pdk.HttpContext) {
+	s.responseReindexProgress(c, s.s.PauseReindex)
+}
+
+func (s Search) reindexResume(c *pdk.HttpContext) {
+	s.responseReindexProgress(c, s.s.ResumeReindex)
+}
+
+func (s Search) reindexCancel(c *pdk.HttpContext) {
+	s.responseReindexProgress(c, s.s.CancelReindex)
+}
+
+func (s Search) responseReindexProgress(c *pdk.HttpContext, fn func() (search.ReindexProgress, error)) {
+	progress, err := fn()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, progress)
+}
+
+func (s Search) retentionCleanup(c *pdk.HttpContext) {
+	result, err := s.s.CleanupRetention()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s Search) retentionPartitions(c *pdk.HttpContext) {
+	partitions, err := s.s.Partitions()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, partitions)
+}
+
+func (s Search) backup(c *pdk.HttpContext) {
+	info, err := s.s.Backup()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func (s Search) backupList(c *pdk.HttpContext) {
+	backups, err := s.s.Backups()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, backups)
+}
+
+func (s Search) backupRestore(c *pdk.HttpContext) {
+	var req struct {
+		Name string `json:"name"` // 备份文件名
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	info, err := s.s.RestoreBackup(req.Name)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func (s Search) metrics(c *pdk.HttpContext) {
+	var buf bytes.Buffer
+	if err := s.s.WriteMetrics(&buf); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.Response.Status = http.StatusOK
+	c.Response.Body = buf.Bytes()
+	c.Response.Headers["Content-Type"] = "text/plain; version=0.0.4; charset=utf-8"
+}
+
+func (s Search) status(c *pdk.HttpContext) {
+	status, err := s.s.Status()
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// 如果频道不属于当前节点，将请求原样转发到频道所属节点，返回true表示已转发
+func (s Search) forwardToChannelNode(c *pdk.HttpContext, channelId string, channelType uint8) bool {
+	if strings.TrimSpace(channelId) == "" {
+		return false
+	}
+	belongNodeResp, err := pdk.S.ClusterChannelBelongNode(&pluginproto.ClusterChannelBelongNodeReq{
+		Channels: []*pluginproto.Channel{
+			{
+				ChannelId:   channelId,
+				ChannelType: uint32(channelType),
+			},
+		},
+	})
+	if err != nil {
+		c.ResponseError(err)
+		return true
+	}
+	if len(belongNodeResp.ClusterChannelBelongNodeResps) == 0 {
+		return false
+	}
+	nodeId := belongNodeResp.ClusterChannelBelongNodeResps[0].NodeId
+	if nodeId == 0 || nodeId == pdk.S.NodeId() {
+		return false
+	}
+	resp, err := pdk.S.ForwardHttp(&pluginproto.ForwardHttpReq{
+		PluginNo: pluginNo,
+		ToNodeId: int64(nodeId),
+		Request:  c.Request,
+	})
+	if err != nil {
+		c.ResponseError(err)
+		return true
+	}
+	c.Response.Status = resp.Status
+	c.Response.Body = resp.Body
+	for k, v := range resp.Headers {
+		c.Response.Headers[k] = v
+	}
+	return true
+}
+
 func (s Search) Stop() {
 	s.s.Stop()
 }
@@ -85,7 +591,8 @@ func (s Search) Stop() {
 func (s Search) usersearch(c *pdk.HttpContext) {
 
 	var req struct {
-		Uid string `json:"uid"`
+		Uid     string `json:"uid"`
+		Timeout int    `json:"timeout"` // 等待各节点返回的超时时间（毫秒），默认5秒
 		search.SearchReq
 	}
 	if err := c.BindJSON(&req); err != nil {
@@ -98,25 +605,44 @@ func (s Search) usersearch(c *pdk.HttpContext) {
 		return
 	}
 
+	result, err := s.userSearch(c.Request.Headers, req.Uid, req.Timeout, req.SearchReq)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+
+	// 记录搜索历史
+	if q := searchText(req.SearchReq); q != "" {
+		go s.addSearchHistory(c.Request.Headers, req.Uid, q)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 在用户所有会话中搜索，转发到各频道所属节点后合并结果
+func (s Search) userSearch(headers map[string]string, uid string, timeoutMs int, req search.SearchReq) (*search.SearchResp, error) {
 	if req.Limit <= 0 || req.Limit > 1000 {
 		req.Limit = 20
 	}
 
+	// 先在本节点校验，避免每个节点都返回相同的参数错误
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+
 	if strings.TrimSpace(req.ChannelId) != "" && req.ChannelType == wkproto.ChannelTypePerson {
-		req.ChannelId = pdk.GetFakeChannelIDWith(req.Uid, req.ChannelId)
+		req.ChannelId = pdk.GetFakeChannelIDWith(uid, req.ChannelId)
 	}
 
 	// 获取用户的会话列表
-	conversationChannelResp, err := pdk.S.ConversationChannels(req.Uid)
+	conversationChannelResp, err := pdk.S.ConversationChannels(uid)
 	if err != nil {
-		c.ResponseError(err)
-		return
+		return nil, err
 	}
 	if len(conversationChannelResp.Channels) == 0 {
-		c.JSON(http.StatusOK, search.SearchResp{
+		return &search.SearchResp{
 			Messages: []*search.Message{},
-		})
-		return
+		}, nil
 	}
 
 	channels := conversationChannelResp.Channels
@@ -126,99 +652,519 @@ func (s Search) usersearch(c *pdk.HttpContext) {
 		Channels: channels,
 	})
 	if err != nil {
+		return nil, err
+	}
+	channelBelongNodeResps := channelBelogNodeBatchResp.ClusterChannelBelongNodeResps
+
+	nodeReqs := make([]nodeRequest, 0, len(channelBelongNodeResps))
+	for _, channelBelongNodeResp := range channelBelongNodeResps {
+		if len(channelBelongNodeResp.Channels) == 0 {
+			continue
+		}
+		// 各节点再次校验uid所在的频道
+		bodyData, _ := json.Marshal(searchBody{
+			Uid:       uid,
+			SearchReq: req.NodeReq(channelBelongNodeResp.Channels),
+		})
+		nodeReqs = append(nodeReqs, nodeRequest{
+			nodeId: channelBelongNodeResp.NodeId,
+			body:   bodyData,
+		})
+	}
+
+	resps := make([]*search.SearchResp, 0, len(nodeReqs))
+	nodeResps, failures := s.forwardNodes("/search", headers, nodeReqs, nodeTimeout(timeoutMs))
+	for _, nodeResp := range nodeResps {
+		resp := &search.SearchResp{}
+		if err := json.Unmarshal(nodeResp.body, resp); err != nil {
+			failures = append(failures, &search.NodeError{
+				NodeId: nodeResp.nodeId,
+				Error:  err.Error(),
+			})
+			continue
+		}
+		// 个人频道替换成真实频道
+		for _, msg := range resp.Messages {
+			if msg.ChannelType == wkproto.ChannelTypePerson {
+				msg.ChannelId = getRealChannelId(uid, msg.ChannelId)
+			}
+		}
+		for _, group := range resp.Groups {
+			if group.ChannelType == wkproto.ChannelTypePerson {
+				group.ChannelId = getRealChannelId(uid, group.ChannelId)
+				if group.Message != nil {
+					group.Message.ChannelId = group.ChannelId
+				}
+			}
+		}
+		if facet := resp.Facets[search.FacetChannelId]; facet != nil {
+			for _, term := range facet.Terms {
+				if isPersonChannelOf(uid, term.Term) {
+					term.Term = getRealChannelId(uid, term.Term)
+				}
+			}
+		}
+		resps = append(resps, resp)
+	}
+
+	// 所有节点都失败才返回错误
+	if len(resps) == 0 && len(failures) > 0 {
+		return nil, fmt.Errorf("search failed on all nodes: %s", failures[0].Error)
+	}
+
+	result := search.MergeSearchResps(req, resps)
+	if len(failures) > 0 {
+		result.Failures = failures
+	}
+	return result, nil
+}
+
+// 搜索内容，用于记录搜索历史
+func searchText(req search.SearchReq) string {
+	if strings.TrimSpace(req.Q) != "" {
+		return strings.TrimSpace(req.Q)
+	}
+	return strings.TrimSpace(req.Payload["content"])
+}
+
+func (s Search) suggest(c *pdk.HttpContext) {
+	var req struct {
+		Uid     string `json:"uid"`
+		Timeout int    `json:"timeout"` // 等待各节点返回的超时时间（毫秒），默认5秒
+		search.SuggestReq
+	}
+	if err := c.BindJSON(&req); err != nil {
 		c.ResponseError(err)
 		return
 	}
-	channelBelongNodeResps := channelBelogNodeBatchResp.ClusterChannelBelongNodeResps
+	if req.Uid == "" {
+		c.ResponseError(fmt.Errorf("uid is empty"))
+		return
+	}
+	if err := req.Check(); err != nil {
+		responseSearchError(c, err)
+		return
+	}
 
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	g, _ := errgroup.WithContext(timeoutCtx)
+	// 在保存搜索历史的节点处理
+	if s.forwardToUserNode(c, req.Uid) {
+		return
+	}
 
-	messages := make([]*search.Message, 0)
-	messageLock := sync.Mutex{}
+	history, err := s.s.SuggestHistory(req.Uid, req.Q, req.Limit)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
 
-	var maxCost uint64  // 最大耗时
-	var maxTotal uint64 // 最大消息数量
-	for _, channelBelongNodeResp := range channelBelongNodeResps {
-		nodeId := channelBelongNodeResp.NodeId
+	// 补全内容限制在用户的会话中
+	conversationChannelResp, err := pdk.S.ConversationChannels(req.Uid)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if len(conversationChannelResp.Channels) == 0 {
+		c.JSON(http.StatusOK, search.SuggestResp{
+			Terms:   []*search.SuggestTerm{},
+			Uids:    []*search.SuggestTerm{},
+			History: history,
+		})
+		return
+	}
+	channelBelogNodeBatchResp, err := pdk.S.ClusterChannelBelongNode(&pluginproto.ClusterChannelBelongNodeReq{
+		Channels: conversationChannelResp.Channels,
+	})
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
 
-		channels := channelBelongNodeResp.Channels
+	nodeReqs := make([]nodeRequest, 0)
+	for _, channelBelongNodeResp := range channelBelogNodeBatchResp.ClusterChannelBelongNodeResps {
+		if len(channelBelongNodeResp.Channels) == 0 {
+			continue
+		}
+		nodeReq := req.SuggestReq
+		nodeReq.Channels = channelBelongNodeResp.Channels
+		// 各节点再次校验uid所在的频道
+		bodyData, _ := json.Marshal(suggestBody{
+			Uid:        req.Uid,
+			SuggestReq: nodeReq,
+		})
+		nodeReqs = append(nodeReqs, nodeRequest{
+			nodeId: channelBelongNodeResp.NodeId,
+			body:   bodyData,
+		})
+	}
 
-		if len(channels) == 0 {
+	resps := make([]*search.SuggestResp, 0, len(nodeReqs))
+	nodeResps, failures := s.forwardNodes("/suggest/channels", c.Request.Headers, nodeReqs, nodeTimeout(req.Timeout))
+	for _, nodeResp := range nodeResps {
+		resp := &search.SuggestResp{}
+		if err := json.Unmarshal(nodeResp.body, resp); err != nil {
+			s.Warn("decode node suggest error", zap.Error(err), zap.Uint64("nodeId", nodeResp.nodeId))
 			continue
 		}
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 && len(failures) > 0 {
+		c.ResponseError(fmt.Errorf("suggest failed on all nodes: %s", failures[0].Error))
+		return
+	}
 
-		cloneReq := req.SearchReq.Clone()
-		cloneReq.Channels = channels
+	result := search.MergeSuggestResps(req.SuggestReq, resps)
+	result.History = history
+	c.JSON(http.StatusOK, result)
+}
 
-		bodyData, _ := json.Marshal(cloneReq)
+// /suggest/channels的请求，指定uid后只能补全uid所在频道的内容
+type suggestBody struct {
+	Uid string `json:"uid"`
+	search.SuggestReq
+}
 
-		headerMap := c.Request.Headers
+// 在指定频道内补全，由suggest转发到频道所属节点
+func (s Search) suggestChannels(c *pdk.HttpContext) {
+	var req suggestBody
+	if err := c.BindJSON(&req); err != nil {
+		c.ResponseError(err)
+		return
+	}
+	if err := search.CheckSearchUid(req.Uid); err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	var (
+		result *search.SuggestResp
+		err    error
+	)
+	if strings.TrimSpace(req.Uid) == "" {
+		result, err = s.s.Suggest(req.SuggestReq)
+	} else {
+		result, err = s.suggestAs(req.Uid, req.SuggestReq)
+	}
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
 
-		g.Go(func() error {
-			// 转发请求到频道所属节点
-			resp, err := pdk.S.ForwardHttp(&pluginproto.ForwardHttpReq{
-				PluginNo: pluginNo,
-				ToNodeId: int64(nodeId),
-				Request: &pluginproto.HttpRequest{
-					Method:  "POST",
-					Headers: headerMap,
-					Path:    "/search",
-					Body:    bodyData,
-				},
-			})
-			if err != nil {
-				return err
-			}
+// 在uid所在的频道中补全当前节点的内容，请求了其他频道返回403
+func (s Search) suggestAs(uid string, req search.SuggestReq) (*search.SuggestResp, error) {
+	conversationChannelResp, err := pdk.S.ConversationChannels(uid)
+	if err != nil {
+		return nil, err
+	}
+	return s.s.SuggestAs(uid, conversationChannelResp.Channels, req)
+}
 
-			searchResp := &search.SearchResp{}
-			err = json.Unmarshal(resp.Body, searchResp)
-			if err != nil {
-				return err
-			}
-			messageLock.Lock()
+func (s Search) historyAdd(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+		Q   string `json:"q"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	s.responseStatus(c, s.s.AddSearchHistory(req.Uid, req.Q))
+}
 
-			// 个人频道替换成真实频道
-			for _, msg := range searchResp.Messages {
-				if msg.ChannelType == wkproto.ChannelTypePerson {
-					msg.ChannelId = getRealChannelId(req.Uid, msg.ChannelId)
-				}
-			}
-			messages = append(messages, searchResp.Messages...)
-			if searchResp.Cost > maxCost {
-				maxCost = searchResp.Cost
-			}
-			if searchResp.Total > maxTotal {
-				maxTotal = searchResp.Total
-			}
-			messageLock.Unlock()
+func (s Search) historyList(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	histories, err := s.s.SearchHistories(req.Uid)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, histories)
+}
 
-			return nil
-		})
+func (s Search) historyDelete(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+		Q   string `json:"q"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	s.responseStatus(c, s.s.DeleteSearchHistory(req.Uid, req.Q))
+}
+
+func (s Search) historyClear(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	s.responseStatus(c, s.s.ClearSearchHistory(req.Uid))
+}
+
+func (s Search) savedList(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	saved, err := s.s.SavedSearches(req.Uid)
+	if err != nil {
+		c.ResponseError(err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+func (s Search) savedAdd(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+		search.SavedSearch
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	saved, err := s.s.AddSavedSearch(req.Uid, &req.SavedSearch)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+func (s Search) savedUpdate(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+		search.SavedSearch
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	saved, err := s.s.UpdateSavedSearch(req.Uid, &req.SavedSearch)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+func (s Search) savedDelete(c *pdk.HttpContext) {
+	var req struct {
+		Uid string `json:"uid"`
+		Id  string `json:"id"`
+	}
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	s.responseStatus(c, s.s.DeleteSavedSearch(req.Uid, req.Id))
+}
+
+// 执行保存的搜索
+func (s Search) savedRun(c *pdk.HttpContext) {
+	var req struct {
+		Uid     string `json:"uid"`
+		Id      string `json:"id"`
+		Page    int    `json:"page"`    // 页码，不指定使用保存的页码
+		Limit   int    `json:"limit"`   // 消息数量限制，不指定使用保存的数量
+		Cursor  string `json:"cursor"`  // 分页游标
+		Timeout int    `json:"timeout"` // 等待各节点返回的超时时间（毫秒），默认5秒
 	}
-	err = g.Wait()
+	if !s.bindUserReq(c, &req, &req.Uid) {
+		return
+	}
+	saved, err := s.s.GetSavedSearch(req.Uid, req.Id)
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	searchReq := saved.SearchReq(time.Now())
+	if req.Page > 0 {
+		searchReq.Page = req.Page
+	}
+	if req.Limit > 0 {
+		searchReq.Limit = req.Limit
+	}
+	if req.Cursor != "" {
+		searchReq.Cursor = req.Cursor
+	}
+	result, err := s.userSearch(c.Request.Headers, req.Uid, req.Timeout, searchReq)
 	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// 解析用户数据相关的请求，用户数据不在当前节点时转发到用户所属节点，返回true表示需要继续处理
+func (s Search) bindUserReq(c *pdk.HttpContext, req interface{}, uid *string) bool {
+	if err := c.BindJSON(req); err != nil {
 		c.ResponseError(err)
+		return false
+	}
+	if *uid == "" {
+		c.ResponseError(fmt.Errorf("uid is empty"))
+		return false
+	}
+	return !s.forwardToUserNode(c, *uid)
+}
+
+func (s Search) responseStatus(c *pdk.HttpContext, err error) {
+	if err != nil {
+		responseSearchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": http.StatusOK,
+	})
+}
+
+// 记录搜索历史，保存在用户所属的节点
+func (s Search) addSearchHistory(headers map[string]string, uid string, q string) {
+	nodeId, err := userNodeId(uid)
+	if err != nil {
+		s.Warn("get user node error", zap.Error(err), zap.String("uid", uid))
 		return
 	}
+	if nodeId == 0 || nodeId == pdk.S.NodeId() {
+		if err = s.s.AddSearchHistory(uid, q); err != nil {
+			s.Warn("add search history error", zap.Error(err), zap.String("uid", uid))
+		}
+		return
+	}
+	bodyData, _ := json.Marshal(map[string]string{
+		"uid": uid,
+		"q":   q,
+	})
+	if _, err = forwardNode(nodeId, "/history/add", headers, bodyData); err != nil {
+		s.Warn("forward search history error", zap.Error(err), zap.String("uid", uid), zap.Uint64("nodeId", nodeId))
+	}
+}
 
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Timestamp > messages[j].Timestamp
+// 用户数据（搜索历史等）保存在uid作为频道时所属的节点
+func userNodeId(uid string) (uint64, error) {
+	resp, err := pdk.S.ClusterChannelBelongNode(&pluginproto.ClusterChannelBelongNodeReq{
+		Channels: []*pluginproto.Channel{
+			{
+				ChannelId:   uid,
+				ChannelType: uint32(wkproto.ChannelTypePerson),
+			},
+		},
 	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.ClusterChannelBelongNodeResps) == 0 {
+		return 0, nil
+	}
+	return resp.ClusterChannelBelongNodeResps[0].NodeId, nil
+}
+
+// 如果用户数据不在当前节点，将请求原样转发到用户所属节点，返回true表示已转发
+func (s Search) forwardToUserNode(c *pdk.HttpContext, uid string) bool {
+	return s.forwardToChannelNode(c, uid, wkproto.ChannelTypePerson)
+}
 
-	// 截取前limit条消息
-	if len(messages) > req.Limit {
-		messages = messages[:req.Limit]
+// 多节点请求的超时时间（毫秒），默认5秒
+func nodeTimeout(timeoutMs int) time.Duration {
+	if timeoutMs <= 0 {
+		return defaultNodeTimeout
 	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout > maxNodeTimeout {
+		timeout = maxNodeTimeout
+	}
+	return timeout
+}
+
+type nodeRequest struct {
+	nodeId uint64
+	body   []byte
+}
 
-	c.JSON(http.StatusOK, &search.SearchResp{
-		Cost:     maxCost,
-		Total:    maxTotal,
-		Page:     req.Page,
-		Limit:    req.Limit,
-		Messages: messages,
+type nodeResponse struct {
+	nodeId uint64
+	body   []byte
+	err    error
+}
+
+// 并发转发请求到各节点，失败或超时的节点记为失败，不影响其他节点的结果
+func (s Search) forwardNodes(path string, headers map[string]string, reqs []nodeRequest, timeout time.Duration) ([]nodeResponse, []*search.NodeError) {
+	resps := make([]nodeResponse, 0, len(reqs))
+	failures := make([]*search.NodeError, 0)
+	results := make(chan nodeResponse, len(reqs))
+	pending := make(map[uint64]struct{})
+	for _, req := range reqs {
+		req := req
+		pending[req.nodeId] = struct{}{}
+		go func() {
+			body, err := forwardNode(req.nodeId, path, headers, req.body)
+			results <- nodeResponse{
+				nodeId: req.nodeId,
+				body:   body,
+				err:    err,
+			}
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.nodeId)
+			if result.err != nil {
+				s.Warn("forward node error", zap.Error(result.err), zap.String("path", path), zap.Uint64("nodeId", result.nodeId))
+				failures = append(failures, &search.NodeError{
+					NodeId: result.nodeId,
+					Error:  result.err.Error(),
+				})
+				continue
+			}
+			resps = append(resps, result)
+		case <-timer.C:
+			for nodeId := range pending {
+				s.Warn("forward node timeout", zap.String("path", path), zap.Uint64("nodeId", nodeId), zap.Duration("timeout", timeout))
+				failures = append(failures, &search.NodeError{
+					NodeId: nodeId,
+					Error:  "timeout",
+				})
+				delete(pending, nodeId)
+			}
+		}
+	}
+	return resps, failures
+}
+
+// 转发请求到节点
+func forwardNode(nodeId uint64, path string, headers map[string]string, body []byte) ([]byte, error) {
+	resp, err := pdk.S.ForwardHttp(&pluginproto.ForwardHttpReq{
+		PluginNo: pluginNo,
+		ToNodeId: int64(nodeId),
+		Request: &pluginproto.HttpRequest{
+			Method:  "POST",
+			Headers: headers,
+			Path:    path,
+			Body:    body,
+		},
 	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.Status, string(resp.Body))
+	}
+	return resp.Body, nil
+}
+
+// 是否是用户的个人频道（由两个uid组成的频道id）
+func isPersonChannelOf(uid, channelId string) bool {
+	uids := strings.Split(channelId, "@")
+	return len(uids) == 2 && (uids[0] == uid || uids[1] == uid)
 }
 
 func getRealChannelId(uid, channelId string) string {
@@ -0,0 +1,192 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
+)
+
+// 加入频道的时间允许早于当前时间的误差（节点之间的时钟误差）
+const memberJoinedSkew = time.Minute
+
+// 搜索的权限配置
+type AccessOptions struct {
+	RequireUid     bool // 必须指定uid，只能访问uid所在的频道；关闭时不指定uid可以访问所有频道（供服务端调用）
+	HideBeforeJoin bool // 不返回用户加入频道之前的消息，加入时间通过SetMemberJoined设置
+}
+
+var (
+	accessOptionsLock sync.RWMutex
+	accessOptions     AccessOptions
+)
+
+// SetAccessOptions 设置搜索的权限配置
+func SetAccessOptions(opts AccessOptions) {
+	accessOptionsLock.Lock()
+	defer accessOptionsLock.Unlock()
+	accessOptions = opts
+}
+
+func getAccessOptions() AccessOptions {
+	accessOptionsLock.RLock()
+	defer accessOptionsLock.RUnlock()
+	return accessOptions
+}
+
+var ErrSearchUidRequired = newBadRequest("uid is required")
+
+// ForbiddenError 没有权限访问请求的频道
+type ForbiddenError struct {
+	msg string
+}
+
+func newForbidden(format string, args ...interface{}) *ForbiddenError {
+	return &ForbiddenError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.msg
+}
+
+// IsForbidden 是否是没有权限的错误
+func IsForbidden(err error) bool {
+	var e *ForbiddenError
+	return errors.As(err, &e)
+}
+
+// CheckSearchUid 配置了必须指定uid时，uid不能为空
+func CheckSearchUid(uid string) error {
+	if getAccessOptions().RequireUid && strings.TrimSpace(uid) == "" {
+		return ErrSearchUidRequired
+	}
+	return nil
+}
+
+// SearchAs 以uid的身份搜索，members为uid所在的频道（会话列表）
+// 请求的频道（channels、channel_id）必须是uid所在的频道，否则返回ForbiddenError，没有指定频道时在uid所在的所有频道中搜索
+func (s *Search) SearchAs(uid string, members []*pluginproto.Channel, req SearchReq) (*SearchResp, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	channels, err := authorizeChannels(members, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return &SearchResp{
+			Limit:    req.Limit,
+			Page:     req.Page,
+			Messages: []*Message{},
+		}, nil
+	}
+	req.Channels = channels
+	req.ChannelId = ""
+	req.ChannelType = 0
+	if getAccessOptions().HideBeforeJoin {
+		if req.joinedAt, err = s.memberJoinedAt(uid, channels); err != nil {
+			return nil, err
+		}
+	}
+	return s.Search(req)
+}
+
+// SuggestAs 以uid的身份补全，members为uid所在的频道（会话列表），请求的频道不属于uid时返回ForbiddenError
+func (s *Search) SuggestAs(uid string, members []*pluginproto.Channel, req SuggestReq) (*SuggestResp, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	channels, err := authorizeChannels(members, SearchReq{Channels: req.Channels})
+	if err != nil {
+		return nil, err
+	}
+	req.Channels = channels
+	if getAccessOptions().HideBeforeJoin {
+		if req.joinedAt, err = s.memberJoinedAt(uid, channels); err != nil {
+			return nil, err
+		}
+	}
+	return s.Suggest(req)
+}
+
+// 请求的频道与uid所在频道的交集，请求了不属于uid的频道返回ForbiddenError
+func authorizeChannels(members []*pluginproto.Channel, req SearchReq) ([]*pluginproto.Channel, error) {
+	requested := make([]*pluginproto.Channel, 0, len(req.Channels)+1)
+	requested = append(requested, req.Channels...)
+	if strings.TrimSpace(req.ChannelId) != "" {
+		requested = append(requested, &pluginproto.Channel{
+			ChannelId:   req.ChannelId,
+			ChannelType: uint32(req.ChannelType),
+		})
+	}
+	for _, channel := range requested {
+		if len(matchChannels(members, channel)) == 0 {
+			return nil, newForbidden("no permission for channel: %s", channel.ChannelId)
+		}
+	}
+
+	channels := members
+	if len(req.Channels) > 0 {
+		matched := make([]*pluginproto.Channel, 0, len(req.Channels))
+		for _, channel := range req.Channels {
+			matched = append(matched, matchChannels(channels, channel)...)
+		}
+		channels = matched
+	}
+	if strings.TrimSpace(req.ChannelId) != "" {
+		channels = matchChannels(channels, requested[len(requested)-1])
+	}
+	return channels, nil
+}
+
+// channels中与channel相同的频道，频道类型为0时匹配所有类型
+func matchChannels(channels []*pluginproto.Channel, channel *pluginproto.Channel) []*pluginproto.Channel {
+	matched := make([]*pluginproto.Channel, 0, 1)
+	for _, c := range channels {
+		if c.ChannelId == channel.ChannelId && (channel.ChannelType == 0 || c.ChannelType == channel.ChannelType) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// SetMemberJoined 设置用户加入频道的时间（秒），joinedAt为0时使用当前时间
+// 加入时间由调用方传入，不能早于当前时间（允许memberJoinedSkew的时钟误差），防止提前加入时间查看之前的消息
+func (s *Search) SetMemberJoined(uid string, channelId string, channelType uint8, joinedAt uint32) error {
+	now := time.Now()
+	if joinedAt == 0 {
+		joinedAt = uint32(now.Unix())
+	}
+	if int64(joinedAt) < now.Add(-memberJoinedSkew).Unix() {
+		return newBadRequest("joined_at must not be in the past")
+	}
+	return s.db.setMemberJoined(uid, channelId, channelType, joinedAt)
+}
+
+// 用户加入各频道的时间，key为channelKey，没有记录的频道不限制
+func (s *Search) memberJoinedAt(uid string, channels []*pluginproto.Channel) (map[string]uint32, error) {
+	joinedAt := make(map[string]uint32)
+	for _, channel := range channels {
+		t, err := s.db.getMemberJoined(uid, channel.ChannelId, uint8(channel.ChannelType))
+		if err != nil {
+			return nil, err
+		}
+		if t > 0 {
+			joinedAt[channelKey(channel.ChannelId, uint8(channel.ChannelType))] = t
+		}
+	}
+	return joinedAt, nil
+}
+
+// timestamp >= since
+func newSinceQuery(since uint32) bleveQuery.Query {
+	start := float64(since)
+	q := bleve.NewNumericRangeQuery(&start, nil)
+	q.SetField("timestamp")
+	return q
+}
@@ -0,0 +1,149 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestAuthorizeChannels(t *testing.T) {
+	members := []*pluginproto.Channel{
+		{ChannelId: "g1", ChannelType: 2},
+		{ChannelId: "g2", ChannelType: 2},
+		{ChannelId: "g2", ChannelType: 3},
+		{ChannelId: "u1@u2", ChannelType: 1},
+	}
+	tests := []struct {
+		name          string
+		req           SearchReq
+		want          []string
+		wantForbidden bool
+	}{
+		{"all member channels", SearchReq{}, []string{"g1:2", "g2:2", "g2:3", "u1@u2:1"}, false},
+		{"channel id", SearchReq{ChannelId: "g1", ChannelType: 2}, []string{"g1:2"}, false},
+		{"channel id of any type", SearchReq{ChannelId: "g2"}, []string{"g2:2", "g2:3"}, false},
+		{"channels", SearchReq{Channels: []*pluginproto.Channel{{ChannelId: "g1", ChannelType: 2}, {ChannelId: "u1@u2", ChannelType: 1}}}, []string{"g1:2", "u1@u2:1"}, false},
+		{"channel id inside channels", SearchReq{ChannelId: "g2", ChannelType: 3, Channels: []*pluginproto.Channel{{ChannelId: "g2"}}}, []string{"g2:3"}, false},
+		{"channel id outside channels", SearchReq{ChannelId: "g1", Channels: []*pluginproto.Channel{{ChannelId: "g2"}}}, []string{}, false},
+		{"not a member", SearchReq{ChannelId: "g3", ChannelType: 2}, nil, true},
+		{"wrong channel type", SearchReq{ChannelId: "g1", ChannelType: 3}, nil, true},
+		{"one of channels not a member", SearchReq{Channels: []*pluginproto.Channel{{ChannelId: "g1", ChannelType: 2}, {ChannelId: "g3", ChannelType: 2}}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channels, err := authorizeChannels(members, tt.req)
+			if IsForbidden(err) != tt.wantForbidden {
+				t.Fatalf("authorizeChannels() error = %v, wantForbidden %v", err, tt.wantForbidden)
+			}
+			if tt.wantForbidden {
+				return
+			}
+			got := make([]string, 0, len(channels))
+			for _, c := range channels {
+				got = append(got, channelKey(c.ChannelId, uint8(c.ChannelType)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("authorizeChannels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSearchUid(t *testing.T) {
+	defer SetAccessOptions(AccessOptions{})
+	tests := []struct {
+		name       string
+		requireUid bool
+		uid        string
+		wantErr    bool
+	}{
+		{"open without uid", false, "", false},
+		{"required with uid", true, "u1", false},
+		{"required without uid", true, "", true},
+		{"required with blank uid", true, "  ", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetAccessOptions(AccessOptions{RequireUid: tt.requireUid})
+			if err := CheckSearchUid(tt.uid); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSearchUid() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetMemberJoined(t *testing.T) {
+	s := newTestSearch(t)
+	now := uint32(time.Now().Unix())
+	tests := []struct {
+		name     string
+		joinedAt uint32
+		wantErr  bool
+	}{
+		{"now by default", 0, false},
+		{"within clock skew", now - 10, false},
+		{"future", now + 3600, false},
+		{"backdated", now - 3600, true},
+		{"epoch", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.SetMemberJoined("u1", "c1", 2, tt.joinedAt)
+			if tt.wantErr {
+				if !IsBadRequest(err) {
+					t.Errorf("SetMemberJoined() error = %v, want bad request", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := s.db.getMemberJoined("u1", "c1", 2)
+			if want := tt.joinedAt; (want == 0 && got < now) || (want != 0 && got != want) {
+				t.Errorf("joined at = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSearchAsHideBeforeJoin(t *testing.T) {
+	s := newTestSearch(t)
+	old := newTestMessage("c1", 2, 1, "u2", "release")
+	old.Timestamp = uint32(time.Now().Add(-time.Hour).Unix())
+	recent := newTestMessage("c1", 2, 2, "u2", "release")
+	recent.Timestamp = uint32(time.Now().Add(time.Hour).Unix())
+	indexTestMessages(t, s, 0, old, recent)
+	members := []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 2}}
+	if err := s.SetMemberJoined("u1", "c1", 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func() []int64 {
+		resp, err := s.SearchAs("u1", members, SearchReq{Payload: map[string]string{"content": "release"}, Sort: SortTime, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, 0)
+		for _, m := range resp.Messages {
+			ids = append(ids, m.MessageId)
+		}
+		return ids
+	}
+	if got := search(); len(got) != 2 {
+		t.Errorf("search without HideBeforeJoin = %v, want 2 messages", got)
+	}
+	SetAccessOptions(AccessOptions{HideBeforeJoin: true})
+	defer SetAccessOptions(AccessOptions{})
+	if got := search(); !reflect.DeepEqual(got, []int64{recent.MessageId}) {
+		t.Errorf("search = %v, want [%d]", got, recent.MessageId)
+	}
+	// 不能提前加入时间查看之前的消息
+	if err := s.SetMemberJoined("u1", "c1", 2, old.Timestamp); err == nil {
+		t.Errorf("SetMemberJoined() accepted a backdated join time")
+	}
+	if got := search(); !reflect.DeepEqual(got, []int64{recent.MessageId}) {
+		t.Errorf("search = %v, want [%d]", got, recent.MessageId)
+	}
+}
@@ -0,0 +1,371 @@
+package search
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/lang/cjk"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/token/porter"
+	"github.com/blevesearch/bleve/v2/analysis/token/stop"
+	unicodeTokenizer "github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/v2/analysis/tokenmap"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/go-ego/gse"
+	"github.com/tidwall/gjson"
+	_ "github.com/vcaesar/gse-bleve" // 旧版本索引使用的gse分词器，迁移时需要打开
+)
+
+// 支持的语言分析器
+const (
+	LangZh       = "zh"       // 中文（gse分词）
+	LangJa       = "ja"       // 日文（gse分词）
+	LangEn       = "en"       // 英文（词干提取）
+	LangStandard = "standard" // 按空格和标点分词
+	LangCJK      = "cjk"      // 中日韩二元分词（适合韩文或没有词典的语言）
+)
+
+var analysisLangs = []string{LangZh, LangJa, LangEn, LangStandard, LangCJK}
+
+// 识别语言后可能写入的语言子字段
+var detectedLangs = []string{LangZh, LangJa, LangEn, LangCJK}
+
+// 识别语言后，消息内容按照语言写入的子字段，例如 lang_content.en
+const langContentField = "lang_content"
+
+const (
+	gseTokenizerName = "gse_lang"
+	customStopName   = "custom_stop"
+	// 自定义词典中没有指定词频时的词频
+	defaultUserDictFreq = 100
+)
+
+// 分词相关的选项，修改后索引会在后台迁移
+type AnalysisOptions struct {
+	Language       string   `json:"language"`        // 默认的语言分析器
+	DetectLanguage bool     `json:"detect_language"` // 识别每条消息的语言，写入对应语言的子字段
+	UserDict       []string `json:"user_dict"`       // 自定义词典（gse分词使用），每项为 词 或 词 词频
+	StopWords      []string `json:"stop_words"`      // 停用词
+}
+
+var DefaultAnalysisOptions = AnalysisOptions{
+	Language: LangZh,
+}
+
+var (
+	analysisOptionsLock sync.RWMutex
+	analysisOptions     = DefaultAnalysisOptions
+)
+
+// SetAnalysisOptions 设置分词选项，已打开的索引需要调用Search.ReloadAnalysis迁移
+func SetAnalysisOptions(opts AnalysisOptions) error {
+	if opts.Language == "" {
+		opts.Language = DefaultAnalysisOptions.Language
+	}
+	if !isAnalysisLang(opts.Language) {
+		return fmt.Errorf("unknown language: %s", opts.Language)
+	}
+	opts.UserDict = trimWords(opts.UserDict)
+	opts.StopWords = trimWords(opts.StopWords)
+
+	analysisOptionsLock.Lock()
+	defer analysisOptionsLock.Unlock()
+	analysisOptions = opts
+	return nil
+}
+
+func getAnalysisOptions() AnalysisOptions {
+	analysisOptionsLock.RLock()
+	defer analysisOptionsLock.RUnlock()
+	return analysisOptions
+}
+
+// ParseWords 解析逗号或换行分隔的词
+func ParseWords(text string) []string {
+	return trimWords(strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '，' || r == '\n' || r == '\r'
+	}))
+}
+
+func trimWords(words []string) []string {
+	result := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			result = appendUnique(result, w)
+		}
+	}
+	return result
+}
+
+func isAnalysisLang(lang string) bool {
+	for _, l := range analysisLangs {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// 选项的指纹，默认选项为空，不同的选项使用不同的索引目录
+// 中文变体的内容在写入时生成，选项也包含在指纹中，未开启时与之前的指纹相同
+func (o AnalysisOptions) fingerprint(zh ChineseOptions) string {
+	if o.Language == DefaultAnalysisOptions.Language && !o.DetectLanguage && len(o.UserDict) == 0 && len(o.StopWords) == 0 && zh == (ChineseOptions{}) {
+		return ""
+	}
+	var data []byte
+	if zh == (ChineseOptions{}) {
+		data, _ = json.Marshal(o)
+	} else {
+		data, _ = json.Marshal(struct {
+			AnalysisOptions
+			Chinese ChineseOptions `json:"chinese"`
+		}{o, zh})
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:4])
+}
+
+func langAnalyzerName(lang string) string {
+	return "lang_" + lang
+}
+
+func langTokenizerName(lang string) string {
+	return "gse_" + lang
+}
+
+// 注册各语言的分析器，返回默认语言的分析器名
+func addLangAnalyzers(indexMapping *mapping.IndexMappingImpl, opts AnalysisOptions) (string, error) {
+	langs := []string{opts.Language}
+	if opts.DetectLanguage {
+		langs = appendUnique(langs, detectedLangs...)
+	}
+	// 中文的繁简体、拼音子字段也使用中文分词
+	langs = appendUnique(langs, LangZh)
+
+	var stopFilters []string
+	if len(opts.StopWords) > 0 {
+		tokens := make([]interface{}, 0, len(opts.StopWords))
+		for _, w := range opts.StopWords {
+			tokens = append(tokens, strings.ToLower(w))
+		}
+		if err := indexMapping.AddCustomTokenMap(customStopName, map[string]interface{}{
+			"type":   tokenmap.Name,
+			"tokens": tokens,
+		}); err != nil {
+			return "", err
+		}
+		if err := indexMapping.AddCustomTokenFilter(customStopName, map[string]interface{}{
+			"type":           stop.Name,
+			"stop_token_map": customStopName,
+		}); err != nil {
+			return "", err
+		}
+		stopFilters = []string{customStopName}
+	}
+
+	userDict := make([]interface{}, 0, len(opts.UserDict))
+	for _, w := range opts.UserDict {
+		userDict = append(userDict, w)
+	}
+
+	for _, lang := range langs {
+		config := map[string]interface{}{
+			"type": custom.Name,
+		}
+		switch lang {
+		case LangZh, LangJa:
+			if err := indexMapping.AddCustomTokenizer(langTokenizerName(lang), map[string]interface{}{
+				"type":      gseTokenizerName,
+				"dict":      lang,
+				"user_dict": userDict,
+			}); err != nil {
+				return "", err
+			}
+			config["tokenizer"] = langTokenizerName(lang)
+			// 保存的mapping中不能为null，否则索引无法重新打开
+			if len(stopFilters) > 0 {
+				config["token_filters"] = stopFilters
+			}
+		case LangEn:
+			config["tokenizer"] = unicodeTokenizer.Name
+			config["token_filters"] = append([]string{en.PossessiveName, lowercase.Name, en.StopName}, append(stopFilters, porter.Name)...)
+		case LangStandard:
+			config["tokenizer"] = unicodeTokenizer.Name
+			config["token_filters"] = append([]string{lowercase.Name, en.StopName}, stopFilters...)
+		case LangCJK:
+			config["tokenizer"] = unicodeTokenizer.Name
+			config["token_filters"] = append([]string{cjk.WidthName, lowercase.Name, cjk.BigramName}, stopFilters...)
+		}
+		if err := indexMapping.AddCustomAnalyzer(langAnalyzerName(lang), config); err != nil {
+			return "", err
+		}
+	}
+	return langAnalyzerName(opts.Language), nil
+}
+
+// 识别语言时，添加各语言的内容子字段
+func addLangContentMappings(docMapping *mapping.DocumentMapping, opts AnalysisOptions) {
+	if !opts.DetectLanguage {
+		return
+	}
+	langContentMapping := bleve.NewDocumentStaticMapping()
+	for _, lang := range detectedLangs {
+		fieldMapping := bleve.NewTextFieldMapping()
+		fieldMapping.Analyzer = langAnalyzerName(lang)
+		fieldMapping.Store = false
+		fieldMapping.IncludeInAll = false
+		langContentMapping.AddFieldMappingsAt(lang, fieldMapping)
+	}
+	docMapping.AddSubDocumentMapping(langContentField, langContentMapping)
+}
+
+// 根据文字识别消息的语言，返回 zh ja ko en，无法识别返回空
+func detectLanguage(text string) string {
+	var han, kana, hangul, latin int
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case r <= unicode.MaxLatin1 && unicode.IsLetter(r):
+			latin++
+		}
+	}
+	switch {
+	case kana > 0:
+		return "ja"
+	case hangul > 0 && hangul >= han:
+		return "ko"
+	case han > 0:
+		return "zh"
+	case latin > 0:
+		return "en"
+	}
+	return ""
+}
+
+// 语言使用的分析器
+func langAnalysis(lang string) string {
+	switch lang {
+	case "zh":
+		return LangZh
+	case "ja":
+		return LangJa
+	case "ko":
+		return LangCJK
+	case "en":
+		return LangEn
+	}
+	return ""
+}
+
+// 识别消息内容的语言，与默认语言不同时写入对应语言的子字段
+func (m *Message) parseLanguage(payload gjson.Result) {
+	content := payload.Get("content").String()
+	if content == "" {
+		return
+	}
+	m.Lang = detectLanguage(content)
+	opts := getAnalysisOptions()
+	if !opts.DetectLanguage {
+		return
+	}
+	if lang := langAnalysis(m.Lang); lang != "" && lang != opts.Language {
+		m.LangContent = map[string]string{lang: content}
+	}
+}
+
+// 内容查询同时搜索其他语言的子字段和中文变体，build根据字段生成与原查询相同的查询
+func withContentVariants(field string, text string, opts MatchOptions, build func(field string) query.Query) query.Query {
+	q := build(field)
+	if field != queryDefaultField {
+		return q
+	}
+	queries := make([]query.Query, 0)
+	if analysisOpts := getAnalysisOptions(); analysisOpts.DetectLanguage {
+		for _, lang := range detectedLangs {
+			if lang == analysisOpts.Language {
+				continue
+			}
+			queries = append(queries, build(fmt.Sprintf("%s.%s", langContentField, lang)))
+		}
+	}
+	queries = append(queries, chineseVariantQueries(text, opts)...)
+	if len(queries) == 0 {
+		return q
+	}
+	return bleve.NewDisjunctionQuery(append([]query.Query{q}, queries...)...)
+}
+
+// gse分词器，支持加载自定义词典
+type gseTokenizer struct {
+	seg *gse.Segmenter
+}
+
+func (t *gseTokenizer) Tokenize(text []byte) analysis.TokenStream {
+	result := make(analysis.TokenStream, 0)
+	str := string(text)
+	cuts := t.seg.Trim(t.seg.CutSearch(str, true))
+	for _, az := range t.seg.Analyze(cuts, str) {
+		result = append(result, &analysis.Token{
+			Term:     []byte(az.Text),
+			Start:    az.Start,
+			End:      az.End,
+			Position: az.Position,
+			Type:     analysis.Ideographic,
+		})
+	}
+	return result
+}
+
+func gseTokenizerConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.Tokenizer, error) {
+	dict, _ := config["dict"].(string)
+	if dict == "" {
+		dict = LangZh
+	}
+	seg := &gse.Segmenter{SkipLog: true}
+	if err := seg.LoadDictEmbed(dict); err != nil {
+		return nil, err
+	}
+	userDict, _ := config["user_dict"].([]interface{})
+	for _, item := range userDict {
+		word, _ := item.(string)
+		fields := strings.Fields(word)
+		if len(fields) == 0 {
+			continue
+		}
+		freq := float64(defaultUserDictFreq)
+		if len(fields) > 1 {
+			if f, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil && f > 0 {
+				freq = f
+				fields = fields[:len(fields)-1]
+			}
+		}
+		if err := seg.AddToken(strings.Join(fields, " "), freq); err != nil {
+			return nil, err
+		}
+	}
+	if len(userDict) > 0 {
+		seg.CalcToken()
+	}
+	return &gseTokenizer{seg: seg}, nil
+}
+
+func init() {
+	registry.RegisterTokenizer(gseTokenizerName, gseTokenizerConstructor)
+}
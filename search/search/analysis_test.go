@@ -0,0 +1,151 @@
+package search
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// 使用指定的分词选项创建新索引，测试结束后恢复默认选项
+func useTestAnalysis(t *testing.T, s *Search, opts AnalysisOptions) {
+	t.Helper()
+	if err := SetAnalysisOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetAnalysisOptions(DefaultAnalysisOptions) })
+	index, err := createMessageIndexDir(filepath.Join(t.TempDir(), "index"), s.buildMessageMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	s.setActiveIndex(index)
+}
+
+func TestSetAnalysisOptions(t *testing.T) {
+	defer SetAnalysisOptions(DefaultAnalysisOptions)
+	if err := SetAnalysisOptions(AnalysisOptions{Language: "fr"}); err == nil {
+		t.Errorf("SetAnalysisOptions() with unknown language error = nil")
+	}
+	if err := SetAnalysisOptions(AnalysisOptions{StopWords: []string{" the ", "", "the", "a"}, UserDict: []string{"悟空 200 "}}); err != nil {
+		t.Fatal(err)
+	}
+	want := AnalysisOptions{Language: LangZh, StopWords: []string{"the", "a"}, UserDict: []string{"悟空 200"}}
+	if got := getAnalysisOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("getAnalysisOptions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseWords(t *testing.T) {
+	if got, want := ParseWords("a, b，c\n\r\n a ,"), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseWords() = %v, want %v", got, want)
+	}
+}
+
+func TestAnalysisFingerprint(t *testing.T) {
+	en := AnalysisOptions{Language: LangEn}
+	tests := []struct {
+		name  string
+		a, b  AnalysisOptions
+		equal bool
+	}{
+		{"same options", en, AnalysisOptions{Language: LangEn}, true},
+		{"language", en, AnalysisOptions{Language: LangCJK}, false},
+		{"stop words", en, AnalysisOptions{Language: LangEn, StopWords: []string{"foo"}}, false},
+		{"user dict", AnalysisOptions{Language: LangZh, UserDict: []string{"悟空"}}, AnalysisOptions{Language: LangZh, UserDict: []string{"悟空 10"}}, false},
+		{"detect language", en, AnalysisOptions{Language: LangEn, DetectLanguage: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tt.a.fingerprint(ChineseOptions{}), tt.b.fingerprint(ChineseOptions{})
+			if a == "" || b == "" || (a == b) != tt.equal {
+				t.Errorf("fingerprint() = %q %q, want equal %v", a, b, tt.equal)
+			}
+		})
+	}
+	if got := DefaultAnalysisOptions.fingerprint(ChineseOptions{}); got != "" {
+		t.Errorf("fingerprint() of default options = %q, want empty", got)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello world", "en"},
+		{"你好世界", "zh"},
+		{"こんにちは世界", "ja"},
+		{"안녕하세요", "ko"},
+		{"hello 你好", "zh"},
+		{"123 !!", ""},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// 按照消息内容搜索，返回排序后的消息ID
+func searchSortedIds(t *testing.T, s *Search, content string) []int64 {
+	t.Helper()
+	ids := searchTestContent(t, s, content)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestSearchEnglishStopWords(t *testing.T) {
+	s := newTestSearch(t)
+	useTestAnalysis(t, s, AnalysisOptions{Language: LangEn, StopWords: []string{"Foo"}})
+	m1 := newTestMessage("c1", 2, 1, "u1", "running the tests")
+	m2 := newTestMessage("c1", 2, 2, "u1", "foo bar")
+	indexTestMessages(t, s, 0, m1, m2)
+
+	tests := []struct {
+		content string
+		want    []int64
+	}{
+		{"run", []int64{m1.MessageId}},    // 词干提取
+		{"tested", []int64{m1.MessageId}}, // 词干提取
+		{"the", []int64{}},                // 内置停用词
+		{"foo", []int64{}},                // 自定义停用词（不区分大小写）
+		{"bar", []int64{m2.MessageId}},
+	}
+	for _, tt := range tests {
+		if got := searchSortedIds(t, s, tt.content); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSearchDetectLanguage(t *testing.T) {
+	s := newTestSearch(t)
+	useTestAnalysis(t, s, AnalysisOptions{Language: LangZh, DetectLanguage: true, UserDict: []string{"蓝鲸派 1000"}})
+	m1 := newTestMessage("c1", 2, 1, "u1", "running tests")
+	m2 := newTestMessage("c1", 2, 2, "u1", "蓝鲸派来了")
+	indexTestMessages(t, s, 0, m1, m2)
+
+	// 英文消息写入英文子字段，搜索时可以匹配词干
+	if got := searchSortedIds(t, s, "run"); !reflect.DeepEqual(got, []int64{m1.MessageId}) {
+		t.Errorf("search run = %v, want [%d]", got, m1.MessageId)
+	}
+	if got := searchSortedIds(t, s, "蓝鲸派"); !reflect.DeepEqual(got, []int64{m2.MessageId}) {
+		t.Errorf("search 蓝鲸派 = %v, want [%d]", got, m2.MessageId)
+	}
+
+	// 自定义词典中的词作为一个词
+	analyzer := s.activeIndex.mapping.AnalyzerNamed(langAnalyzerName(LangZh))
+	if analyzer == nil {
+		t.Fatal("zh analyzer is missing")
+	}
+	found := false
+	for _, token := range analyzer.Analyze([]byte("蓝鲸派来了")) {
+		if string(token.Term) == "蓝鲸派" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("user dict word is not a token")
+	}
+}
@@ -0,0 +1,618 @@
+package search
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk"
+	"go.uber.org/zap"
+)
+
+// 备份是一个tar.gz文件，包含：
+// meta.json 备份信息
+// db/       pebble的检查点
+// index/    消息索引（分区的目录结构不变）
+// 两者在索引写入锁内创建，索引中的频道检查点与db一致。
+
+const (
+	backupExt      = ".tar.gz"
+	backupMetaFile = "meta.json"
+	backupDbDir    = "db"
+	backupIndexDir = "index"
+)
+
+var ErrBackupNotFound = newBadRequest("backup not found")
+
+// 备份的选项
+type BackupOptions struct {
+	Dir         string // 备份文件保存的目录，为空时使用沙盒中的backup目录（建议使用沙盒外的目录）
+	AutoRestore bool   // 启动时沙盒中没有数据，从最新的备份恢复
+}
+
+type BackupInfo struct {
+	Name      string `json:"name"`       // 备份文件名
+	Size      int64  `json:"size"`       // 文件大小
+	IndexName string `json:"index_name"` // 消息索引目录
+	Version   int    `json:"version"`    // 消息索引结构版本
+	CreatedAt int64  `json:"created_at"` // 创建时间
+}
+
+type backupMeta struct {
+	IndexName string `json:"index_name"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+var (
+	backupOptionsLock sync.RWMutex
+	backupOptions     BackupOptions
+)
+
+// SetBackupOptions 设置备份的选项
+func SetBackupOptions(opts BackupOptions) {
+	backupOptionsLock.Lock()
+	defer backupOptionsLock.Unlock()
+	backupOptions = opts
+}
+
+func getBackupOptions() BackupOptions {
+	backupOptionsLock.RLock()
+	defer backupOptionsLock.RUnlock()
+	return backupOptions
+}
+
+func (o BackupOptions) dir() string {
+	if strings.TrimSpace(o.Dir) != "" {
+		return o.Dir
+	}
+	return path.Join(pdk.S.SandboxDir(), "backup")
+}
+
+// 备份文件的路径，名字不能包含目录
+func backupFile(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, backupExt) {
+		return "", newBadRequest("invalid backup name: %s", name)
+	}
+	file := path.Join(getBackupOptions().dir(), name)
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrBackupNotFound
+		}
+		return "", err
+	}
+	return file, nil
+}
+
+// Backup 创建消息索引和db的快照，写入备份目录
+func (s *Search) Backup() (*BackupInfo, error) {
+	// 迁移期间索引会切换，不备份
+	if !s.migrateLock.TryLock() {
+		return nil, fmt.Errorf("message index is migrating")
+	}
+	defer s.migrateLock.Unlock()
+
+	dir := getBackupOptions().dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	staging := path.Join(pdk.S.SandboxDir(), "backup.tmp")
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	start := time.Now()
+	meta, err := s.snapshot(staging)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path.Join(staging, backupMetaFile), data, 0644); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("search_%s%s", start.Format("20060102150405"), backupExt)
+	file := path.Join(dir, name)
+	if err = writeArchive(staging, file+".tmp"); err != nil {
+		os.Remove(file + ".tmp")
+		return nil, err
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	s.Info("backup finished", zap.String("file", file), zap.Int64("size", stat.Size()), zap.Duration("cost", time.Since(start)))
+	return &BackupInfo{
+		Name:      name,
+		Size:      stat.Size(),
+		IndexName: meta.IndexName,
+		Version:   meta.Version,
+		CreatedAt: meta.CreatedAt,
+	}, nil
+}
+
+// 在写入锁内复制db和消息索引，快照期间索引不能写入
+func (s *Search) snapshot(dir string) (*backupMeta, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if s.activeIndex == nil {
+		return nil, fmt.Errorf("message index is not open")
+	}
+	name, version, err := s.db.getMessageIndexMeta()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.db.checkpoint(path.Join(dir, backupDbDir)); err != nil {
+		return nil, err
+	}
+	if err = s.activeIndex.copyTo(path.Join(dir, backupIndexDir)); err != nil {
+		return nil, err
+	}
+	return &backupMeta{
+		IndexName: name,
+		Version:   version,
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+// Backups 备份目录中的所有备份，从新到旧
+func (s *Search) Backups() ([]*BackupInfo, error) {
+	dir := getBackupOptions().dir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return make([]*BackupInfo, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]*BackupInfo, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), backupExt) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		info := &BackupInfo{
+			Name:      entry.Name(),
+			Size:      stat.Size(),
+			CreatedAt: stat.ModTime().Unix(),
+		}
+		if meta, err := readBackupMeta(path.Join(dir, entry.Name())); err == nil {
+			info.IndexName = meta.IndexName
+			info.Version = meta.Version
+			info.CreatedAt = meta.CreatedAt
+		} else {
+			s.Warn("read backup meta error", zap.Error(err), zap.String("name", entry.Name()))
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name > backups[j].Name
+	})
+	return backups, nil
+}
+
+// RestoreBackup 从备份恢复消息索引和频道检查点，频道从备份的位置继续索引。
+// 待索引的频道、撤回和编辑记录以及用户数据保留当前的，撤回和编辑会重新应用到恢复的索引。
+func (s *Search) RestoreBackup(name string) (*BackupInfo, error) {
+	file, err := backupFile(name)
+	if err != nil {
+		return nil, err
+	}
+	s.reindexLock.Lock()
+	reindexing := s.reindex != nil && !s.reindex.finished()
+	s.reindexLock.Unlock()
+	if reindexing {
+		return nil, ErrReindexRunning
+	}
+	if !s.migrateLock.TryLock() {
+		return nil, fmt.Errorf("message index is migrating")
+	}
+
+	staging := path.Join(pdk.S.SandboxDir(), "restore.tmp")
+	defer os.RemoveAll(staging)
+	meta, err := extractBackup(file, staging)
+	if err != nil {
+		s.migrateLock.Unlock()
+		return nil, err
+	}
+
+	// 恢复前已索引的频道，快照之后新增的频道需要从头索引
+	channels := make(map[string]indexReq)
+	addChannel := func(channelId string, channelType uint8) bool {
+		req := indexReq{channelId: channelId, channelType: channelType}
+		channels[req.key()] = req
+		return true
+	}
+	if err = s.db.rangeIndexedChannels(addChannel); err != nil {
+		s.migrateLock.Unlock()
+		return nil, err
+	}
+
+	start := time.Now()
+	if err = s.replaceMessageIndex(staging, meta); err != nil {
+		s.migrateLock.Unlock()
+		return nil, err
+	}
+	s.migrateLock.Unlock()
+
+	s.reapplyMessageEvents()
+	s.checkIndexConsistency()
+	if err = s.db.rangeIndexedChannels(addChannel); err != nil {
+		s.Warn("range indexed channels error", zap.Error(err))
+	}
+	for _, req := range channels {
+		s.MakeIndex(req.channelId, req.channelType)
+	}
+	s.checkMessageIndexSchema(meta.IndexName, meta.Version)
+
+	s.Info("restore backup finished", zap.String("name", name), zap.Int("channels", len(channels)), zap.Duration("cost", time.Since(start)))
+	return &BackupInfo{
+		Name:      name,
+		IndexName: meta.IndexName,
+		Version:   meta.Version,
+		CreatedAt: meta.CreatedAt,
+	}, nil
+}
+
+// 用解压的备份替换当前的消息索引和频道检查点，失败时还原当前的索引
+func (s *Search) replaceMessageIndex(staging string, meta *backupMeta) error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if s.activeIndex == nil {
+		return fmt.Errorf("message index is not open")
+	}
+	oldName, oldVersion, err := s.db.getMessageIndexMeta()
+	if err != nil {
+		return err
+	}
+	oldIndex := s.activeIndex
+	oldDir := path.Join(pdk.S.SandboxDir(), oldName)
+	movedDir := oldDir + ".restore_old"
+	newDir := path.Join(pdk.S.SandboxDir(), meta.IndexName)
+
+	s.msgIndex.Remove(oldIndex.alias)
+	if err = oldIndex.Close(); err != nil {
+		s.Warn("close message index error", zap.Error(err))
+	}
+	os.RemoveAll(movedDir)
+	if err = os.Rename(oldDir, movedDir); err != nil {
+		return s.rollbackMessageIndex(oldDir, "", oldVersion, err)
+	}
+
+	index, err := func() (*messageIndex, error) {
+		if err := os.RemoveAll(newDir); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path.Join(staging, backupIndexDir), newDir); err != nil {
+			return nil, err
+		}
+		index, err := openMessageIndexDir(newDir, meta.Version < partitionSchemaVersion, s.buildMessageMapping)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.db.restoreIndexState(path.Join(staging, backupDbDir)); err != nil {
+			index.Close()
+			return nil, err
+		}
+		return index, nil
+	}()
+	if err != nil {
+		os.RemoveAll(newDir)
+		return s.rollbackMessageIndex(oldDir, movedDir, oldVersion, err)
+	}
+
+	s.msgIndex.Add(index.alias)
+	s.activeIndex = index
+	if err = os.RemoveAll(movedDir); err != nil {
+		s.Warn("remove old message index error", zap.Error(err))
+	}
+	return nil
+}
+
+// 恢复失败，重新打开原来的索引
+func (s *Search) rollbackMessageIndex(dir string, movedDir string, version int, cause error) error {
+	if movedDir != "" {
+		if err := os.Rename(movedDir, dir); err != nil {
+			s.Error("move back message index error", zap.Error(err))
+		}
+	}
+	index, err := openMessageIndexDir(dir, version < partitionSchemaVersion, s.buildMessageMapping)
+	if err != nil {
+		s.Error("reopen message index error", zap.Error(err))
+		return cause
+	}
+	s.msgIndex.Add(index.alias)
+	s.activeIndex = index
+	return cause
+}
+
+// 将db中的撤回和编辑记录重新应用到恢复的索引（备份之后的事件不在快照中）
+// 逐页读取记录，只修改索引，不重写记录中的消息时间
+func (s *Search) reapplyMessageEvents() {
+	ids := make([]string, 0, retentionDeletePageSize)
+	removeIndexed := func() {
+		if err := s.removeIndexed(ids); err != nil {
+			s.Warn("remove message index error", zap.Error(err))
+		}
+		ids = ids[:0]
+	}
+	err := s.db.rangeRemovedMessages(func(messageId int64) bool {
+		ids = append(ids, strconv.FormatInt(messageId, 10))
+		if len(ids) >= retentionDeletePageSize {
+			removeIndexed()
+		}
+		return true
+	})
+	if err != nil {
+		s.Warn("range removed messages error", zap.Error(err))
+	}
+	if len(ids) > 0 {
+		removeIndexed()
+	}
+
+	err = s.db.rangeEditedMessages(func(messageId int64, payload []byte) bool {
+		msg, err := s.getMessage(messageId)
+		if err != nil {
+			s.Warn("get edited message error", zap.Error(err), zap.Int64("messageId", messageId))
+			return true
+		}
+		if msg == nil {
+			return true
+		}
+		if err = s.reindexEdited(msg, payload); err != nil {
+			s.Warn("update message index error", zap.Error(err), zap.Int64("messageId", messageId))
+		}
+		return true
+	})
+	if err != nil {
+		s.Warn("range edited messages error", zap.Error(err))
+	}
+}
+
+// 启动时沙盒中没有数据，从最新的备份恢复，返回true表示已恢复
+func (s *Search) restoreOnStart() bool {
+	if !getBackupOptions().AutoRestore {
+		return false
+	}
+	dbDir := path.Join(pdk.S.SandboxDir(), "db")
+	if _, err := os.Stat(dbDir); !os.IsNotExist(err) {
+		return false
+	}
+	backups, err := s.Backups()
+	if err != nil {
+		s.Error("list backups error", zap.Error(err))
+		return false
+	}
+	if len(backups) == 0 {
+		return false
+	}
+	name := backups[0].Name
+	staging := path.Join(pdk.S.SandboxDir(), "restore.tmp")
+	defer os.RemoveAll(staging)
+	meta, err := extractBackup(path.Join(getBackupOptions().dir(), name), staging)
+	if err != nil {
+		s.Error("extract backup error", zap.Error(err), zap.String("name", name))
+		return false
+	}
+	indexDir := path.Join(pdk.S.SandboxDir(), meta.IndexName)
+	if err = os.RemoveAll(indexDir); err != nil {
+		s.Error("remove message index error", zap.Error(err))
+		return false
+	}
+	if err = os.Rename(path.Join(staging, backupIndexDir), indexDir); err != nil {
+		s.Error("restore message index error", zap.Error(err))
+		return false
+	}
+	if err = os.Rename(path.Join(staging, backupDbDir), dbDir); err != nil {
+		s.Error("restore db error", zap.Error(err))
+		return false
+	}
+	s.Info("restore from backup", zap.String("name", name), zap.String("indexName", meta.IndexName))
+	return true
+}
+
+// 恢复后所有已索引的频道从备份的位置继续索引
+func (s *Search) resumeRestoredChannels() {
+	err := s.db.rangeIndexedChannels(func(channelId string, channelType uint8) bool {
+		s.MakeIndex(channelId, channelType)
+		return true
+	})
+	if err != nil {
+		s.Error("range indexed channels error", zap.Error(err))
+	}
+}
+
+// 解压备份到dir，dir已存在时先删除
+func extractBackup(file string, dir string) (*backupMeta, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := extractArchive(file, dir); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path.Join(dir, backupMetaFile))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	meta := &backupMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	if meta.IndexName == "" || meta.IndexName != filepath.Base(meta.IndexName) {
+		return nil, fmt.Errorf("invalid backup index name: %s", meta.IndexName)
+	}
+	for _, name := range []string{backupDbDir, backupIndexDir} {
+		if _, err = os.Stat(path.Join(dir, name)); err != nil {
+			return nil, fmt.Errorf("invalid backup: %v", err)
+		}
+	}
+	return meta, nil
+}
+
+// 读取备份的信息，meta.json是备份的第一个文件
+func readBackupMeta(file string) (*backupMeta, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if header.Name != backupMetaFile {
+		return nil, fmt.Errorf("backup meta not found")
+	}
+	meta := &backupMeta{}
+	if err = json.NewDecoder(tr).Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// 将dir打包为tar.gz，meta.json写在最前面
+func writeArchive(dir string, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	addFile := func(p string, info os.FileInfo) error {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	}
+
+	metaPath := filepath.Join(dir, backupMetaFile)
+	metaInfo, err := os.Stat(metaPath)
+	if err != nil {
+		return err
+	}
+	if err = addFile(metaPath, metaInfo); err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || p == metaPath {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		return addFile(p, info)
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// 解压tar.gz到dir，只解压目录和普通文件
+func extractArchive(file string, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	root := filepath.Clean(dir)
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(root, filepath.FromSlash(header.Name))
+		if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return fmt.Errorf("invalid backup entry: %s", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, tr)
+			dst.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
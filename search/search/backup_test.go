@@ -0,0 +1,152 @@
+package search
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupFile(t *testing.T) {
+	dir := t.TempDir()
+	SetBackupOptions(BackupOptions{Dir: dir})
+	defer SetBackupOptions(BackupOptions{})
+	if err := os.WriteFile(filepath.Join(dir, "a.tar.gz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		wantErr  error
+		badInput bool
+	}{
+		{name: "a.tar.gz"},
+		{name: "missing.tar.gz", wantErr: ErrBackupNotFound},
+		{name: "", badInput: true},
+		{name: "a.zip", badInput: true},
+		{name: "../a.tar.gz", badInput: true},
+		{name: "sub/a.tar.gz", badInput: true},
+		{name: "/etc/a.tar.gz", badInput: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := backupFile(tt.name)
+			if tt.badInput {
+				if !IsBadRequest(err) || err == ErrBackupNotFound {
+					t.Errorf("backupFile() error = %v, want invalid name", err)
+				}
+				return
+			}
+			if err != tt.wantErr {
+				t.Fatalf("backupFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && file != filepath.Join(dir, tt.name) {
+				t.Errorf("backupFile() = %s, want %s", file, filepath.Join(dir, tt.name))
+			}
+		})
+	}
+}
+
+// 生成包含指定条目的tar.gz
+func writeTestArchive(t *testing.T, file string, headers ...*tar.Header) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err = tw.Write([]byte(header.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchivePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   *tar.Header
+		wantErr bool
+		want    string // 解压后应存在的文件
+	}{
+		{"regular file", &tar.Header{Name: "index/a", Typeflag: tar.TypeReg, Mode: 0644}, false, "index/a"},
+		{"directory", &tar.Header{Name: "db/", Typeflag: tar.TypeDir, Mode: 0755}, false, "db"},
+		{"absolute path stays inside", &tar.Header{Name: "/abs", Typeflag: tar.TypeReg, Mode: 0644}, false, "abs"},
+		{"parent directory", &tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}, true, ""},
+		{"nested parent directory", &tar.Header{Name: "index/../../evil", Typeflag: tar.TypeReg, Mode: 0644}, true, ""},
+		{"symlink is skipped", &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			file := filepath.Join(tmp, "backup.tar.gz")
+			writeTestArchive(t, file, tt.entry)
+			dir := filepath.Join(tmp, "out")
+			err := extractArchive(file, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err = os.Stat(filepath.Join(tmp, "evil")); err == nil {
+				t.Fatalf("file written outside of the target directory")
+			}
+			if _, err = os.Lstat(filepath.Join(dir, "link")); err == nil {
+				t.Errorf("symlink is extracted")
+			}
+			if tt.want != "" {
+				if _, err = os.Stat(filepath.Join(dir, tt.want)); err != nil {
+					t.Errorf("%s is not extracted: %v", tt.want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractBackupIndexName(t *testing.T) {
+	tests := []struct {
+		meta    string
+		wantErr bool
+	}{
+		{`{"index_name":"message_v7.bleve","version":7}`, false},
+		{`{"index_name":"","version":7}`, true},
+		{`{"index_name":"../message_v7.bleve","version":7}`, true},
+		{`{"index_name":"a/b","version":7}`, true},
+		{`not json`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.meta, func(t *testing.T) {
+			tmp := t.TempDir()
+			src := filepath.Join(tmp, "src")
+			for _, name := range []string{backupDbDir, backupIndexDir} {
+				if err := os.MkdirAll(filepath.Join(src, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(src, backupMetaFile), []byte(tt.meta), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(tmp, "backup.tar.gz")
+			if err := writeArchive(src, file); err != nil {
+				t.Fatal(err)
+			}
+			_, err := extractBackup(file, filepath.Join(tmp, "out"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("extractBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,12 +2,13 @@ package search
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/WuKongIM/go-pdk/pdk"
 	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
 	"github.com/WuKongIM/wklog"
-	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
 )
 
@@ -15,130 +16,429 @@ type bucket struct {
 	id        int
 	s         *Search
 	indexChan chan indexReq
+
+	queuedLock   sync.Mutex
+	queued       map[string]struct{}  // 已在indexChan中的频道，用于去重
+	pendingSince map[string]time.Time // 频道开始等待索引的时间，索引完成后删除
+	needReplay   atomic.Bool          // 有待索引的频道只保存在db中，需要从db重新加载
+
+	stopper chan struct{} // 调整bucket时关闭，bucket处理完当前批次后退出
+	done    chan struct{} // loopIndex退出后关闭
 	wklog.Log
 }
 
-func newBucket(id int, s *Search) *bucket {
+// 从服务端拉取频道的消息，测试时替换
+var getChannelMessages = func(req *pluginproto.ChannelMessageBatchReq) (*pluginproto.ChannelMessageBatchResp, error) {
+	return pdk.S.GetChannelMessages(req)
+}
+
+func newBucket(id int, s *Search, queueSize int) *bucket {
 	return &bucket{
-		id:        id,
-		indexChan: make(chan indexReq, 1000),
-		s:         s,
-		Log:       wklog.NewWKLog(fmt.Sprintf("bucket[%d]", id)),
+		id:           id,
+		indexChan:    make(chan indexReq, queueSize),
+		queued:       make(map[string]struct{}),
+		pendingSince: make(map[string]time.Time),
+		stopper:      make(chan struct{}),
+		done:         make(chan struct{}),
+		s:            s,
+		Log:          wklog.NewWKLog(fmt.Sprintf("bucket[%d]", id)),
 	}
 }
 
 func (b *bucket) start() {
-	go b.loopIndex()
+	if !b.s.goTask(b.loopIndex) {
+		close(b.done)
+	}
+}
+
+// 停止bucket，通过done等待退出
+func (b *bucket) quit() {
+	close(b.stopper)
+}
+
+func (b *bucket) quitting() bool {
+	select {
+	case <-b.stopper:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待d，bucket或插件停止时提前返回false
+func (b *bucket) sleep(d time.Duration) bool {
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		return true
+	case <-b.stopper:
+		return false
+	case <-b.s.stopper:
+		return false
+	}
+}
+
+// 把已退出的bucket中的频道交给新的bucket，等待时间保持不变
+func (b *bucket) handover() {
+	b.queuedLock.Lock()
+	pendingSince := b.pendingSince
+	b.pendingSince = make(map[string]time.Time)
+	b.queuedLock.Unlock()
+
+	for key, since := range pendingSince {
+		channelId, _, ok := parseChannelKey(key)
+		if !ok {
+			continue
+		}
+		b.s.bucketOf(channelId).setPendingSince(key, since)
+	}
+	for {
+		select {
+		case req := <-b.indexChan:
+			b.s.enqueueIndex(b.dequeue(req))
+		default:
+			// 不在队列中的频道保存在db中，由新的bucket重新加载
+			if b.needReplay.Load() {
+				for _, nb := range b.s.bucketList() {
+					nb.needReplay.Store(true)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (b *bucket) setPendingSince(key string, since time.Time) {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	if old, ok := b.pendingSince[key]; !ok || since.Before(old) {
+		b.pendingSince[key] = since
+	}
+}
+
+// 将频道放入索引队列，同一个频道在队列中只会存在一个，队列已满返回false
+func (b *bucket) enqueue(req indexReq) bool {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	return b.enqueueLocked(req)
+}
+
+// 频道还未索引完成时放入队列，db中的待索引记录还在，不需要再次写入
+// 与complete持有同一把锁，complete删除记录后这里返回false
+func (b *bucket) enqueueIfPending(req indexReq) bool {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	if _, ok := b.pendingSince[req.key()]; !ok {
+		return false
+	}
+	b.enqueueLocked(req)
+	return true
+}
+
+// 调用时需持有queuedLock
+func (b *bucket) enqueueLocked(req indexReq) bool {
+	key := req.key()
+	if _, ok := b.pendingSince[key]; !ok {
+		b.pendingSince[key] = time.Now()
+	}
+	if _, ok := b.queued[key]; ok {
+		return true
+	}
+	select {
+	case b.indexChan <- req:
+		b.queued[key] = struct{}{}
+		return true
+	default:
+		// 队列已满，频道已保存在db中，稍后再从db加载
+		b.needReplay.Store(true)
+		return false
+	}
+}
+
+func (b *bucket) dequeue(req indexReq) indexReq {
+	b.queuedLock.Lock()
+	delete(b.queued, req.key())
+	b.queuedLock.Unlock()
+	return req
+}
+
+// 频道已索引完成，如果没有再次进入队列则移除db中的待索引记录
+func (b *bucket) complete(req indexReq) {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	if _, ok := b.queued[req.key()]; ok {
+		return
+	}
+	delete(b.pendingSince, req.key())
+	err := b.s.db.removePendingIndex(req.channelId, req.channelType)
+	if err != nil {
+		b.Error("remove pending index error", zap.Error(err), zap.String("channelId", req.channelId), zap.Uint8("channelType", req.channelType))
+	}
+}
+
+// bucket的状态和还未索引完成的频道
+func (b *bucket) status(now time.Time) (BucketStatus, []*PendingChannel) {
+	b.queuedLock.Lock()
+	defer b.queuedLock.Unlock()
+	channels := make([]*PendingChannel, 0, len(b.pendingSince))
+	for key, since := range b.pendingSince {
+		channelId, channelType, ok := parseChannelKey(key)
+		if !ok {
+			continue
+		}
+		channels = append(channels, &PendingChannel{
+			ChannelId:   channelId,
+			ChannelType: channelType,
+			Since:       since.Unix(),
+			Lag:         int64(now.Sub(since).Seconds()),
+		})
+	}
+	return BucketStatus{
+		Id:              b.id,
+		QueueLength:     len(b.indexChan),
+		QueueCapacity:   cap(b.indexChan),
+		PendingChannels: len(channels),
+	}, channels
+}
+
+// 从db中重新加载属于此bucket的待索引频道
+func (b *bucket) replayPending() {
+	b.needReplay.Store(false)
+	err := b.s.db.rangePendingIndex(func(channelId string, channelType uint8) bool {
+		if b.s.bucketOf(channelId) != b {
+			return true
+		}
+		return b.enqueue(indexReq{
+			channelId:   channelId,
+			channelType: channelType,
+		})
+	})
+	if err != nil {
+		b.needReplay.Store(true)
+		b.Error("replay pending index error", zap.Error(err))
+	}
 }
 
 func (b *bucket) loopIndex() {
-	batchSize := 100
-	reqs := make([]indexReq, 0, batchSize)
-	done := false
-	for req := range b.indexChan {
-		reqs = append(reqs, req)
-		for !done {
-			select {
-			case req := <-b.indexChan:
-				if len(reqs) > batchSize {
+	defer close(b.done)
+	tk := time.NewTicker(time.Second * 5)
+	defer tk.Stop()
+	for {
+		select {
+		case <-b.s.stopper:
+			return
+		case <-b.stopper:
+			return
+		case req := <-b.indexChan:
+			// 停止时队列中的频道已保存在db中，下次启动时继续索引
+			if b.s.stopping() {
+				return
+			}
+			// bucket已被替换，放回队列交给新的bucket（此时只有本协程写入队列，不会阻塞）
+			if b.quitting() {
+				b.indexChan <- req
+				return
+			}
+			batchSize := b.s.getIndexOptions().BatchSize
+			reqs := make([]indexReq, 0, batchSize)
+			reqs = append(reqs, b.dequeue(req))
+			done := false
+			for !done && len(reqs) < batchSize {
+				select {
+				case req := <-b.indexChan:
+					reqs = append(reqs, b.dequeue(req))
+				default:
 					done = true
-					break
 				}
-				reqs = append(reqs, req)
-			default:
-				done = true
+			}
+			b.handleIndex(reqs)
+		case <-tk.C:
+			if b.needReplay.Load() {
+				b.replayPending()
 			}
 		}
-		b.handleIndex(reqs)
-		reqs = reqs[:0]
-		done = false
 	}
 }
 
 func (b *bucket) handleIndex(indexs []indexReq) {
-
+	opts := b.s.getIndexOptions()
 	reqs := make([]*pluginproto.ChannelMessageReq, 0, len(indexs))
+	prevSeqs := make(map[string]uint64, len(indexs)) // 拉取时频道的检查点
 	for _, indexReq := range indexs {
-		msgSeq, err := b.s.db.getChannelMaxMessageSeq(indexReq.channelId, indexReq.channelType)
+		// 重建索引中的频道由重建任务负责，完成后会重新加入队列
+		if b.s.isReindexing(indexReq.channelId, indexReq.channelType) {
+			b.needReplay.Store(true)
+			continue
+		}
+		msgSeq, err := b.s.getChannelMaxMessageSeq(indexReq.channelId, indexReq.channelType)
 		if err != nil {
+			// 频道仍保存在db中，稍后重试
+			b.needReplay.Store(true)
+			b.Error("get channel max message seq error", zap.Error(err), zap.String("channelId", indexReq.channelId), zap.Uint8("channelType", indexReq.channelType))
 			continue
 		}
+		prevSeqs[indexReq.key()] = msgSeq
 		reqs = append(reqs, &pluginproto.ChannelMessageReq{
 			ChannelId:       indexReq.channelId,
 			ChannelType:     uint32(indexReq.channelType),
 			StartMessageSeq: msgSeq + 1,
-			Limit:           500,
+			Limit:           uint32(opts.PullLimit),
 		})
 
 	}
+	if len(reqs) == 0 {
+		return
+	}
+
+	// 服务端出错后退避，等待中被停止时频道仍保存在db中，由新的bucket或下次启动时重新加载
+	if delay := b.s.throttle.current(); delay > 0 && !b.sleep(delay) {
+		b.needReplay.Store(true)
+		return
+	}
 
 	req := &pluginproto.ChannelMessageBatchReq{
 		ChannelMessageReqs: reqs,
 	}
-	messageResp, err := pdk.S.GetChannelMessages(req)
+	b.s.metrics.getMessagesRequests.Add(1)
+	messageResp, err := getChannelMessages(req)
 	if err != nil {
-		b.Error("get channel message error", zap.Error(err), zap.Int("channelMessageReqs", len(reqs)))
+		b.s.metrics.getMessagesErrors.Add(1)
+		delay := b.s.throttle.failure()
+		// 频道仍保存在db中，稍后重试
+		b.needReplay.Store(true)
+		b.Error("get channel message error", zap.Error(err), zap.Int("channelMessageReqs", len(reqs)), zap.Duration("throttle", delay))
 		return
 	}
+	b.s.throttle.success()
 
 	if len(messageResp.ChannelMessageResps) == 0 {
 		b.Warn("channel message is empty", zap.Int("channelMessageReqs", len(reqs)))
+		for _, req := range reqs {
+			b.complete(indexReq{
+				channelId:   req.ChannelId,
+				channelType: uint8(req.ChannelType),
+			})
+		}
 		return
 	}
 	for _, resp := range messageResp.ChannelMessageResps {
+		respReq := indexReq{
+			channelId:   resp.ChannelId,
+			channelType: uint8(resp.ChannelType),
+		}
 		if len(resp.Messages) == 0 {
+			b.complete(respReq)
 			continue
 		}
 		// 索引消息
-		err = b.buildIndex(resp.ChannelId, uint8(resp.ChannelType), resp.Messages)
+		err = b.buildIndex(resp.ChannelId, uint8(resp.ChannelType), prevSeqs[respReq.key()], resp.Messages)
 		if err != nil {
+			b.needReplay.Store(true)
 			b.Error("search index error", zap.Error(err))
 			continue
 		}
 
-		lastMsg := resp.Messages[len(resp.Messages)-1]
-		err = b.s.db.setChannelMaxMessageSeq(resp.ChannelId, uint8(resp.ChannelType), lastMsg.MessageSeq)
-		if err != nil {
-			b.Error("set channel max message seq error", zap.Error(err))
-		}
-
 		// 如果消息数量大于等于limit，继续请求
 		if len(resp.Messages) >= int(resp.Limit) {
 
-			time.Sleep(time.Millisecond * 500) // 防止请求过快
+			b.sleep(opts.PullInterval) // 防止请求过快
 
-			select {
-			case b.indexChan <- indexReq{
-				channelId:   resp.ChannelId,
-				channelType: uint8(resp.ChannelType),
-			}:
-			default:
-			}
+			b.enqueue(respReq)
+		} else {
+			b.complete(respReq)
 		}
 	}
 
 }
 
-func (b *bucket) buildIndex(channelId string, channelType uint8, msgs []*pluginproto.Message) error {
+// 索引消息，并在同一个batch中更新频道的检查点，prevSeq为拉取消息时频道的检查点
+func (b *bucket) buildIndex(channelId string, channelType uint8, prevSeq uint64, msgs []*pluginproto.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
 	if b.s.msgIndex == nil {
 		b.Error("search: msg index is nil", zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
 		return nil
 	}
-	batch := b.s.msgIndex.NewBatch()
+	docs := make([]*Message, 0, len(msgs))
+	// 不索引的消息序号，检查索引是否缺少消息时跳过
+	skipped := make([]seqRange, 0)
+	expectedSeq := prevSeq + 1
 	for _, msg := range msgs {
-		if gjson.ValidBytes(msg.Payload) {
-
-			m := newMessageFrom(msg)
-			err := batch.Index(fmt.Sprintf("%d", msg.MessageId), m)
+		// 服务端没有返回的序号
+		if msg.MessageSeq > expectedSeq {
+			skipped = appendSeqRange(skipped, seqRange{start: expectedSeq, end: msg.MessageSeq - 1})
+		}
+		expectedSeq = msg.MessageSeq + 1
+		// 已撤回或删除的消息不索引，已编辑的消息使用编辑后的内容
+		if !b.s.applyMessageEvents(msg) {
+			b.s.metrics.skip(SkipRemoved)
+			skipped = appendSeqRange(skipped, seqRange{start: msg.MessageSeq, end: msg.MessageSeq})
+			continue
+		}
+		// 超过保留时间的消息不索引，检查点照常前进
+		if isMessageExpired(channelType, msg.Timestamp) {
+			b.s.metrics.skip(SkipExpired)
+			skipped = appendSeqRange(skipped, seqRange{start: msg.MessageSeq, end: msg.MessageSeq})
+			continue
+		}
+		// 不是JSON的消息内容使用解码器转换
+		payload, reason := decodePayload(msg)
+		if reason != "" {
+			b.s.metrics.skip(reason)
+			skipped = appendSeqRange(skipped, seqRange{start: msg.MessageSeq, end: msg.MessageSeq})
+			continue
+		}
+		docs = append(docs, newMessageWithPayload(msg, payload))
+	}
+	lastMsg := msgs[len(msgs)-1]
+	checkpointKey := channelCheckpointKey(channelId, channelType)
+	rewound := false
+	failed := 0
+	start := time.Now()
+	err := b.s.indexBatch(func(batch *messageBatch) {
+		// 拉取消息后检查点回退了（例如恢复了备份），丢弃这批消息，稍后从新的检查点重新拉取
+		if messageSeq, ok, err := b.s.activeIndex.checkpoint(checkpointKey); err == nil && ok && messageSeq < prevSeq {
+			rewound = true
+			return
+		}
+		// 迁移期间会调用两次，只统计一次
+		failed = 0
+		for _, m := range docs {
+			err := batch.Index(m.MessageIdStr, m)
 			if err != nil {
-				b.Error("index message error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType), zap.Int64("messageId", msg.MessageId), zap.Uint64("messageSeq", msg.MessageSeq))
+				failed++
+				b.Error("index message error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType), zap.Int64("messageId", m.MessageId), zap.Uint64("messageSeq", m.MessageSeq))
 			}
 		}
+		batch.SetInternal(checkpointKey, encodeMessageSeq(lastMsg.MessageSeq))
+	})
+	b.s.metrics.observeBatch(time.Since(start))
+	if err != nil {
+		b.s.metrics.failedMessages.Add(uint64(len(docs)))
+		return err
+	}
+	if rewound {
+		return fmt.Errorf("channel checkpoint is rewound")
 	}
-	return b.s.msgIndex.Batch(batch)
+	b.s.metrics.indexedMessages.Add(uint64(len(docs) - failed))
+	b.s.metrics.failedMessages.Add(uint64(failed))
+	err = b.s.db.setChannelMaxMessageSeq(channelId, channelType, lastMsg.MessageSeq)
+	if err != nil {
+		b.Warn("set channel max message seq error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+	}
+	if err = b.s.db.addSkippedSeqs(channelId, channelType, skipped); err != nil {
+		b.Warn("add skipped seqs error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+	}
+	return nil
 }
 
 type indexReq struct {
 	channelId   string
 	channelType uint8
 }
+
+func (r indexReq) key() string {
+	return channelKey(r.channelId, r.channelType)
+}
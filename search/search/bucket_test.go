@@ -0,0 +1,127 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// db中保存的待索引频道
+func pendingChannels(t *testing.T, s *Search) []string {
+	t.Helper()
+	keys := make([]string, 0)
+	err := s.db.rangePendingIndex(func(channelId string, channelType uint8) bool {
+		keys = append(keys, channelKey(channelId, channelType))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestMakeIndexPending(t *testing.T) {
+	s := newTestSearch(t)
+	b := newBucket(0, s, 4)
+	s.buckets = []*bucket{b}
+	req := indexReq{channelId: "c1", channelType: 2}
+
+	// 同一个频道在队列中只有一个
+	s.MakeIndex("c1", 2)
+	s.MakeIndex("c1", 2)
+	if len(b.indexChan) != 1 {
+		t.Fatalf("queue length = %d, want 1", len(b.indexChan))
+	}
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Fatalf("pending channels = %v, want [c1:2]", got)
+	}
+
+	// 索引期间又有新消息，完成后记录保留，频道重新进入队列
+	b.dequeue(<-b.indexChan)
+	s.MakeIndex("c1", 2)
+	if len(b.indexChan) != 1 {
+		t.Fatalf("queue length = %d, want 1", len(b.indexChan))
+	}
+	b.complete(req)
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Errorf("pending channels = %v after complete with queued channel, want [c1:2]", got)
+	}
+
+	// 索引完成后记录删除，新消息重新写入记录
+	b.complete(b.dequeue(<-b.indexChan))
+	if got := pendingChannels(t, s); len(got) != 0 {
+		t.Errorf("pending channels = %v after complete, want none", got)
+	}
+	if b.enqueueIfPending(req) {
+		t.Errorf("enqueueIfPending() = true for a completed channel")
+	}
+	s.MakeIndex("c1", 2)
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Errorf("pending channels = %v, want [c1:2]", got)
+	}
+}
+
+func TestBucketQueueFull(t *testing.T) {
+	s := newTestSearch(t)
+	b := newBucket(0, s, 1)
+	s.buckets = []*bucket{b}
+
+	s.MakeIndex("c1", 2)
+	s.MakeIndex("c2", 2)
+	if !b.needReplay.Load() {
+		t.Fatalf("needReplay = false after the queue is full")
+	}
+	// 队列满时频道只保存在db中，腾出位置后从db重新加载
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2", "c2:2"}) {
+		t.Fatalf("pending channels = %v, want [c1:2 c2:2]", got)
+	}
+	b.complete(b.dequeue(<-b.indexChan))
+	b.replayPending()
+	if req := <-b.indexChan; req.channelId != "c2" {
+		t.Errorf("replayed channel = %s, want c2", req.channelId)
+	}
+	if b.needReplay.Load() {
+		t.Errorf("needReplay = true after replay")
+	}
+}
+
+func TestBucketHandover(t *testing.T) {
+	s := newTestSearch(t)
+	old := newBucket(0, s, 4)
+	s.buckets = []*bucket{old}
+	s.MakeIndex("c1", 2)
+	since := time.Now().Add(-time.Minute)
+	old.setPendingSince(channelKey("c1", 2), since)
+
+	nb := newBucket(0, s, 4)
+	s.buckets = []*bucket{nb}
+	old.handover()
+
+	// 队列中的频道和等待时间都交给新的bucket
+	if len(nb.indexChan) != 1 || len(old.indexChan) != 0 {
+		t.Fatalf("queue length = %d old = %d, want 1 0", len(nb.indexChan), len(old.indexChan))
+	}
+	status, channels := nb.status(time.Now())
+	if status.PendingChannels != 1 || channels[0].Since != since.Unix() {
+		t.Errorf("pending channels = %d since = %d, want 1 %d", status.PendingChannels, channels[0].Since, since.Unix())
+	}
+	if _, channels = old.status(time.Now()); len(channels) != 0 {
+		t.Errorf("old bucket still has %d pending channels", len(channels))
+	}
+}
+
+func TestMakeIndexSkipsPendingWrite(t *testing.T) {
+	s := newTestSearch(t)
+	b := newBucket(0, s, 4)
+	s.buckets = []*bucket{b}
+
+	s.MakeIndex("c1", 2)
+	if err := s.db.removePendingIndex("c1", 2); err != nil {
+		t.Fatal(err)
+	}
+	// 频道还在等待索引时不再写入db
+	s.MakeIndex("c1", 2)
+	if got := pendingChannels(t, s); len(got) != 0 {
+		t.Errorf("pending channels = %v, want no write for a pending channel", got)
+	}
+}
@@ -0,0 +1,373 @@
+package search
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"go.uber.org/zap"
+)
+
+// 频道已索引的最大消息序号（检查点）和消息文档在同一个bleve batch中写入，
+// 两者一起持久化，不会出现检查点与索引内容不一致的情况。
+// pebble中的channel_msg_max_seq只是检查点的副本，用于遍历频道和兼容旧版本的数据。
+
+func channelCheckpointKey(channelId string, channelType uint8) []byte {
+	return []byte(fmt.Sprintf("channel_msg_max_seq:%s:%d", channelId, channelType))
+}
+
+func encodeMessageSeq(messageSeq uint64) []byte {
+	var buf = make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, messageSeq)
+	return buf
+}
+
+func decodeMessageSeq(data []byte) uint64 {
+	return binary.BigEndian.Uint64(data)
+}
+
+// 获取频道已索引的最大消息序号
+func (s *Search) getChannelMaxMessageSeq(channelId string, channelType uint8) (uint64, error) {
+	messageSeq, ok, err := s.getIndexCheckpoint(channelId, channelType)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return messageSeq, nil
+	}
+	// 旧版本只在pebble中保存了检查点
+	return s.db.getChannelMaxMessageSeq(channelId, channelType)
+}
+
+// 获取索引中保存的检查点，ok为false表示索引中没有此频道的检查点
+func (s *Search) getIndexCheckpoint(channelId string, channelType uint8) (uint64, bool, error) {
+	s.indexLock.RLock()
+	defer s.indexLock.RUnlock()
+	if s.activeIndex == nil {
+		return 0, false, fmt.Errorf("message index is not open")
+	}
+	return s.activeIndex.checkpoint(channelCheckpointKey(channelId, channelType))
+}
+
+// 设置频道的检查点（不写入消息）
+func (s *Search) setChannelMaxMessageSeq(channelId string, channelType uint8, messageSeq uint64) error {
+	err := s.indexBatch(func(batch *messageBatch) {
+		batch.SetInternal(channelCheckpointKey(channelId, channelType), encodeMessageSeq(messageSeq))
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.setChannelMaxMessageSeq(channelId, channelType, messageSeq)
+}
+
+// 重置频道的检查点，频道将从头开始索引
+func (s *Search) resetChannelMaxMessageSeq(channelId string, channelType uint8) error {
+	err := s.indexBatch(func(batch *messageBatch) {
+		batch.DeleteInternal(channelCheckpointKey(channelId, channelType))
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.resetChannelMaxMessageSeq(channelId, channelType)
+}
+
+// 启动时检查每个频道的检查点，修复索引内容落后于检查点的频道
+func (s *Search) checkIndexConsistency() {
+	type repair struct {
+		channelId   string
+		channelType uint8
+		messageSeq  uint64
+	}
+	repairs := make([]repair, 0)
+	checked := 0
+	err := s.db.rangeIndexedChannels(func(channelId string, channelType uint8) bool {
+		checked++
+		dbSeq, err := s.db.getChannelMaxMessageSeq(channelId, channelType)
+		if err != nil {
+			s.Warn("get channel max message seq error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+			return true
+		}
+		indexSeq, ok, err := s.getIndexCheckpoint(channelId, channelType)
+		if err != nil {
+			s.Warn("get index checkpoint error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+			return true
+		}
+		if ok {
+			// 索引中的检查点与消息一起持久化，以索引中的为准
+			if indexSeq != dbSeq {
+				repairs = append(repairs, repair{channelId, channelType, indexSeq})
+			}
+			return true
+		}
+
+		// 旧版本的数据，检查点之前的消息可能没有写入索引，以索引中最大的消息序号为准
+		maxSeq, err := s.maxIndexedMessageSeq(channelId, channelType)
+		if err != nil {
+			s.Warn("get max indexed message seq error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+			return true
+		}
+		if maxSeq < dbSeq {
+			repairs = append(repairs, repair{channelId, channelType, maxSeq})
+		} else {
+			repairs = append(repairs, repair{channelId, channelType, dbSeq})
+		}
+		return true
+	})
+	if err != nil {
+		s.Error("check index consistency error", zap.Error(err))
+		return
+	}
+
+	gaps := 0
+	for _, r := range repairs {
+		dbSeq, _ := s.db.getChannelMaxMessageSeq(r.channelId, r.channelType)
+		if err = s.setChannelMaxMessageSeq(r.channelId, r.channelType, r.messageSeq); err != nil {
+			s.Error("repair channel checkpoint error", zap.Error(err), zap.String("channelId", r.channelId), zap.Uint8("channelType", r.channelType))
+			continue
+		}
+		if r.messageSeq < dbSeq {
+			// 检查点回退，补齐缺少的消息
+			gaps++
+			s.MakeIndex(r.channelId, r.channelType)
+		}
+	}
+	if len(repairs) > 0 {
+		s.Info("check index consistency", zap.Int("channels", checked), zap.Int("repairs", len(repairs)), zap.Int("gaps", gaps))
+	}
+	// 检查点之前缺少的消息在后台检查
+	s.goTask(s.checkSeqCoverage)
+}
+
+// 不需要索引的消息序号区间（已撤回、已删除、超过保留时间、不能解码或服务端没有的序号）
+type seqRange struct {
+	start uint64
+	end   uint64
+}
+
+// 按开始序号的顺序追加区间，与最后一个区间重叠或相邻时合并
+func appendSeqRange(ranges []seqRange, r seqRange) []seqRange {
+	if n := len(ranges); n > 0 && r.start <= ranges[n-1].end+1 {
+		if r.end > ranges[n-1].end {
+			ranges[n-1].end = r.end
+		}
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+// [start, end]中不在ranges中的第一个序号
+func firstUncoveredSeq(ranges []seqRange, start, end uint64) (uint64, bool) {
+	for _, r := range ranges {
+		if start > end {
+			return 0, false
+		}
+		if r.end < start {
+			continue
+		}
+		if r.start > start {
+			return start, true
+		}
+		start = r.end + 1
+	}
+	if start > end {
+		return 0, false
+	}
+	return start, true
+}
+
+// [start, end]中在ranges中的序号数量
+func coveredSeqCount(ranges []seqRange, start, end uint64) uint64 {
+	var count uint64
+	for _, r := range ranges {
+		from, to := r.start, r.end
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if from <= to {
+			count += to - from + 1
+		}
+	}
+	return count
+}
+
+// 检查每个频道检查点之前的消息是否都已索引，从第一条缺少的消息重新索引
+// 索引中最小的消息序号之前的消息可能已按保留时间删除，不检查
+func (s *Search) checkSeqCoverage() {
+	type channel struct {
+		channelId   string
+		channelType uint8
+	}
+	channels := make([]channel, 0)
+	err := s.db.rangeIndexedChannels(func(channelId string, channelType uint8) bool {
+		channels = append(channels, channel{channelId, channelType})
+		return true
+	})
+	if err != nil {
+		s.Error("range indexed channels error", zap.Error(err))
+		return
+	}
+	gaps := 0
+	for _, c := range channels {
+		if s.stopping() {
+			return
+		}
+		checkpoint, err := s.getChannelMaxMessageSeq(c.channelId, c.channelType)
+		if err != nil || checkpoint == 0 {
+			continue
+		}
+		missingSeq, ok, err := s.findSeqGap(c.channelId, c.channelType, checkpoint)
+		if err != nil {
+			s.Warn("find seq gap error", zap.Error(err), zap.String("channelId", c.channelId), zap.Uint8("channelType", c.channelType))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		gaps++
+		s.Info("channel seq gap", zap.String("channelId", c.channelId), zap.Uint8("channelType", c.channelType), zap.Uint64("missingSeq", missingSeq), zap.Uint64("checkpoint", checkpoint))
+		if err = s.rewindChannel(c.channelId, c.channelType, missingSeq); err != nil {
+			s.Error("rewind channel checkpoint error", zap.Error(err), zap.String("channelId", c.channelId), zap.Uint8("channelType", c.channelType))
+		}
+	}
+	if gaps > 0 {
+		s.Info("check seq coverage", zap.Int("channels", len(channels)), zap.Int("gaps", gaps))
+	}
+}
+
+// 频道缺少missingSeq之后的消息，回退检查点并重新索引
+func (s *Search) rewindChannel(channelId string, channelType uint8, missingSeq uint64) error {
+	if err := s.setChannelMaxMessageSeq(channelId, channelType, missingSeq-1); err != nil {
+		return err
+	}
+	s.MakeIndex(channelId, channelType)
+	return nil
+}
+
+// 频道在[最小的已索引序号, checkpoint]中第一个既没有索引也不需要索引的序号
+func (s *Search) findSeqGap(channelId string, channelType uint8, checkpoint uint64) (uint64, bool, error) {
+	minSeq, count, err := s.indexedSeqStats(channelId, channelType, checkpoint)
+	if err != nil || count == 0 {
+		return 0, false, err
+	}
+	skipped, err := s.db.getSkippedSeqs(channelId, channelType)
+	if err != nil {
+		return 0, false, err
+	}
+	// 数量一致时没有缺少的消息
+	if count+coveredSeqCount(skipped, minSeq, checkpoint) >= checkpoint-minSeq+1 {
+		return 0, false, nil
+	}
+
+	const pageSize = 1000
+	expected := minSeq
+	for expected <= checkpoint {
+		if s.stopping() {
+			return 0, false, ErrStopped
+		}
+		searchRequest := bleve.NewSearchRequest(newChannelSeqQuery(channelId, channelType, expected, checkpoint))
+		searchRequest.Fields = []string{"message_seq"}
+		searchRequest.Size = pageSize
+		searchRequest.SortBy([]string{"message_seq"})
+		searchResult, err := s.msgIndex.Search(searchRequest)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, hit := range searchResult.Hits {
+			messageSeq, ok := hit.Fields["message_seq"].(float64)
+			if !ok {
+				continue
+			}
+			seq := uint64(messageSeq)
+			if seq > expected {
+				if missing, ok := firstUncoveredSeq(skipped, expected, seq-1); ok {
+					return missing, true, nil
+				}
+			}
+			expected = seq + 1
+		}
+		if len(searchResult.Hits) < pageSize {
+			break
+		}
+	}
+	missing, ok := firstUncoveredSeq(skipped, expected, checkpoint)
+	return missing, ok, nil
+}
+
+// 频道在checkpoint之前已索引的最小消息序号和消息数量
+func (s *Search) indexedSeqStats(channelId string, channelType uint8, checkpoint uint64) (uint64, uint64, error) {
+	searchRequest := bleve.NewSearchRequest(newChannelSeqQuery(channelId, channelType, 0, checkpoint))
+	searchRequest.Fields = []string{"message_seq"}
+	searchRequest.Size = 1
+	searchRequest.SortBy([]string{"message_seq"})
+	searchResult, err := s.msgIndex.Search(searchRequest)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(searchResult.Hits) == 0 {
+		return 0, 0, nil
+	}
+	messageSeq, ok := searchResult.Hits[0].Fields["message_seq"].(float64)
+	if !ok {
+		return 0, 0, nil
+	}
+	return uint64(messageSeq), searchResult.Total, nil
+}
+
+// 频道中消息序号在[startSeq, endSeq]的消息
+func newChannelSeqQuery(channelId string, channelType uint8, startSeq, endSeq uint64) query.Query {
+	q := bleve.NewConjunctionQuery()
+	channelIdQuery := bleve.NewTermQuery(channelId)
+	channelIdQuery.SetField("channel_id")
+	q.AddQuery(channelIdQuery)
+
+	ftype := float64(channelType)
+	start := ftype
+	end := ftype + 1
+	channelTypeQuery := bleve.NewNumericRangeQuery(&start, &end)
+	channelTypeQuery.SetField("channel_type")
+	q.AddQuery(channelTypeQuery)
+
+	minSeq := float64(startSeq)
+	maxSeq := float64(endSeq)
+	inclusive := true
+	seqQuery := bleve.NewNumericRangeInclusiveQuery(&minSeq, &maxSeq, &inclusive, &inclusive)
+	seqQuery.SetField("message_seq")
+	q.AddQuery(seqQuery)
+	return q
+}
+
+// 索引中频道最大的消息序号
+func (s *Search) maxIndexedMessageSeq(channelId string, channelType uint8) (uint64, error) {
+	query := bleve.NewConjunctionQuery()
+	channelIdQuery := bleve.NewTermQuery(channelId)
+	channelIdQuery.SetField("channel_id")
+	query.AddQuery(channelIdQuery)
+
+	ftype := float64(channelType)
+	start := ftype
+	end := ftype + 1
+	channelTypeQuery := bleve.NewNumericRangeQuery(&start, &end)
+	channelTypeQuery.SetField("channel_type")
+	query.AddQuery(channelTypeQuery)
+
+	searchRequest := bleve.NewSearchRequest(query)
+	searchRequest.Fields = []string{"message_seq"}
+	searchRequest.Size = 1
+	searchRequest.SortBy([]string{"-message_seq"})
+	searchResult, err := s.msgIndex.Search(searchRequest)
+	if err != nil {
+		return 0, err
+	}
+	if len(searchResult.Hits) == 0 {
+		return 0, nil
+	}
+	messageSeqObj, ok := searchResult.Hits[0].Fields["message_seq"].(float64)
+	if !ok {
+		return 0, nil
+	}
+	return uint64(messageSeqObj), nil
+}
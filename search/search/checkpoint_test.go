@@ -0,0 +1,54 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppendSeqRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []seqRange
+		r      seqRange
+		want   []seqRange
+	}{
+		{"first", nil, seqRange{3, 5}, []seqRange{{3, 5}}},
+		{"adjacent", []seqRange{{3, 5}}, seqRange{6, 8}, []seqRange{{3, 8}}},
+		{"overlapping", []seqRange{{3, 5}}, seqRange{4, 9}, []seqRange{{3, 9}}},
+		{"contained", []seqRange{{3, 9}}, seqRange{4, 5}, []seqRange{{3, 9}}},
+		{"separate", []seqRange{{3, 5}}, seqRange{7, 7}, []seqRange{{3, 5}, {7, 7}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendSeqRange(tt.ranges, tt.r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appendSeqRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeqRangeCoverage(t *testing.T) {
+	ranges := []seqRange{{3, 5}, {8, 8}}
+	tests := []struct {
+		start, end  uint64
+		wantMissing uint64
+		wantOk      bool
+		wantCovered uint64
+	}{
+		{1, 10, 1, true, 4},
+		{3, 5, 0, false, 3},
+		{3, 7, 6, true, 3},
+		{4, 8, 6, true, 3},
+		{8, 8, 0, false, 1},
+		{9, 12, 9, true, 0},
+	}
+	for _, tt := range tests {
+		missing, ok := firstUncoveredSeq(ranges, tt.start, tt.end)
+		if missing != tt.wantMissing || ok != tt.wantOk {
+			t.Errorf("firstUncoveredSeq(%d, %d) = %d %v, want %d %v", tt.start, tt.end, missing, ok, tt.wantMissing, tt.wantOk)
+		}
+		if covered := coveredSeqCount(ranges, tt.start, tt.end); covered != tt.wantCovered {
+			t.Errorf("coveredSeqCount(%d, %d) = %d, want %d", tt.start, tt.end, covered, tt.wantCovered)
+		}
+	}
+}
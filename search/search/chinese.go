@@ -0,0 +1,316 @@
+package search
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/WuKongIM/wklog"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/longbridgeapp/opencc"
+	"github.com/mozillazg/go-pinyin"
+	"go.uber.org/zap"
+)
+
+// 中文的变体
+const (
+	variantSimplified     = "simplified"      // 繁体转为简体
+	variantPinyin         = "pinyin"          // 全拼
+	variantPinyinInitials = "pinyin_initials" // 拼音首字母
+)
+
+// 消息内容的变体字段，索引在 payload.content 下
+const (
+	contentSimplifiedField     = "content_simplified"
+	contentPinyinField         = "content_pinyin"
+	contentPinyinInitialsField = "content_pinyin_initials"
+)
+
+// 变体的权重，原文匹配排在最前
+const (
+	simplifiedMatchBoost     = 1.0
+	pinyinMatchBoost         = 0.5
+	pinyinInitialsMatchBoost = 0.25
+)
+
+const (
+	zhVariantCharFilterName = "zh_variant"
+	pinyinTokenFilterName   = "pinyin"
+)
+
+// 中文搜索的选项
+type ChineseOptions struct {
+	Pinyin      bool `json:"pinyin"`      // 支持拼音（全拼和首字母）搜索
+	Traditional bool `json:"traditional"` // 繁体和简体互相搜索
+}
+
+var (
+	chineseOptionsLock sync.RWMutex
+	chineseOptions     ChineseOptions
+
+	t2sOnce sync.Once
+	t2s     *opencc.OpenCC
+)
+
+// SetChineseOptions 设置中文搜索的选项，已打开的索引需要调用Search.ReloadAnalysis迁移
+func SetChineseOptions(opts ChineseOptions) {
+	chineseOptionsLock.Lock()
+	defer chineseOptionsLock.Unlock()
+	chineseOptions = opts
+}
+
+func getChineseOptions() ChineseOptions {
+	chineseOptionsLock.RLock()
+	defer chineseOptionsLock.RUnlock()
+	return chineseOptions
+}
+
+func (o ChineseOptions) enabled(variant string) bool {
+	switch variant {
+	case variantSimplified:
+		return o.Traditional
+	case variantPinyin, variantPinyinInitials:
+		return o.Pinyin
+	}
+	return false
+}
+
+// 繁体转简体，词典较大，第一次使用时加载
+func toSimplified(text string) string {
+	t2sOnce.Do(func() {
+		var err error
+		t2s, err = opencc.New("t2s")
+		if err != nil {
+			wklog.Error("load t2s dictionary error", zap.Error(err))
+		}
+	})
+	if t2s == nil {
+		return text
+	}
+	result, err := t2s.Convert(text)
+	if err != nil {
+		return text
+	}
+	return result
+}
+
+// 给 payload.content 添加中文变体的子字段
+func addChineseVariantMappings(indexMapping *mapping.IndexMappingImpl, payloadMapping *mapping.DocumentMapping) error {
+	for _, variant := range []string{variantSimplified, variantPinyin} {
+		err := indexMapping.AddCustomCharFilter(variantCharFilterName(variant), map[string]interface{}{
+			"type":    zhVariantCharFilterName,
+			"variant": variant,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, initials := range []bool{false, true} {
+		name := pinyinFilterName(initials)
+		err := indexMapping.AddCustomTokenFilter(name, map[string]interface{}{
+			"type":     pinyinTokenFilterName,
+			"initials": initials,
+		})
+		if err != nil {
+			return err
+		}
+		// 查询时保留输入的字母，例如 zhongguo zg
+		err = indexMapping.AddCustomTokenFilter(pinyinQueryFilterName(initials), map[string]interface{}{
+			"type":       pinyinTokenFilterName,
+			"initials":   initials,
+			"keep_latin": true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	analyzers := map[string]map[string]interface{}{
+		contentSimplifiedField: {
+			"char_filters":  []string{variantCharFilterName(variantSimplified)},
+			"token_filters": []string{lowercase.Name},
+		},
+		contentPinyinField: {
+			"char_filters":  []string{variantCharFilterName(variantPinyin)},
+			"token_filters": []string{lowercase.Name, pinyinFilterName(false)},
+		},
+		contentPinyinInitialsField: {
+			"char_filters":  []string{variantCharFilterName(variantPinyin)},
+			"token_filters": []string{lowercase.Name, pinyinFilterName(true)},
+		},
+		pinyinQueryAnalyzer(false): {
+			"token_filters": []string{lowercase.Name, pinyinQueryFilterName(false)},
+		},
+		pinyinQueryAnalyzer(true): {
+			"token_filters": []string{lowercase.Name, pinyinQueryFilterName(true)},
+		},
+	}
+	for name, config := range analyzers {
+		config["type"] = custom.Name
+		config["tokenizer"] = langTokenizerName(LangZh)
+		if err := indexMapping.AddCustomAnalyzer(name, config); err != nil {
+			return err
+		}
+	}
+
+	for _, field := range []string{contentSimplifiedField, contentPinyinField, contentPinyinInitialsField} {
+		fieldMapping := bleve.NewTextFieldMapping()
+		fieldMapping.Name = field
+		fieldMapping.Analyzer = field
+		fieldMapping.Store = false
+		fieldMapping.IncludeInAll = false
+		payloadMapping.AddFieldMappingsAt("content", fieldMapping)
+	}
+	return nil
+}
+
+func variantCharFilterName(variant string) string {
+	return "zh_" + variant
+}
+
+func pinyinFilterName(initials bool) string {
+	if initials {
+		return "pinyin_initials"
+	}
+	return "pinyin_full"
+}
+
+func pinyinQueryFilterName(initials bool) string {
+	return pinyinFilterName(initials) + "_query"
+}
+
+// 查询拼音字段的分析器，输入可以是中文或拼音
+func pinyinQueryAnalyzer(initials bool) string {
+	if initials {
+		return contentPinyinInitialsField + "_query"
+	}
+	return contentPinyinField + "_query"
+}
+
+// 开启的中文变体的查询，权重低于原文
+func chineseVariantQueries(text string, opts MatchOptions) []query.Query {
+	queries := make([]query.Query, 0)
+	if opts.Mode == MatchExact {
+		return queries
+	}
+	chineseOpts := getChineseOptions()
+	if chineseOpts.Traditional && hasHan(text) {
+		queries = append(queries, newVariantQuery("payload."+contentSimplifiedField, "", text, opts, simplifiedMatchBoost))
+	}
+	if chineseOpts.Pinyin {
+		queries = append(queries,
+			newVariantQuery("payload."+contentPinyinField, pinyinQueryAnalyzer(false), text, opts, pinyinMatchBoost),
+			newVariantQuery("payload."+contentPinyinInitialsField, pinyinQueryAnalyzer(true), text, opts, pinyinInitialsMatchBoost),
+		)
+	}
+	return queries
+}
+
+func newVariantQuery(field string, analyzer string, text string, opts MatchOptions, boost float64) query.Query {
+	// 输入的拼音边输入边搜索，拼音之间的空格忽略
+	if opts.Mode == MatchPrefix && analyzer != "" && !hasHan(text) {
+		prefixQuery := bleve.NewPrefixQuery(strings.ToLower(strings.Join(strings.Fields(text), "")))
+		prefixQuery.SetField(field)
+		prefixQuery.SetBoost(boost)
+		return prefixQuery
+	}
+	q := newMatchQuery(field, text, boost)
+	if analyzer != "" {
+		q.Analyzer = analyzer
+	}
+	if opts.Mode == MatchFuzzy {
+		fuzziness := opts.Fuzziness
+		if fuzziness == 0 {
+			fuzziness = defaultFuzziness
+		}
+		q.SetFuzziness(fuzziness)
+	}
+	return q
+}
+
+func hasHan(text string) bool {
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// 变体未开启时不索引内容，开启了繁简体时转换为简体
+type zhVariantCharFilter struct {
+	variant string
+}
+
+func (f *zhVariantCharFilter) Filter(input []byte) []byte {
+	opts := getChineseOptions()
+	if !opts.enabled(f.variant) {
+		return nil
+	}
+	if opts.Traditional {
+		return []byte(toSimplified(string(input)))
+	}
+	return input
+}
+
+// 中文词转为拼音，不包含中文的词丢弃（keepLatin时保留）
+type pinyinTokenFilter struct {
+	initials  bool
+	keepLatin bool
+	args      pinyin.Args
+}
+
+func (f *pinyinTokenFilter) Filter(input analysis.TokenStream) analysis.TokenStream {
+	output := make(analysis.TokenStream, 0, len(input))
+	for _, token := range input {
+		term := string(token.Term)
+		if !hasHan(term) {
+			if f.keepLatin && isLatin(term) {
+				output = append(output, token)
+			}
+			continue
+		}
+		py := strings.Join(pinyin.LazyPinyin(term, f.args), "")
+		if py == "" {
+			continue
+		}
+		token.Term = []byte(py)
+		output = append(output, token)
+	}
+	return output
+}
+
+func isLatin(text string) bool {
+	for _, r := range text {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return text != ""
+}
+
+func zhVariantCharFilterConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.CharFilter, error) {
+	variant, _ := config["variant"].(string)
+	return &zhVariantCharFilter{variant: variant}, nil
+}
+
+func pinyinTokenFilterConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.TokenFilter, error) {
+	initials, _ := config["initials"].(bool)
+	keepLatin, _ := config["keep_latin"].(bool)
+	args := pinyin.NewArgs()
+	if initials {
+		args.Style = pinyin.FirstLetter
+	}
+	return &pinyinTokenFilter{initials: initials, keepLatin: keepLatin, args: args}, nil
+}
+
+func init() {
+	registry.RegisterCharFilter(zhVariantCharFilterName, zhVariantCharFilterConstructor)
+	registry.RegisterTokenFilter(pinyinTokenFilterName, pinyinTokenFilterConstructor)
+}
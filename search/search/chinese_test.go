@@ -0,0 +1,79 @@
+package search
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestIndexFingerprintChineseOptions(t *testing.T) {
+	custom := AnalysisOptions{Language: LangZh, StopWords: []string{"的"}}
+	data, _ := json.Marshal(custom)
+	sum := sha1.Sum(data)
+	tests := []struct {
+		name     string
+		analysis AnalysisOptions
+		chinese  ChineseOptions
+		want     string // 为空时只检查与其他选项不同
+	}{
+		{"default", DefaultAnalysisOptions, ChineseOptions{}, ""},
+		{"custom analysis keeps the previous fingerprint", custom, ChineseOptions{}, hex.EncodeToString(sum[:4])},
+		{"pinyin", DefaultAnalysisOptions, ChineseOptions{Pinyin: true}, ""},
+		{"traditional", DefaultAnalysisOptions, ChineseOptions{Traditional: true}, ""},
+		{"pinyin and traditional", DefaultAnalysisOptions, ChineseOptions{Pinyin: true, Traditional: true}, ""},
+		{"custom analysis with pinyin", custom, ChineseOptions{Pinyin: true}, ""},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		got := tt.analysis.fingerprint(tt.chinese)
+		if tt.want != "" && got != tt.want {
+			t.Errorf("%s: fingerprint() = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.name != "default" && got == "" {
+			t.Errorf("%s: fingerprint() is empty", tt.name)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%s: fingerprint() = %q, same as %s", tt.name, got, other)
+		}
+		seen[got] = tt.name
+	}
+}
+
+func TestCurrentMessageIndexNameChineseOptions(t *testing.T) {
+	defer SetChineseOptions(ChineseOptions{})
+	name := currentMessageIndexName()
+	// 开启拼音后需要迁移到新的索引，已有的消息才有拼音
+	SetChineseOptions(ChineseOptions{Pinyin: true})
+	if currentMessageIndexName() == name {
+		t.Errorf("currentMessageIndexName() = %s, want a new index when pinyin is enabled", name)
+	}
+	SetChineseOptions(ChineseOptions{})
+	if got := currentMessageIndexName(); got != name {
+		t.Errorf("currentMessageIndexName() = %s, want %s", got, name)
+	}
+}
+
+func TestSearchChineseVariants(t *testing.T) {
+	defer SetChineseOptions(ChineseOptions{})
+	SetChineseOptions(ChineseOptions{Pinyin: true, Traditional: true})
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "發布會議")
+	m2 := newTestMessage("c1", 2, 2, "u1", "你好世界")
+	indexTestMessages(t, s, 0, m1, m2)
+
+	tests := []struct {
+		q    string
+		want []int64
+	}{
+		{"发布", []int64{m1.MessageId}},
+		{"nihao", []int64{m2.MessageId}},
+		{"nh", []int64{m2.MessageId}},
+	}
+	for _, tt := range tests {
+		if got := searchTestContent(t, s, tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %s = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package search
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultContextSize = 10  // 默认返回前后各多少条消息
+	maxContextSize     = 100 // 前后最多返回的消息数量
+)
+
+var ErrUidRequired = newBadRequest("uid is required for person channel")
+
+type ContextReq struct {
+	ChannelId   string `json:"channel_id"`   // 频道ID
+	ChannelType uint8  `json:"channel_type"` // 频道类型
+	MessageSeq  uint64 `json:"message_seq"`  // 定位的消息序号
+	Before      int    `json:"before"`       // 返回之前的消息数量（before和after都为0时各返回10条）
+	After       int    `json:"after"`        // 返回之后的消息数量
+}
+
+type ContextResp struct {
+	MessageSeq uint64     `json:"message_seq"` // 定位的消息序号
+	Messages   []*Message `json:"messages"`    // 消息列表，按照message_seq升序
+}
+
+// Check 校验请求参数，参数错误返回BadRequestError
+func (r ContextReq) Check() error {
+	if strings.TrimSpace(r.ChannelId) == "" {
+		return newBadRequest("channel_id is empty")
+	}
+	if r.MessageSeq == 0 {
+		return newBadRequest("message_seq is empty")
+	}
+	if r.Before < 0 || r.Before > maxContextSize || r.After < 0 || r.After > maxContextSize {
+		return newBadRequest("before and after must be between 0 and %d", maxContextSize)
+	}
+	return nil
+}
+
+// MessageContextAs 以uid的身份获取消息前后的消息，members为uid所在的频道（会话列表），频道不属于uid时返回ForbiddenError
+func (s *Search) MessageContextAs(uid string, members []*pluginproto.Channel, req ContextReq) (*ContextResp, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	channel := &pluginproto.Channel{
+		ChannelId:   req.ChannelId,
+		ChannelType: uint32(req.ChannelType),
+	}
+	if len(matchChannels(members, channel)) == 0 {
+		return nil, newForbidden("no permission for channel: %s", req.ChannelId)
+	}
+	resp, err := s.MessageContext(req)
+	if err != nil || !getAccessOptions().HideBeforeJoin {
+		return resp, err
+	}
+	// 不返回用户加入频道之前的消息
+	joinedAt, err := s.db.getMemberJoined(uid, req.ChannelId, req.ChannelType)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, 0, len(resp.Messages))
+	for _, msg := range resp.Messages {
+		if msg.Timestamp >= joinedAt {
+			messages = append(messages, msg)
+		}
+	}
+	resp.Messages = messages
+	return resp, nil
+}
+
+// MessageContext 获取消息前后的消息，优先从索引中读取，索引中没有的消息从服务端拉取
+func (s *Search) MessageContext(req ContextReq) (*ContextResp, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	before, after := req.Before, req.After
+	if before == 0 && after == 0 {
+		before, after = defaultContextSize, defaultContextSize
+	}
+	startSeq := uint64(1)
+	if req.MessageSeq > uint64(before) {
+		startSeq = req.MessageSeq - uint64(before)
+	}
+	endSeq := req.MessageSeq + uint64(after)
+
+	messageMap, err := s.indexedMessagesBySeq(req.ChannelId, req.ChannelType, startSeq, endSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	// 补齐索引中缺失的消息
+	if uint64(len(messageMap)) < endSeq-startSeq+1 {
+		if err = s.fillMessageGaps(req.ChannelId, req.ChannelType, startSeq, endSeq, messageMap); err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make([]*Message, 0, len(messageMap))
+	for _, msg := range messageMap {
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].MessageSeq < messages[j].MessageSeq
+	})
+	return &ContextResp{
+		MessageSeq: req.MessageSeq,
+		Messages:   messages,
+	}, nil
+}
+
+// 从索引中读取频道指定序号范围内的消息
+func (s *Search) indexedMessagesBySeq(channelId string, channelType uint8, startSeq, endSeq uint64) (map[uint64]*Message, error) {
+	channelIdQuery := bleve.NewTermQuery(channelId)
+	channelIdQuery.SetField("channel_id")
+
+	ftype := float64(channelType)
+	typeStart, typeEnd := ftype, ftype+1
+	channelTypeQuery := bleve.NewNumericRangeQuery(&typeStart, &typeEnd)
+	channelTypeQuery.SetField("channel_type")
+
+	seqStart, seqEnd := float64(startSeq), float64(endSeq+1)
+	seqQuery := bleve.NewNumericRangeQuery(&seqStart, &seqEnd)
+	seqQuery.SetField("message_seq")
+
+	searchRequest := bleve.NewSearchRequest(bleve.NewConjunctionQuery(channelIdQuery, channelTypeQuery, seqQuery))
+	searchRequest.Fields = []string{"*"}
+	searchRequest.Size = int(endSeq - startSeq + 1)
+	searchRequest.SortBy([]string{"message_seq"})
+	searchResult, err := s.msgIndex.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	messageMap := make(map[uint64]*Message, len(searchResult.Hits))
+	for _, hit := range searchResult.Hits {
+		msg := newMessageFromHit(hit)
+		messageMap[msg.MessageSeq] = msg
+	}
+	return messageMap, nil
+}
+
+// 从服务端拉取缺失的消息，已撤回、删除的消息不返回
+// 已知不需要索引的消息（skipped_seq）不再拉取，检查点之前缺少的消息回退检查点重新索引
+func (s *Search) fillMessageGaps(channelId string, channelType uint8, startSeq, endSeq uint64, messageMap map[uint64]*Message) error {
+	skipped, err := s.db.getSkippedSeqs(channelId, channelType)
+	if err != nil {
+		return err
+	}
+	known := func(seq uint64) bool {
+		if _, ok := messageMap[seq]; ok {
+			return true
+		}
+		_, ok := firstUncoveredSeq(skipped, seq, seq)
+		return !ok
+	}
+	reqs := make([]*pluginproto.ChannelMessageReq, 0)
+	for seq := startSeq; seq <= endSeq; seq++ {
+		if known(seq) {
+			continue
+		}
+		gapStart := seq
+		for seq+1 <= endSeq && !known(seq+1) {
+			seq++
+		}
+		reqs = append(reqs, &pluginproto.ChannelMessageReq{
+			ChannelId:       channelId,
+			ChannelType:     uint32(channelType),
+			StartMessageSeq: gapStart,
+			Limit:           uint32(seq - gapStart + 1),
+		})
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	// 检查点之前既没有索引也不知道不需要索引的消息，由索引流程重新拉取确认
+	// 这里的响应可能不完整，不记录不需要索引的消息
+	checkpoint, err := s.getChannelMaxMessageSeq(channelId, channelType)
+	if err != nil {
+		s.Warn("get channel max message seq error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+	} else if firstSeq := reqs[0].StartMessageSeq; firstSeq <= checkpoint {
+		s.Info("context seq gap", zap.String("channelId", channelId), zap.Uint8("channelType", channelType), zap.Uint64("missingSeq", firstSeq), zap.Uint64("checkpoint", checkpoint))
+		if err = s.rewindChannel(channelId, channelType, firstSeq); err != nil {
+			s.Warn("rewind channel checkpoint error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+		}
+	}
+
+	resp, err := getChannelMessages(&pluginproto.ChannelMessageBatchReq{
+		ChannelMessageReqs: reqs,
+	})
+	if err != nil {
+		return err
+	}
+	for _, channelMessageResp := range resp.ChannelMessageResps {
+		for _, m := range channelMessageResp.Messages {
+			if m.MessageSeq < startSeq || m.MessageSeq > endSeq {
+				continue
+			}
+			if _, ok := messageMap[m.MessageSeq]; ok {
+				continue
+			}
+			if !s.applyMessageEvents(m) {
+				continue
+			}
+			// 与索引一致，不是JSON的内容使用解码器转换，不能解码的消息不返回
+			payload, reason := decodePayload(m)
+			if reason != "" {
+				continue
+			}
+			msg := newMessageWithPayload(m, payload)
+			msg.Payload = payload // 与搜索结果一致，返回payload的JSON
+			messageMap[m.MessageSeq] = msg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package search
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+// 替换拉取消息的函数，服务端只返回messages中的消息
+func stubChannelMessages(t *testing.T, messages ...*pluginproto.Message) *int {
+	t.Helper()
+	calls := 0
+	old := getChannelMessages
+	getChannelMessages = func(req *pluginproto.ChannelMessageBatchReq) (*pluginproto.ChannelMessageBatchResp, error) {
+		calls++
+		resp := &pluginproto.ChannelMessageBatchResp{}
+		for _, r := range req.ChannelMessageReqs {
+			channelResp := &pluginproto.ChannelMessageResp{
+				ChannelId:   r.ChannelId,
+				ChannelType: r.ChannelType,
+				Limit:       r.Limit,
+			}
+			for _, m := range messages {
+				if m.ChannelId == r.ChannelId && m.ChannelType == r.ChannelType && m.MessageSeq >= r.StartMessageSeq && m.MessageSeq < r.StartMessageSeq+uint64(r.Limit) {
+					channelResp.Messages = append(channelResp.Messages, m)
+				}
+			}
+			resp.ChannelMessageResps = append(resp.ChannelMessageResps, channelResp)
+		}
+		return resp, nil
+	}
+	t.Cleanup(func() { getChannelMessages = old })
+	return &calls
+}
+
+func contextSeqs(resp *ContextResp) []uint64 {
+	seqs := make([]uint64, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		seqs = append(seqs, m.MessageSeq)
+	}
+	return seqs
+}
+
+func TestMessageContextGap(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	msgs := make([]*pluginproto.Message, 0)
+	for seq := uint64(1); seq <= 5; seq++ {
+		msgs = append(msgs, newTestMessage("c1", 2, seq, "u1", "hello"))
+	}
+	indexTestMessages(t, s, 0, msgs...)
+	// 索引中丢失了第3条消息
+	err := s.indexBatch(func(batch *messageBatch) {
+		batch.Delete(strconv.FormatInt(msgs[2].MessageId, 10))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端的响应不完整时不记录不需要索引的消息，回退检查点重新索引
+	stubChannelMessages(t)
+	resp, err := s.MessageContext(ContextReq{ChannelId: "c1", ChannelType: 2, MessageSeq: 3, Before: 2, After: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contextSeqs(resp), []uint64{1, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("context seqs = %v, want %v", got, want)
+	}
+	if skipped, _ := s.db.getSkippedSeqs("c1", 2); len(skipped) != 0 {
+		t.Errorf("skipped seqs = %v, want none", skipped)
+	}
+	if checkpoint, _ := s.getChannelMaxMessageSeq("c1", 2); checkpoint != 2 {
+		t.Errorf("checkpoint = %d, want 2", checkpoint)
+	}
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Errorf("pending channels = %v, want [c1:2]", got)
+	}
+
+	// 服务端返回的消息直接返回
+	stubChannelMessages(t, msgs[2])
+	resp, err = s.MessageContext(ContextReq{ChannelId: "c1", ChannelType: 2, MessageSeq: 3, Before: 2, After: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contextSeqs(resp), []uint64{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("context seqs = %v, want %v", got, want)
+	}
+}
+
+func TestMessageContextAfterCheckpoint(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	m1 := newTestMessage("c1", 2, 1, "u1", "hello")
+	m2 := newTestMessage("c1", 2, 2, "u1", "hello")
+	indexTestMessages(t, s, 0, m1)
+
+	// 检查点之后的消息还没有索引，不需要回退
+	calls := stubChannelMessages(t, m2)
+	resp, err := s.MessageContext(ContextReq{ChannelId: "c1", ChannelType: 2, MessageSeq: 1, After: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contextSeqs(resp), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("context seqs = %v, want %v", got, want)
+	}
+	if *calls != 1 {
+		t.Errorf("GetChannelMessages calls = %d, want 1", *calls)
+	}
+	if checkpoint, _ := s.getChannelMaxMessageSeq("c1", 2); checkpoint != 1 {
+		t.Errorf("checkpoint = %d, want 1", checkpoint)
+	}
+	if got := pendingChannels(t, s); len(got) != 0 {
+		t.Errorf("pending channels = %v, want none", got)
+	}
+
+	// 已知不需要索引的消息不再拉取
+	if err = s.db.addSkippedSeqs("c1", 2, []seqRange{{2, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.MessageContext(ContextReq{ChannelId: "c1", ChannelType: 2, MessageSeq: 1, After: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 1 {
+		t.Errorf("GetChannelMessages calls = %d, want 1", *calls)
+	}
+}
+
+func TestMessageContextAs(t *testing.T) {
+	s := newTestSearch(t)
+	indexTestMessages(t, s, 0, newTestMessage("c1", 2, 1, "u1", "hello"), newTestMessage("c1", 2, 2, "u1", "hello"))
+	stubChannelMessages(t)
+	members := []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 2}}
+	req := ContextReq{ChannelId: "c1", ChannelType: 2, MessageSeq: 1, After: 1}
+
+	if _, err := s.MessageContextAs("u1", nil, req); !IsForbidden(err) {
+		t.Errorf("MessageContextAs() error = %v for a non-member, want forbidden", err)
+	}
+	if _, err := s.MessageContextAs("u1", []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 1}}, req); !IsForbidden(err) {
+		t.Errorf("MessageContextAs() error = %v for another channel type, want forbidden", err)
+	}
+
+	// 不返回加入频道之前的消息
+	SetAccessOptions(AccessOptions{HideBeforeJoin: true})
+	defer SetAccessOptions(AccessOptions{})
+	if err := s.db.setMemberJoined("u1", "c1", 2, 1700000002); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.MessageContextAs("u1", members, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contextSeqs(resp), []uint64{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("context seqs = %v, want %v", got, want)
+	}
+}
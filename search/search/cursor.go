@@ -0,0 +1,104 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2/numeric"
+)
+
+var ErrInvalidCursor = newBadRequest("invalid cursor")
+
+const (
+	SortRelevance = "relevance" // 先按照相关度排序，再按照时间排序（默认）
+	SortTime      = "time"      // 按照时间排序
+)
+
+// 搜索结果的排序，最后按照消息id排序保证顺序唯一
+func searchSortBy(sortMode string) []string {
+	if sortMode == SortTime {
+		return []string{"-timestamp", "-_id"}
+	}
+	return []string{"-_score", "-timestamp", "-_id"}
+}
+
+// 游标，记录上一页最后一条消息的排序值
+type searchCursor struct {
+	Score     float64 `json:"s"`
+	Timestamp uint32  `json:"t"`
+	MessageId string  `json:"m"`
+}
+
+// EncodeCursor 根据消息的排序值生成游标
+func EncodeCursor(m *Message) string {
+	c := searchCursor{
+		Timestamp: m.Timestamp,
+		MessageId: m.MessageIdStr,
+	}
+	if m.Score != nil {
+		c.Score = *m.Score
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &searchCursor{}
+	if err = json.Unmarshal(data, c); err != nil || c.MessageId == "" {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// 转换为bleve的SearchAfter，顺序与searchSortBy一致
+func (c *searchCursor) searchAfter(sortMode string) []string {
+	timestamp := string(numeric.MustNewPrefixCodedInt64(numeric.Float64ToInt64(float64(c.Timestamp)), 0))
+	if sortMode == SortTime {
+		return []string{timestamp, c.MessageId}
+	}
+	return []string{
+		strconv.FormatFloat(c.Score, 'g', -1, 64),
+		timestamp,
+		c.MessageId,
+	}
+}
+
+// CompareMessage 按照搜索结果的排序比较两条消息，a在b之前返回负数
+func CompareMessage(sortMode string, a, b *Message) int {
+	if sortMode != SortTime {
+		var aScore, bScore float64
+		if a.Score != nil {
+			aScore = *a.Score
+		}
+		if b.Score != nil {
+			bScore = *b.Score
+		}
+		if aScore != bScore {
+			if aScore > bScore {
+				return -1
+			}
+			return 1
+		}
+	}
+	if a.Timestamp != b.Timestamp {
+		if a.Timestamp > b.Timestamp {
+			return -1
+		}
+		return 1
+	}
+	return -strings.Compare(a.MessageIdStr, b.MessageIdStr)
+}
+
+// SortMessages 按照搜索结果的排序对消息排序
+func SortMessages(sortMode string, messages []*Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return CompareMessage(sortMode, messages[i], messages[j]) < 0
+	})
+}
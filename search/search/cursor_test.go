@@ -0,0 +1,80 @@
+package search
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	score := 1.5
+	tests := []struct {
+		name string
+		msg  *Message
+		want searchCursor
+	}{
+		{"with score", &Message{Timestamp: 1700000000, MessageIdStr: "42", Score: &score}, searchCursor{Score: 1.5, Timestamp: 1700000000, MessageId: "42"}},
+		{"without score", &Message{Timestamp: 1, MessageIdStr: "7"}, searchCursor{Timestamp: 1, MessageId: "7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(EncodeCursor(tt.msg))
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("decodeCursor() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("abc"))},
+		{"no message id", base64.RawURLEncoding.EncodeToString([]byte(`{"s":1,"t":2}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor); err != ErrInvalidCursor {
+				t.Errorf("decodeCursor() error = %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestSortMessages(t *testing.T) {
+	high, low := 2.0, 1.0
+	messages := func() []*Message {
+		return []*Message{
+			{MessageIdStr: "1", Timestamp: 100, Score: &low},
+			{MessageIdStr: "2", Timestamp: 200, Score: &low},
+			{MessageIdStr: "3", Timestamp: 100, Score: &high},
+			{MessageIdStr: "4", Timestamp: 200, Score: &low},
+		}
+	}
+	tests := []struct {
+		sortMode string
+		want     []string
+	}{
+		{SortRelevance, []string{"3", "4", "2", "1"}},
+		{SortTime, []string{"4", "2", "3", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sortMode, func(t *testing.T) {
+			msgs := messages()
+			SortMessages(tt.sortMode, msgs)
+			got := make([]string, 0, len(msgs))
+			for _, m := range msgs {
+				got = append(got, m.MessageIdStr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SortMessages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/WuKongIM/go-pdk/pdk"
 	"github.com/cockroachdb/pebble"
@@ -13,11 +15,29 @@ type db struct {
 	pebbleDb *pebble.DB
 
 	channelMsgMaxSeqPrefix string
+	removedMsgPrefix       string // 已撤回/删除的消息
+	editedMsgPrefix        string // 已编辑的消息
+	pendingIndexPrefix     string // 待索引的频道
+	msgIndexNameKey        string // 当前使用的消息索引目录
+	msgIndexVersionKey     string // 当前使用的消息索引结构版本
+	searchHistoryPrefix    string // 用户的搜索历史
+	savedSearchPrefix      string // 用户保存的搜索
+	memberJoinedPrefix     string // 用户加入频道的时间
+	skippedSeqPrefix       string // 频道中不需要索引的消息序号区间
 }
 
 func newDb() *db {
 	d := &db{
 		channelMsgMaxSeqPrefix: "channel_msg_max_seq:",
+		removedMsgPrefix:       "removed_msg:",
+		editedMsgPrefix:        "edited_msg:",
+		pendingIndexPrefix:     "pending_index:",
+		msgIndexNameKey:        "msg_index_name",
+		msgIndexVersionKey:     "msg_index_version",
+		searchHistoryPrefix:    "search_history:",
+		savedSearchPrefix:      "saved_search:",
+		memberJoinedPrefix:     "member_joined:",
+		skippedSeqPrefix:       "skipped_seq:",
 	}
 
 	return d
@@ -82,6 +102,36 @@ func (d *db) setChannelMaxMessageSeq(channelId string, channelType uint8, messag
 	return d.pebbleDb.Set([]byte(key), buf, pebble.Sync)
 }
 
+// 重置频道已同步的最大消息序号，频道将从头开始索引
+func (d *db) resetChannelMaxMessageSeq(channelId string, channelType uint8) error {
+	key := fmt.Sprintf("%s%s:%d", d.channelMsgMaxSeqPrefix, channelId, channelType)
+	return d.pebbleDb.Delete([]byte(key), pebble.Sync)
+}
+
+// 遍历所有已索引过的频道，fn返回false停止遍历
+func (d *db) rangeIndexedChannels(fn func(channelId string, channelType uint8) bool) error {
+	prefix := []byte(d.channelMsgMaxSeqPrefix)
+	iter, err := d.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := strings.TrimPrefix(string(iter.Key()), d.channelMsgMaxSeqPrefix)
+		channelId, channelType, ok := parseChannelKey(key)
+		if !ok {
+			continue
+		}
+		if !fn(channelId, channelType) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
 // 获取频道已同步的最大消息序号
 func (d *db) getChannelMaxMessageSeq(channelId string, channelType uint8) (uint64, error) {
 	key := fmt.Sprintf("%s%s:%d", d.channelMsgMaxSeqPrefix, channelId, channelType)
@@ -99,3 +149,420 @@ func (d *db) getChannelMaxMessageSeq(channelId string, channelType uint8) (uint6
 
 	return binary.BigEndian.Uint64(data), nil
 }
+
+// 撤回和编辑记录的头部：格式标记、消息所在的频道类型、消息时间，按照保留策略清理时使用
+// 旧版本的记录没有头部（撤回记录的值为1，编辑记录的值为消息内容）
+const (
+	messageEventMarker    = 0
+	messageEventHeaderLen = 6
+	// 不知道消息所在的频道类型（消息未索引或旧版本的记录），所有频道类型都过期后清理
+	unknownChannelType = 0
+)
+
+func encodeMessageEvent(channelType uint8, timestamp uint32, payload []byte) []byte {
+	value := make([]byte, messageEventHeaderLen+len(payload))
+	value[0] = messageEventMarker
+	value[1] = channelType
+	binary.BigEndian.PutUint32(value[2:], timestamp)
+	copy(value[messageEventHeaderLen:], payload)
+	return value
+}
+
+// 解析记录，ok为false表示旧版本没有头部的记录
+func decodeMessageEvent(value []byte) (channelType uint8, timestamp uint32, payload []byte, ok bool) {
+	if len(value) < messageEventHeaderLen || value[0] != messageEventMarker {
+		return 0, 0, value, false
+	}
+	return value[1], binary.BigEndian.Uint32(value[2:]), value[messageEventHeaderLen:], true
+}
+
+// 标记消息已被移除（撤回或删除），后续不再索引，channelType和timestamp为消息所在的频道类型和时间
+func (d *db) setMessageRemoved(messageId int64, channelType uint8, timestamp uint32) error {
+	batch := d.pebbleDb.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(d.removedMsgKey(messageId), encodeMessageEvent(channelType, timestamp, nil), pebble.NoSync); err != nil {
+		return err
+	}
+	// 已移除的消息不再需要编辑内容
+	if err := batch.Delete(d.editedMsgKey(messageId), pebble.NoSync); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// 消息是否已被移除
+func (d *db) isMessageRemoved(messageId int64) (bool, error) {
+	_, closer, err := d.pebbleDb.Get(d.removedMsgKey(messageId))
+	if closer != nil {
+		defer closer.Close()
+	}
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// 保存消息编辑后的内容，channelType和timestamp为消息所在的频道类型和时间
+func (d *db) setMessageEdited(messageId int64, channelType uint8, timestamp uint32, payload []byte) error {
+	return d.pebbleDb.Set(d.editedMsgKey(messageId), encodeMessageEvent(channelType, timestamp, payload), pebble.Sync)
+}
+
+// 获取消息编辑后的内容，没有编辑过返回nil
+func (d *db) getMessageEdited(messageId int64) ([]byte, error) {
+	value, err := d.get(d.editedMsgKey(messageId))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	_, _, payload, _ := decodeMessageEvent(value)
+	return payload, nil
+}
+
+// 删除过期消息的撤回和编辑记录，cutoff返回频道类型的过期时间（0表示不过期）
+// 旧版本的记录不知道消息时间，以now作为消息时间补写头部，之后按照unknownChannelType清理
+func (d *db) pruneMessageEvents(cutoff func(channelType uint8) uint32, now uint32) (uint64, error) {
+	var pruned uint64
+	for _, prefix := range []string{d.removedMsgPrefix, d.editedMsgPrefix} {
+		batch := d.pebbleDb.NewBatch()
+		var commitErr error
+		err := d.rangeMessages(prefix, func(messageId int64, value []byte) bool {
+			key := []byte(fmt.Sprintf("%s%d", prefix, messageId))
+			channelType, timestamp, payload, ok := decodeMessageEvent(value)
+			if !ok {
+				if prefix == d.removedMsgPrefix {
+					payload = nil
+				}
+				_ = batch.Set(key, encodeMessageEvent(unknownChannelType, now, payload), pebble.NoSync)
+			} else if c := cutoff(channelType); c > 0 && timestamp < c {
+				_ = batch.Delete(key, pebble.NoSync)
+				pruned++
+			}
+			if batch.Count() >= retentionDeletePageSize {
+				if commitErr = batch.Commit(pebble.NoSync); commitErr != nil {
+					return false
+				}
+				batch.Reset()
+			}
+			return true
+		})
+		if err == nil {
+			err = commitErr
+		}
+		if err == nil {
+			err = batch.Commit(pebble.NoSync)
+		}
+		batch.Close()
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+func (d *db) removedMsgKey(messageId int64) []byte {
+	return []byte(fmt.Sprintf("%s%d", d.removedMsgPrefix, messageId))
+}
+
+func (d *db) editedMsgKey(messageId int64) []byte {
+	return []byte(fmt.Sprintf("%s%d", d.editedMsgPrefix, messageId))
+}
+
+// 添加待索引的频道（同一个频道只会保存一条），同步写入，插件崩溃后也不会丢失
+func (d *db) addPendingIndex(channelId string, channelType uint8) error {
+	return d.pebbleDb.Set(d.pendingIndexKey(channelId, channelType), nil, pebble.Sync)
+}
+
+// 频道已索引完成，移除待索引记录（丢失时只会多索引一次，不需要同步）
+func (d *db) removePendingIndex(channelId string, channelType uint8) error {
+	return d.pebbleDb.Delete(d.pendingIndexKey(channelId, channelType), pebble.NoSync)
+}
+
+// 遍历所有待索引的频道，fn返回false停止遍历
+func (d *db) rangePendingIndex(fn func(channelId string, channelType uint8) bool) error {
+	prefix := []byte(d.pendingIndexPrefix)
+	iter, err := d.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := strings.TrimPrefix(string(iter.Key()), d.pendingIndexPrefix)
+		channelId, channelType, ok := parseChannelKey(key)
+		if !ok {
+			continue
+		}
+		if !fn(channelId, channelType) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// 记录频道中不需要索引的消息序号区间
+func (d *db) addSkippedSeqs(channelId string, channelType uint8, ranges []seqRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	batch := d.pebbleDb.NewBatch()
+	defer batch.Close()
+	for _, r := range ranges {
+		if err := batch.Set(d.skippedSeqKey(channelId, channelType, r.start), encodeMessageSeq(r.end), pebble.NoSync); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.NoSync)
+}
+
+// 频道中不需要索引的消息序号区间，按照开始序号排序，重叠的区间已合并
+func (d *db) getSkippedSeqs(channelId string, channelType uint8) ([]seqRange, error) {
+	prefix := []byte(fmt.Sprintf("%s%s:%d:", d.skippedSeqPrefix, channelId, channelType))
+	iter, err := d.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	ranges := make([]seqRange, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		start, err := strconv.ParseUint(strings.TrimPrefix(string(iter.Key()), string(prefix)), 10, 64)
+		if err != nil || len(iter.Value()) != 8 {
+			continue
+		}
+		ranges = appendSeqRange(ranges, seqRange{start: start, end: decodeMessageSeq(iter.Value())})
+	}
+	return ranges, iter.Error()
+}
+
+// 开始序号补齐为20位，按照key的顺序就是序号的顺序
+func (d *db) skippedSeqKey(channelId string, channelType uint8, start uint64) []byte {
+	return []byte(fmt.Sprintf("%s%s:%d:%020d", d.skippedSeqPrefix, channelId, channelType, start))
+}
+
+func (d *db) pendingIndexKey(channelId string, channelType uint8) []byte {
+	return []byte(fmt.Sprintf("%s%s:%d", d.pendingIndexPrefix, channelId, channelType))
+}
+
+// 解析 channelId:channelType 格式的key
+func parseChannelKey(key string) (string, uint8, bool) {
+	i := strings.LastIndex(key, ":")
+	if i <= 0 {
+		return "", 0, false
+	}
+	channelType, err := strconv.ParseUint(key[i+1:], 10, 8)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], uint8(channelType), true
+}
+
+// 前缀的上界，用于遍历指定前缀的key
+func prefixUpperBound(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// 保存当前使用的消息索引
+func (d *db) setMessageIndexMeta(name string, version int) error {
+	batch := d.pebbleDb.NewBatch()
+	defer batch.Close()
+	if err := batch.Set([]byte(d.msgIndexNameKey), []byte(name), pebble.NoSync); err != nil {
+		return err
+	}
+	var buf = make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	if err := batch.Set([]byte(d.msgIndexVersionKey), buf, pebble.NoSync); err != nil {
+		return err
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// 获取当前使用的消息索引，没有保存过返回空
+func (d *db) getMessageIndexMeta() (string, int, error) {
+	name, err := d.get([]byte(d.msgIndexNameKey))
+	if err != nil || len(name) == 0 {
+		return "", 0, err
+	}
+	version, err := d.get([]byte(d.msgIndexVersionKey))
+	if err != nil || len(version) != 8 {
+		return "", 0, err
+	}
+	return string(name), int(binary.BigEndian.Uint64(version)), nil
+}
+
+// 创建db的快照（pebble检查点），dir不能已存在
+func (d *db) checkpoint(dir string) error {
+	return d.pebbleDb.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
+// db占用的磁盘空间
+func (d *db) diskSize() uint64 {
+	return d.pebbleDb.Metrics().DiskSpaceUsage()
+}
+
+// 用快照中的频道检查点和消息索引信息替换当前的，待索引的频道、消息事件和用户数据保留当前的
+func (d *db) restoreIndexState(dir string) error {
+	snapshot, err := pebble.Open(dir, &pebble.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	batch := d.pebbleDb.NewBatch()
+	defer batch.Close()
+	prefix := []byte(d.channelMsgMaxSeqPrefix)
+	if err = batch.DeleteRange(prefix, prefixUpperBound(prefix), pebble.NoSync); err != nil {
+		return err
+	}
+	iter, err := snapshot.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err = batch.Set(iter.Key(), iter.Value(), pebble.NoSync); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	for _, key := range []string{d.msgIndexNameKey, d.msgIndexVersionKey} {
+		value, closer, err := snapshot.Get([]byte(key))
+		if err == pebble.ErrNotFound {
+			if err = batch.Delete([]byte(key), pebble.NoSync); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = batch.Set([]byte(key), value, pebble.NoSync)
+		closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// 遍历所有已移除的消息，fn返回false停止遍历
+func (d *db) rangeRemovedMessages(fn func(messageId int64) bool) error {
+	return d.rangeMessages(d.removedMsgPrefix, func(messageId int64, _ []byte) bool {
+		return fn(messageId)
+	})
+}
+
+// 遍历所有已编辑的消息，fn返回false停止遍历
+func (d *db) rangeEditedMessages(fn func(messageId int64, payload []byte) bool) error {
+	return d.rangeMessages(d.editedMsgPrefix, func(messageId int64, value []byte) bool {
+		_, _, payload, _ := decodeMessageEvent(value)
+		return fn(messageId, payload)
+	})
+}
+
+func (d *db) rangeMessages(prefixStr string, fn func(messageId int64, value []byte) bool) error {
+	prefix := []byte(prefixStr)
+	iter, err := d.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		messageId, err := strconv.ParseInt(strings.TrimPrefix(string(iter.Key()), prefixStr), 10, 64)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, len(iter.Value()))
+		copy(value, iter.Value())
+		if !fn(messageId, value) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// 保存用户的搜索历史
+func (d *db) setSearchHistory(uid string, data []byte) error {
+	return d.pebbleDb.Set(d.searchHistoryKey(uid), data, pebble.Sync)
+}
+
+// 获取用户的搜索历史，没有返回nil
+func (d *db) getSearchHistory(uid string) ([]byte, error) {
+	return d.get(d.searchHistoryKey(uid))
+}
+
+func (d *db) searchHistoryKey(uid string) []byte {
+	return []byte(fmt.Sprintf("%s%s", d.searchHistoryPrefix, uid))
+}
+
+// 保存用户保存的搜索
+func (d *db) setSavedSearches(uid string, data []byte) error {
+	return d.pebbleDb.Set(d.savedSearchKey(uid), data, pebble.Sync)
+}
+
+// 获取用户保存的搜索，没有返回nil
+func (d *db) getSavedSearches(uid string) ([]byte, error) {
+	return d.get(d.savedSearchKey(uid))
+}
+
+func (d *db) savedSearchKey(uid string) []byte {
+	return []byte(fmt.Sprintf("%s%s", d.savedSearchPrefix, uid))
+}
+
+// 保存用户加入频道的时间
+func (d *db) setMemberJoined(uid string, channelId string, channelType uint8, joinedAt uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, joinedAt)
+	return d.pebbleDb.Set(d.memberJoinedKey(uid, channelId, channelType), data, pebble.Sync)
+}
+
+// 获取用户加入频道的时间，没有记录返回0
+func (d *db) getMemberJoined(uid string, channelId string, channelType uint8) (uint32, error) {
+	data, err := d.get(d.memberJoinedKey(uid, channelId, channelType))
+	if err != nil || len(data) != 4 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+func (d *db) memberJoinedKey(uid string, channelId string, channelType uint8) []byte {
+	return []byte(fmt.Sprintf("%s%s:%d:%s", d.memberJoinedPrefix, channelId, channelType, uid))
+}
+
+// 获取key的值，不存在返回nil
+func (d *db) get(key []byte) ([]byte, error) {
+	data, closer, err := d.pebbleDb.Get(key)
+	if closer != nil {
+		defer closer.Close()
+	}
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	value := make([]byte, len(data))
+	copy(value, data)
+	return value, nil
+}
@@ -0,0 +1,305 @@
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+type MessageEventType string
+
+const (
+	MessageEventRevoke MessageEventType = "revoke" // 撤回
+	MessageEventEdit   MessageEventType = "edit"   // 编辑
+	MessageEventDelete MessageEventType = "delete" // 删除
+)
+
+// 命令消息的类型
+const cmdPayloadType = 99
+
+// 命令名 -> 消息事件
+var cmdMessageEvents = map[string]MessageEventType{
+	"messageRevoke":  MessageEventRevoke,
+	"messageEdit":    MessageEventEdit,
+	"messageDeleted": MessageEventDelete,
+}
+
+type MessageEvent struct {
+	Type       MessageEventType `json:"type"`        // 事件类型
+	MessageIds []int64          `json:"message_ids"` // 撤回/删除的消息id
+	MessageId  int64            `json:"message_id"`  // 编辑的消息id
+	Payload    json.RawMessage  `json:"payload"`     // 编辑后的消息内容
+}
+
+func (e *MessageEvent) Check() error {
+	switch e.Type {
+	case MessageEventRevoke, MessageEventDelete:
+		if len(e.MessageIds) == 0 && e.MessageId == 0 {
+			return fmt.Errorf("message_ids is empty")
+		}
+	case MessageEventEdit:
+		if e.MessageId == 0 {
+			return fmt.Errorf("message_id is empty")
+		}
+		if len(e.editedPayload()) == 0 {
+			return fmt.Errorf("payload is empty")
+		}
+	default:
+		return fmt.Errorf("unknown event type: %s", e.Type)
+	}
+	return nil
+}
+
+// 编辑后的消息内容，JSON字符串（例如base64编码的内容）取字符串的值，由解码器解码
+func (e *MessageEvent) editedPayload() []byte {
+	payload := bytes.TrimSpace(e.Payload)
+	if gjson.ValidBytes(payload) {
+		if result := gjson.ParseBytes(payload); result.Type == gjson.String {
+			return []byte(result.String())
+		}
+	}
+	return payload
+}
+
+// 从命令消息中解析消息事件，不是相关命令返回nil
+func ParseMessageEvent(m *pluginproto.Message) *MessageEvent {
+	if !gjson.ValidBytes(m.Payload) {
+		return nil
+	}
+	result := gjson.ParseBytes(m.Payload)
+	if result.Get("type").Int() != cmdPayloadType {
+		return nil
+	}
+	eventType, ok := cmdMessageEvents[result.Get("cmd").String()]
+	if !ok {
+		return nil
+	}
+	param := result.Get("param")
+	event := &MessageEvent{
+		Type: eventType,
+	}
+	if id := param.Get("message_id"); id.Exists() {
+		event.MessageId = parseMessageId(id)
+	}
+	for _, id := range param.Get("message_ids").Array() {
+		if messageId := parseMessageId(id); messageId != 0 {
+			event.MessageIds = append(event.MessageIds, messageId)
+		}
+	}
+	if eventType == MessageEventEdit {
+		event.Payload = json.RawMessage(param.Get("payload").Raw)
+	}
+	if event.Check() != nil {
+		return nil
+	}
+	return event
+}
+
+// 消息id可能是数字也可能是字符串
+func parseMessageId(v gjson.Result) int64 {
+	if v.Type == gjson.String {
+		id, _ := strconv.ParseInt(v.String(), 10, 64)
+		return id
+	}
+	return v.Int()
+}
+
+// HandleMessageEvent 处理消息的撤回、编辑、删除事件
+func (s *Search) HandleMessageEvent(event *MessageEvent) error {
+	if err := event.Check(); err != nil {
+		return err
+	}
+	return s.whenRunning(func() error {
+		switch event.Type {
+		case MessageEventRevoke, MessageEventDelete:
+			messageIds := event.MessageIds
+			if event.MessageId != 0 {
+				messageIds = append(messageIds, event.MessageId)
+			}
+			return s.removeIndex(messageIds)
+		case MessageEventEdit:
+			return s.UpdateIndex(event.MessageId, event.editedPayload())
+		}
+		return nil
+	})
+}
+
+// RemoveIndex 移除消息的索引，并标记消息已移除（防止之后再被索引）
+func (s *Search) RemoveIndex(messageIds []int64) error {
+	return s.whenRunning(func() error {
+		return s.removeIndex(messageIds)
+	})
+}
+
+func (s *Search) removeIndex(messageIds []int64) error {
+	ids := make([]string, 0, len(messageIds))
+	for _, messageId := range messageIds {
+		ids = append(ids, strconv.FormatInt(messageId, 10))
+	}
+	// 已索引的消息记录所在的频道类型和时间，超过保留时间后清理记录
+	var messages []*Message
+	if s.msgIndex != nil {
+		var err error
+		if messages, err = s.getMessages(ids); err != nil {
+			s.Warn("get removed messages error", zap.Error(err))
+		}
+	}
+	indexed := make(map[int64]*Message, len(messages))
+	for _, m := range messages {
+		indexed[m.MessageId] = m
+	}
+	for _, messageId := range messageIds {
+		channelType, timestamp := messageEventTime(indexed[messageId])
+		if err := s.db.setMessageRemoved(messageId, channelType, timestamp); err != nil {
+			return err
+		}
+	}
+	if s.msgIndex == nil {
+		return nil
+	}
+	s.addRemovedSeqs(messages)
+	return s.indexBatch(func(batch *messageBatch) {
+		for _, id := range ids {
+			batch.Delete(id)
+		}
+	})
+}
+
+// 从索引中删除已移除的消息，不修改db中的记录
+func (s *Search) removeIndexed(ids []string) error {
+	messages, err := s.getMessages(ids)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	s.addRemovedSeqs(messages)
+	return s.indexBatch(func(batch *messageBatch) {
+		for _, m := range messages {
+			batch.Delete(m.MessageIdStr)
+		}
+	})
+}
+
+// 删除前记录消息序号，检查索引是否缺少消息时跳过
+func (s *Search) addRemovedSeqs(messages []*Message) {
+	for _, m := range messages {
+		seq := seqRange{start: m.MessageSeq, end: m.MessageSeq}
+		if err := s.db.addSkippedSeqs(m.ChannelId, m.ChannelType, []seqRange{seq}); err != nil {
+			s.Warn("add removed seqs error", zap.Error(err))
+		}
+	}
+}
+
+// 撤回和编辑记录使用的频道类型和消息时间，消息未索引时使用当前时间，消息不会晚于撤回和编辑
+func messageEventTime(m *Message) (uint8, uint32) {
+	if m == nil || m.Timestamp == 0 {
+		return unknownChannelType, uint32(time.Now().Unix())
+	}
+	return m.ChannelType, m.Timestamp
+}
+
+// UpdateIndex 用编辑后的内容重新索引消息，不是JSON的内容使用解码器转换，不能解码时移除消息的索引
+func (s *Search) UpdateIndex(messageId int64, payload []byte) error {
+	removed, err := s.db.isMessageRemoved(messageId)
+	if err != nil {
+		return err
+	}
+	if removed {
+		return nil
+	}
+
+	var msg *Message
+	if s.msgIndex != nil {
+		if msg, err = s.getMessage(messageId); err != nil {
+			return err
+		}
+	}
+	// 先保存编辑内容，消息还没索引的话，索引时会使用编辑后的内容
+	channelType, timestamp := messageEventTime(msg)
+	if err = s.db.setMessageEdited(messageId, channelType, timestamp, payload); err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
+	}
+	return s.reindexEdited(msg, payload)
+}
+
+// 用编辑后的内容重新索引已索引的消息
+func (s *Search) reindexEdited(msg *Message, payload []byte) error {
+	decoded, reason := decodePayload(&pluginproto.Message{
+		MessageId: msg.MessageId,
+		Topic:     msg.Topic,
+		Payload:   payload,
+	})
+	if reason != "" {
+		s.metrics.skip(reason)
+		s.Warn("edited payload can not be indexed", zap.String("reason", reason), zap.Int64("messageId", msg.MessageId))
+		seq := seqRange{start: msg.MessageSeq, end: msg.MessageSeq}
+		if err := s.db.addSkippedSeqs(msg.ChannelId, msg.ChannelType, []seqRange{seq}); err != nil {
+			s.Warn("add skipped seqs error", zap.Error(err), zap.Int64("messageId", msg.MessageId))
+		}
+		return s.indexBatch(func(batch *messageBatch) {
+			batch.Delete(msg.MessageIdStr)
+		})
+	}
+	msg.setPayload(string(decoded))
+	return s.indexBatch(func(batch *messageBatch) {
+		if err := batch.Index(msg.MessageIdStr, msg); err != nil {
+			s.Warn("index edited message error", zap.Error(err), zap.Int64("messageId", msg.MessageId))
+		}
+	})
+}
+
+// 从索引中获取消息，不存在的消息不返回
+func (s *Search) getMessages(ids []string) ([]*Message, error) {
+	searchRequest := bleve.NewSearchRequest(bleve.NewDocIDQuery(ids))
+	searchRequest.Fields = []string{"*"}
+	searchRequest.Size = len(ids)
+	searchResult, err := s.msgIndex.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, 0, len(searchResult.Hits))
+	for _, hit := range searchResult.Hits {
+		messages = append(messages, newMessageFromHit(hit))
+	}
+	return messages, nil
+}
+
+// 从索引中获取消息，不存在返回nil
+func (s *Search) getMessage(messageId int64) (*Message, error) {
+	messages, err := s.getMessages([]string{strconv.FormatInt(messageId, 10)})
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// 应用消息的撤回和编辑状态，返回false表示消息不需要索引
+func (s *Search) applyMessageEvents(m *pluginproto.Message) bool {
+	removed, err := s.db.isMessageRemoved(m.MessageId)
+	if err != nil {
+		s.Warn("get message removed error", zap.Error(err), zap.Int64("messageId", m.MessageId))
+	}
+	if removed {
+		return false
+	}
+	payload, err := s.db.getMessageEdited(m.MessageId)
+	if err != nil {
+		s.Warn("get message edited error", zap.Error(err), zap.Int64("messageId", m.MessageId))
+	}
+	if len(payload) > 0 {
+		m.Payload = payload
+	}
+	return true
+}
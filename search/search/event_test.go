@@ -0,0 +1,270 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestParseMessageEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    *MessageEvent
+	}{
+		{
+			name:    "revoke",
+			payload: `{"type":99,"cmd":"messageRevoke","param":{"message_id":"123"}}`,
+			want:    &MessageEvent{Type: MessageEventRevoke, MessageId: 123},
+		},
+		{
+			name:    "delete with number and string ids",
+			payload: `{"type":99,"cmd":"messageDeleted","param":{"message_ids":[1,"2"]}}`,
+			want:    &MessageEvent{Type: MessageEventDelete, MessageIds: []int64{1, 2}},
+		},
+		{
+			name:    "edit",
+			payload: `{"type":99,"cmd":"messageEdit","param":{"message_id":5,"payload":{"type":1,"content":"hi"}}}`,
+			want:    &MessageEvent{Type: MessageEventEdit, MessageId: 5, Payload: json.RawMessage(`{"type":1,"content":"hi"}`)},
+		},
+		{
+			name:    "edit without payload",
+			payload: `{"type":99,"cmd":"messageEdit","param":{"message_id":5}}`,
+		},
+		{
+			name:    "revoke without ids",
+			payload: `{"type":99,"cmd":"messageRevoke","param":{}}`,
+		},
+		{
+			name:    "unknown cmd",
+			payload: `{"type":99,"cmd":"typing","param":{"message_id":1}}`,
+		},
+		{
+			name:    "not a cmd message",
+			payload: `{"type":1,"content":"messageRevoke"}`,
+		},
+		{
+			name:    "not json",
+			payload: `hello`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseMessageEvent(&pluginproto.Message{Payload: []byte(tt.payload)})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMessageEvent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageEventCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   MessageEvent
+		wantErr bool
+	}{
+		{"revoke by id", MessageEvent{Type: MessageEventRevoke, MessageId: 1}, false},
+		{"delete by ids", MessageEvent{Type: MessageEventDelete, MessageIds: []int64{1}}, false},
+		{"delete without ids", MessageEvent{Type: MessageEventDelete}, true},
+		{"edit json", MessageEvent{Type: MessageEventEdit, MessageId: 1, Payload: json.RawMessage(`{"type":1}`)}, false},
+		{"edit json string", MessageEvent{Type: MessageEventEdit, MessageId: 1, Payload: json.RawMessage(`"aGk="`)}, false},
+		{"edit empty payload", MessageEvent{Type: MessageEventEdit, MessageId: 1, Payload: json.RawMessage(`""`)}, true},
+		{"edit without id", MessageEvent{Type: MessageEventEdit, Payload: json.RawMessage(`{"type":1}`)}, true},
+		{"unknown type", MessageEvent{Type: "pin", MessageId: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.event.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEditedPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"type":1,"content":"hi"}`, `{"type":1,"content":"hi"}`},
+		{` "aGk=" `, `aGk=`},
+		{`plain text`, `plain text`},
+		{``, ``},
+	}
+	for _, tt := range tests {
+		e := &MessageEvent{Payload: json.RawMessage(tt.payload)}
+		if got := string(e.editedPayload()); got != tt.want {
+			t.Errorf("editedPayload(%q) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
+
+// 撤回和编辑记录的频道类型和消息时间，ok为false表示没有记录
+func messageEventRecord(t *testing.T, s *Search, prefix string, messageId int64) (channelType uint8, timestamp uint32, ok bool) {
+	t.Helper()
+	value, err := s.db.get([]byte(fmt.Sprintf("%s%d", prefix, messageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value == nil {
+		return 0, 0, false
+	}
+	channelType, timestamp, _, ok = decodeMessageEvent(value)
+	if !ok {
+		t.Fatalf("record %s%d has no header", prefix, messageId)
+	}
+	return channelType, timestamp, true
+}
+
+func TestHandleMessageEvent(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "release notes")
+	m2 := newTestMessage("c1", 2, 2, "u1", "release day")
+	indexTestMessages(t, s, 0, m1, m2)
+
+	if err := s.HandleMessageEvent(&MessageEvent{Type: MessageEventRevoke, MessageIds: []int64{m1.MessageId}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HandleMessageEvent(&MessageEvent{Type: MessageEventEdit, MessageId: m2.MessageId, Payload: json.RawMessage(`{"type":1,"content":"launch day"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchTestContent(t, s, "release"); len(got) != 0 {
+		t.Errorf("search release = %v, want none", got)
+	}
+	if got := searchTestContent(t, s, "launch"); !reflect.DeepEqual(got, []int64{m2.MessageId}) {
+		t.Errorf("search launch = %v, want [%d]", got, m2.MessageId)
+	}
+
+	// 记录中保存消息所在的频道类型和时间
+	if channelType, timestamp, ok := messageEventRecord(t, s, s.db.removedMsgPrefix, m1.MessageId); !ok || channelType != 2 || timestamp != m1.Timestamp {
+		t.Errorf("removed record = %d %d %v, want 2 %d", channelType, timestamp, ok, m1.Timestamp)
+	}
+	if channelType, timestamp, ok := messageEventRecord(t, s, s.db.editedMsgPrefix, m2.MessageId); !ok || channelType != 2 || timestamp != m2.Timestamp {
+		t.Errorf("edited record = %d %d %v, want 2 %d", channelType, timestamp, ok, m2.Timestamp)
+	}
+	// 还没索引的消息不知道频道类型，使用当前时间
+	before := uint32(time.Now().Unix())
+	if err := s.HandleMessageEvent(&MessageEvent{Type: MessageEventDelete, MessageId: 999}); err != nil {
+		t.Fatal(err)
+	}
+	if channelType, timestamp, ok := messageEventRecord(t, s, s.db.removedMsgPrefix, 999); !ok || channelType != unknownChannelType || timestamp < before {
+		t.Errorf("removed record of unindexed message = %d %d %v, want %d >= %d", channelType, timestamp, ok, unknownChannelType, before)
+	}
+
+	// 撤回后再拉取到的消息不再索引，编辑的消息使用编辑后的内容
+	m1.Payload = []byte(`{"type":1,"content":"release notes"}`)
+	indexTestMessages(t, s, 2, newTestMessage("c1", 2, 3, "u1", "other"))
+	if s.applyMessageEvents(m1) {
+		t.Errorf("applyMessageEvents() = true for a revoked message")
+	}
+	if !s.applyMessageEvents(m2) || string(m2.Payload) != `{"type":1,"content":"launch day"}` {
+		t.Errorf("applyMessageEvents() payload = %s, want the edited payload", m2.Payload)
+	}
+}
+
+func TestPruneMessageEvents(t *testing.T) {
+	s := newTestSearch(t)
+	SetRetentionOptions(RetentionOptions{Days: 30, ChannelTypeDays: map[uint8]int{1: 0}})
+	defer SetRetentionOptions(RetentionOptions{})
+
+	old := uint32(time.Now().AddDate(0, 0, -60).Unix())
+	recent := uint32(time.Now().AddDate(0, 0, -1).Unix())
+	records := []struct {
+		messageId   int64
+		channelType uint8
+		timestamp   uint32
+		edited      bool
+		wantKept    bool
+	}{
+		{1, 2, old, false, false},
+		{2, 2, recent, false, true},
+		{3, 2, old, true, false},
+		{4, 1, old, true, true}, // 频道类型1永久保留
+		{5, unknownChannelType, old, false, true},
+	}
+	for _, r := range records {
+		var err error
+		if r.edited {
+			err = s.db.setMessageEdited(r.messageId, r.channelType, r.timestamp, []byte(`{"type":1,"content":"x"}`))
+		} else {
+			err = s.db.setMessageRemoved(r.messageId, r.channelType, r.timestamp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 旧版本没有头部的记录
+	if err := s.db.pebbleDb.Set(s.db.removedMsgKey(6), []byte{1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.pebbleDb.Set(s.db.editedMsgKey(7), []byte(`{"type":1,"content":"legacy"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.CleanupRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Events != 2 {
+		t.Errorf("CleanupRetention() events = %d, want 2", result.Events)
+	}
+	for _, r := range records {
+		prefix := s.db.removedMsgPrefix
+		if r.edited {
+			prefix = s.db.editedMsgPrefix
+		}
+		if _, _, ok := messageEventRecord(t, s, prefix, r.messageId); ok != r.wantKept {
+			t.Errorf("record of message %d kept = %v, want %v", r.messageId, ok, r.wantKept)
+		}
+	}
+	// 旧版本的记录补写头部后保留
+	if channelType, _, ok := messageEventRecord(t, s, s.db.removedMsgPrefix, 6); !ok || channelType != unknownChannelType {
+		t.Errorf("legacy removed record = %d %v, want stamped", channelType, ok)
+	}
+	if payload, _ := s.db.getMessageEdited(7); string(payload) != `{"type":1,"content":"legacy"}` {
+		t.Errorf("legacy edited payload = %s", payload)
+	}
+}
+
+func TestReapplyMessageEvents(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "release notes")
+	m2 := newTestMessage("c1", 2, 2, "u1", "release day")
+	indexTestMessages(t, s, 0, m1, m2)
+	if err := s.RemoveIndex([]int64{m1.MessageId}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateIndex(m2.MessageId, []byte(`{"type":1,"content":"launch day"}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, removedAt, _ := messageEventRecord(t, s, s.db.removedMsgPrefix, m1.MessageId)
+
+	// 恢复的快照中还是撤回和编辑之前的消息
+	err := s.indexBatch(func(batch *messageBatch) {
+		for _, m := range []*pluginproto.Message{m1, m2} {
+			if err := batch.Index(strconv.FormatInt(m.MessageId, 10), newMessageFrom(m)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reapplyMessageEvents()
+	if got := searchTestContent(t, s, "release"); len(got) != 0 {
+		t.Errorf("search release = %v, want none", got)
+	}
+	if got := searchTestContent(t, s, "launch"); !reflect.DeepEqual(got, []int64{m2.MessageId}) {
+		t.Errorf("search launch = %v, want [%d]", got, m2.MessageId)
+	}
+	// 重新应用不修改记录中的时间
+	if _, timestamp, _ := messageEventRecord(t, s, s.db.removedMsgPrefix, m1.MessageId); timestamp != removedAt {
+		t.Errorf("removed record timestamp = %d, want %d", timestamp, removedAt)
+	}
+}
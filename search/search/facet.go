@@ -0,0 +1,376 @@
+package search
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/numeric"
+	blevesearch "github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// 支持统计的字段
+const (
+	FacetChannelId   = "channel_id"   // 频道
+	FacetFromUid     = "from_uid"     // 发送者
+	FacetPayloadType = "payload.type" // 消息类型
+	FacetTimestamp   = "timestamp"    // 时间直方图
+)
+
+// 时间直方图的间隔
+const (
+	FacetIntervalDay   = "day"
+	FacetIntervalWeek  = "week"
+	FacetIntervalMonth = "month"
+)
+
+const (
+	defaultFacetSize  = 10
+	maxFacetSize      = 1000
+	maxFacetDateRange = 400 // 时间直方图最多的区间数量
+	// 数值字段索引时会按照不同精度生成多个词，统计时需要取出所有词再过滤
+	numericFacetScanSize = 10000
+)
+
+type FacetReq struct {
+	Field     string `json:"field"`      // 统计字段 channel_id, from_uid, payload.type, timestamp
+	Size      int    `json:"size"`       // 返回的数量，默认10（timestamp返回所有区间）
+	Interval  string `json:"interval"`   // timestamp的统计间隔 day(默认) week month
+	UtcOffset int    `json:"utc_offset"` // timestamp按照此时区（与UTC相差的分钟数）划分日期，默认0
+}
+
+type FacetResult struct {
+	Field   string       `json:"field"`   // 统计字段
+	Total   int          `json:"total"`   // 有此字段的消息数量
+	Missing int          `json:"missing"` // 没有此字段的消息数量
+	Other   int          `json:"other"`   // 不在terms中的消息数量
+	Terms   []*FacetTerm `json:"terms"`   // 统计结果，timestamp按照时间升序（只返回有消息的区间），其他按照数量降序
+}
+
+type FacetTerm struct {
+	Term  string `json:"term"`            // 字段值，timestamp为区间开始的日期
+	Count int    `json:"count"`           // 消息数量
+	Start int64  `json:"start,omitempty"` // timestamp区间的开始时间（包含）
+	End   int64  `json:"end,omitempty"`   // timestamp区间的结束时间（不包含）
+}
+
+func (f FacetReq) check() error {
+	switch f.Field {
+	case FacetChannelId, FacetFromUid, FacetPayloadType:
+	case FacetTimestamp:
+		switch f.Interval {
+		case "", FacetIntervalDay, FacetIntervalWeek, FacetIntervalMonth:
+		default:
+			return newBadRequest("unknown facet interval: %s", f.Interval)
+		}
+		if f.UtcOffset < -14*60 || f.UtcOffset > 14*60 {
+			return newBadRequest("invalid facet utc_offset: %d", f.UtcOffset)
+		}
+	default:
+		return newBadRequest("unsupported facet field: %s", f.Field)
+	}
+	if f.Size < 0 || f.Size > maxFacetSize {
+		return newBadRequest("facet size must be between 0 and %d", maxFacetSize)
+	}
+	return nil
+}
+
+func (f FacetReq) size() int {
+	if f.Size <= 0 {
+		return defaultFacetSize
+	}
+	return f.Size
+}
+
+func checkFacets(facets []FacetReq) error {
+	exists := make(map[string]struct{}, len(facets))
+	for _, f := range facets {
+		if err := f.check(); err != nil {
+			return err
+		}
+		if _, ok := exists[f.Field]; ok {
+			return newBadRequest("duplicate facet field: %s", f.Field)
+		}
+		exists[f.Field] = struct{}{}
+	}
+	return nil
+}
+
+// 添加统计请求
+func (s *Search) addFacets(searchRequest *bleve.SearchRequest, req SearchReq, q query.Query) error {
+	for _, f := range req.Facets {
+		switch f.Field {
+		case FacetPayloadType:
+			searchRequest.AddFacet(f.Field, bleve.NewFacetRequest(f.Field, numericFacetScanSize))
+		case FacetTimestamp:
+			ranges, err := s.facetDateRanges(req, q, f)
+			if err != nil {
+				return err
+			}
+			if len(ranges) == 0 {
+				continue
+			}
+			facetRequest := bleve.NewFacetRequest(f.Field, len(ranges)+1)
+			for _, r := range ranges {
+				start, end := float64(r.Start), float64(r.End)
+				facetRequest.AddNumericRange(r.Term, &start, &end)
+			}
+			searchRequest.AddFacet(f.Field, facetRequest)
+		default:
+			searchRequest.AddFacet(f.Field, bleve.NewFacetRequest(f.Field, f.size()))
+		}
+	}
+	return nil
+}
+
+// 时间直方图的区间，没有指定时间范围时使用命中消息的最早和最晚时间
+func (s *Search) facetDateRanges(req SearchReq, q query.Query, f FacetReq) ([]*FacetTerm, error) {
+	var start, end int64
+	if req.StartTime > 0 {
+		start = int64(req.StartTime)
+	}
+	if req.EndTime > 0 {
+		end = int64(req.EndTime) + 1
+	}
+	if start == 0 || end == 0 {
+		min, max, found, err := s.timestampBounds(q)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, nil
+		}
+		if start == 0 {
+			start = min
+		}
+		if end == 0 {
+			end = max + 1
+		}
+	}
+	if end <= start {
+		return nil, nil
+	}
+
+	loc := time.FixedZone("", f.UtcOffset*60)
+	t := truncateFacetTime(time.Unix(start, 0).In(loc), f.Interval)
+	ranges := make([]*FacetTerm, 0)
+	for t.Unix() < end {
+		next := nextFacetTime(t, f.Interval)
+		ranges = append(ranges, &FacetTerm{
+			Term:  t.Format("2006-01-02"),
+			Start: t.Unix(),
+			End:   next.Unix(),
+		})
+		if len(ranges) > maxFacetDateRange {
+			return nil, newBadRequest("too many timestamp facet ranges, narrow the time range or use a larger interval")
+		}
+		t = next
+	}
+	return ranges, nil
+}
+
+// 命中消息的最早和最晚时间
+func (s *Search) timestampBounds(q query.Query) (int64, int64, bool, error) {
+	bound := func(sortBy string) (int64, bool, error) {
+		searchRequest := bleve.NewSearchRequest(q)
+		searchRequest.Size = 1
+		searchRequest.Fields = []string{"timestamp"}
+		searchRequest.SortBy([]string{sortBy})
+		searchResult, err := s.msgIndex.Search(searchRequest)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(searchResult.Hits) == 0 {
+			return 0, false, nil
+		}
+		timestamp, ok := searchResult.Hits[0].Fields["timestamp"].(float64)
+		return int64(timestamp), ok, nil
+	}
+	min, found, err := bound("timestamp")
+	if err != nil || !found {
+		return 0, 0, false, err
+	}
+	max, found, err := bound("-timestamp")
+	if err != nil || !found {
+		return 0, 0, false, err
+	}
+	return min, max, true, nil
+}
+
+func truncateFacetTime(t time.Time, interval string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch interval {
+	case FacetIntervalWeek:
+		// 以周一作为一周的开始
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case FacetIntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return day
+}
+
+func nextFacetTime(t time.Time, interval string) time.Time {
+	switch interval {
+	case FacetIntervalWeek:
+		return t.AddDate(0, 0, 7)
+	case FacetIntervalMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// 将bleve的统计结果转换为返回的结果
+func buildFacetResults(facets []FacetReq, results blevesearch.FacetResults) map[string]*FacetResult {
+	if len(facets) == 0 {
+		return nil
+	}
+	resultMap := make(map[string]*FacetResult, len(facets))
+	for _, f := range facets {
+		result := &FacetResult{
+			Field: f.Field,
+			Terms: make([]*FacetTerm, 0),
+		}
+		resultMap[f.Field] = result
+		facetResult := results[f.Field]
+		if facetResult == nil {
+			continue
+		}
+		result.Missing = facetResult.Missing
+
+		switch f.Field {
+		case FacetTimestamp:
+			for _, r := range facetResult.NumericRanges {
+				term := &FacetTerm{
+					Term:  r.Name,
+					Count: r.Count,
+				}
+				if r.Min != nil {
+					term.Start = int64(*r.Min)
+				}
+				if r.Max != nil {
+					term.End = int64(*r.Max)
+				}
+				result.Total += r.Count
+				result.Terms = append(result.Terms, term)
+			}
+			sortFacetTerms(f, result.Terms)
+		case FacetPayloadType:
+			for _, t := range facetResult.Terms.Terms() {
+				// 只保留原始精度的词
+				prefixCoded := numeric.PrefixCoded(t.Term)
+				shift, err := prefixCoded.Shift()
+				if err != nil || shift != 0 {
+					continue
+				}
+				value, err := prefixCoded.Int64()
+				if err != nil {
+					continue
+				}
+				result.Total += t.Count
+				result.Terms = append(result.Terms, &FacetTerm{
+					Term:  strconv.FormatFloat(numeric.Int64ToFloat64(value), 'f', -1, 64),
+					Count: t.Count,
+				})
+			}
+			sortFacetTerms(f, result.Terms)
+			result.Terms, result.Other = trimFacetTerms(result.Terms, f.size(), result.Total)
+		default:
+			result.Total = facetResult.Total
+			for _, t := range facetResult.Terms.Terms() {
+				result.Terms = append(result.Terms, &FacetTerm{
+					Term:  t.Term,
+					Count: t.Count,
+				})
+			}
+			result.Other = facetResult.Other
+		}
+	}
+	return resultMap
+}
+
+// MergeFacetResults 合并各节点的统计结果，相同的值数量相加
+func MergeFacetResults(facets []FacetReq, results []map[string]*FacetResult) map[string]*FacetResult {
+	if len(facets) == 0 {
+		return nil
+	}
+	resultMap := make(map[string]*FacetResult, len(facets))
+	for _, f := range facets {
+		merged := &FacetResult{
+			Field: f.Field,
+			Terms: make([]*FacetTerm, 0),
+		}
+		termMap := make(map[string]*FacetTerm)
+		for _, result := range results {
+			facetResult := result[f.Field]
+			if facetResult == nil {
+				continue
+			}
+			merged.Total += facetResult.Total
+			merged.Missing += facetResult.Missing
+			for _, t := range facetResult.Terms {
+				exist := termMap[t.Term]
+				if exist == nil {
+					exist = &FacetTerm{
+						Term:  t.Term,
+						Start: t.Start,
+						End:   t.End,
+					}
+					termMap[t.Term] = exist
+					merged.Terms = append(merged.Terms, exist)
+				}
+				exist.Count += t.Count
+			}
+		}
+		sortFacetTerms(f, merged.Terms)
+		if f.Field != FacetTimestamp {
+			merged.Terms, merged.Other = trimFacetTerms(merged.Terms, f.size(), merged.Total)
+		}
+		resultMap[f.Field] = merged
+	}
+	return resultMap
+}
+
+func sortFacetTerms(f FacetReq, terms []*FacetTerm) {
+	sort.SliceStable(terms, func(i, j int) bool {
+		if f.Field == FacetTimestamp {
+			return terms[i].Start < terms[j].Start
+		}
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Term < terms[j].Term
+	})
+}
+
+// 截取前size个，返回截取后的结果和其余的数量
+func trimFacetTerms(terms []*FacetTerm, size int, total int) ([]*FacetTerm, int) {
+	if len(terms) > size {
+		terms = terms[:size]
+	}
+	other := total
+	for _, t := range terms {
+		other -= t.Count
+	}
+	return terms, other
+}
+
+// 发送给各节点的统计请求，多返回一些值使合并后的前size个更准确
+func nodeFacets(facets []FacetReq) []FacetReq {
+	if len(facets) == 0 {
+		return facets
+	}
+	nodeFacets := make([]FacetReq, len(facets))
+	for i, f := range facets {
+		if f.Field != FacetTimestamp {
+			size := f.size()*2 + 10
+			if size > maxFacetSize {
+				size = maxFacetSize
+			}
+			f.Size = size
+		}
+		nodeFacets[i] = f
+	}
+	return nodeFacets
+}
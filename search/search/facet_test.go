@@ -0,0 +1,152 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFacetReqCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		facets  []FacetReq
+		wantErr bool
+	}{
+		{"fields", []FacetReq{{Field: FacetChannelId}, {Field: FacetFromUid, Size: maxFacetSize}, {Field: FacetPayloadType}, {Field: FacetTimestamp, Interval: FacetIntervalWeek, UtcOffset: 480}}, false},
+		{"unsupported field", []FacetReq{{Field: "content"}}, true},
+		{"duplicate field", []FacetReq{{Field: FacetFromUid}, {Field: FacetFromUid}}, true},
+		{"size too large", []FacetReq{{Field: FacetFromUid, Size: maxFacetSize + 1}}, true},
+		{"negative size", []FacetReq{{Field: FacetFromUid, Size: -1}}, true},
+		{"unknown interval", []FacetReq{{Field: FacetTimestamp, Interval: "hour"}}, true},
+		{"utc offset out of range", []FacetReq{{Field: FacetTimestamp, UtcOffset: 15 * 60}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkFacets(tt.facets); (err != nil) != tt.wantErr {
+				t.Errorf("checkFacets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 统计结果中的值和数量
+func facetCounts(result *FacetResult) map[string]int {
+	counts := make(map[string]int, len(result.Terms))
+	for _, term := range result.Terms {
+		counts[term.Term] = term.Count
+	}
+	return counts
+}
+
+func TestSearchFacets(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "release")
+	m1.Timestamp = 1704103200 // 2024-01-01 10:00 UTC
+	m2 := newTestMessage("c1", 2, 2, "u2", "release")
+	m2.Timestamp = 1704151800 // 2024-01-01 23:30 UTC
+	m3 := newTestMessage("c1", 2, 3, "u1", "other")
+	m3.Timestamp = 1704151900
+	m4 := newTestMessage("c2", 1, 1, "u1", "release")
+	m4.Timestamp = 1704243600 // 2024-01-03 01:00 UTC
+	m4.Payload = []byte(`{"type":2,"content":"release"}`)
+	indexTestMessages(t, s, 0, m1, m2, m3)
+	indexTestMessages(t, s, 0, m4)
+
+	resp, err := s.Search(SearchReq{
+		Payload: map[string]string{"content": "release"},
+		Limit:   1,
+		Facets: []FacetReq{
+			{Field: FacetChannelId},
+			{Field: FacetFromUid, Size: 1},
+			{Field: FacetPayloadType},
+			{Field: FacetTimestamp},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 统计所有命中的消息，不受分页影响
+	tests := []struct {
+		field     string
+		want      map[string]int
+		wantTotal int
+		wantOther int
+	}{
+		{FacetChannelId, map[string]int{"c1": 2, "c2": 1}, 3, 0},
+		{FacetFromUid, map[string]int{"u1": 2}, 3, 1},
+		{FacetPayloadType, map[string]int{"1": 2, "2": 1}, 3, 0},
+		{FacetTimestamp, map[string]int{"2024-01-01": 2, "2024-01-03": 1}, 3, 0},
+	}
+	for _, tt := range tests {
+		result := resp.Facets[tt.field]
+		if result == nil {
+			t.Errorf("facet %s is missing", tt.field)
+			continue
+		}
+		if got := facetCounts(result); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("facet %s = %v, want %v", tt.field, got, tt.want)
+		}
+		if result.Total != tt.wantTotal || result.Other != tt.wantOther {
+			t.Errorf("facet %s total = %d other = %d, want %d %d", tt.field, result.Total, result.Other, tt.wantTotal, tt.wantOther)
+		}
+	}
+	if terms := resp.Facets[FacetTimestamp].Terms; len(terms) > 0 && (terms[0].Start != 1704067200 || terms[0].End != 1704153600) {
+		t.Errorf("first timestamp range = [%d, %d), want [1704067200, 1704153600)", terms[0].Start, terms[0].End)
+	}
+
+	// 按照时区划分日期
+	resp, err = s.Search(SearchReq{
+		Payload: map[string]string{"content": "release"},
+		Facets:  []FacetReq{{Field: FacetTimestamp, UtcOffset: 60}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := facetCounts(resp.Facets[FacetTimestamp]), map[string]int{"2024-01-01": 1, "2024-01-02": 1, "2024-01-03": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("timestamp facet with utc offset = %v, want %v", got, want)
+	}
+
+	// 按月统计，指定时间范围时使用请求的范围
+	resp, err = s.Search(SearchReq{
+		Payload:   map[string]string{"content": "release"},
+		StartTime: 1704103200,
+		EndTime:   1704200000,
+		Facets:    []FacetReq{{Field: FacetTimestamp, Interval: FacetIntervalMonth}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := facetCounts(resp.Facets[FacetTimestamp]), map[string]int{"2024-01-01": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("monthly timestamp facet = %v, want %v", got, want)
+	}
+}
+
+func TestMergeFacetResults(t *testing.T) {
+	facets := []FacetReq{{Field: FacetFromUid, Size: 2}, {Field: FacetTimestamp}}
+	results := []map[string]*FacetResult{
+		{
+			FacetFromUid: {Field: FacetFromUid, Total: 6, Terms: []*FacetTerm{{Term: "u1", Count: 3}, {Term: "u2", Count: 2}, {Term: "u3", Count: 1}}},
+			FacetTimestamp: {Field: FacetTimestamp, Total: 6, Terms: []*FacetTerm{
+				{Term: "2024-01-02", Count: 4, Start: 1704153600, End: 1704240000},
+				{Term: "2024-01-01", Count: 2, Start: 1704067200, End: 1704153600},
+			}},
+		},
+		{
+			FacetFromUid:   {Field: FacetFromUid, Total: 4, Missing: 1, Terms: []*FacetTerm{{Term: "u3", Count: 4}}},
+			FacetTimestamp: {Field: FacetTimestamp, Total: 4, Terms: []*FacetTerm{{Term: "2024-01-01", Count: 4, Start: 1704067200, End: 1704153600}}},
+		},
+		nil, // 失败的节点
+	}
+	merged := MergeFacetResults(facets, results)
+
+	from := merged[FacetFromUid]
+	if got, want := facetCounts(from), map[string]int{"u3": 5, "u1": 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged from_uid = %v, want %v", got, want)
+	}
+	if from.Terms[0].Term != "u3" || from.Total != 10 || from.Missing != 1 || from.Other != 2 {
+		t.Errorf("merged from_uid = %+v", from)
+	}
+	timestamp := merged[FacetTimestamp]
+	if len(timestamp.Terms) != 2 || timestamp.Terms[0].Term != "2024-01-01" || timestamp.Terms[0].Count != 6 {
+		t.Errorf("merged timestamp terms = %v, want sorted by time", facetCounts(timestamp))
+	}
+}
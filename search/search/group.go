@@ -0,0 +1,134 @@
+package search
+
+import (
+	"sort"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// 分组模式最多统计的频道数量，超过时返回group_truncated
+const maxGroupChannels = 10000
+
+// 按照频道分组的搜索结果
+type SearchGroup struct {
+	ChannelId   string   `json:"channel_id"`   // 频道ID
+	ChannelType uint8    `json:"channel_type"` // 频道类型
+	Count       int      `json:"count"`        // 频道内命中的消息数量
+	Message     *Message `json:"message"`      // 频道内排在第一的消息（sort=time时为最新的消息）
+}
+
+// 按照频道分组搜索，分组按照命中数量降序，page和limit对分组分页
+func (s *Search) searchGroups(req SearchReq, q query.Query) (*SearchResp, error) {
+	countRequest := bleve.NewSearchRequest(q)
+	countRequest.Size = 0
+	countRequest.AddFacet("_group", bleve.NewFacetRequest("channel_key", maxGroupChannels))
+	if err := s.addFacets(countRequest, req, q); err != nil {
+		return nil, err
+	}
+	countResult, err := s.msgIndex.Search(countRequest)
+	if err != nil {
+		return nil, err
+	}
+	cost := countResult.Cost
+
+	groups := make([]*SearchGroup, 0)
+	truncated := false
+	if facetResult := countResult.Facets["_group"]; facetResult != nil {
+		for _, t := range facetResult.Terms.Terms() {
+			channelId, channelType, ok := parseChannelKey(t.Term)
+			if !ok {
+				continue
+			}
+			groups = append(groups, &SearchGroup{
+				ChannelId:   channelId,
+				ChannelType: channelType,
+				Count:       t.Count,
+			})
+		}
+		truncated = facetResult.Other > 0
+	}
+	if len(groups) == 0 && countResult.Total > 0 {
+		// 迁移完成之前的索引没有channel_key，按照频道ID分组
+		legacyRequest := bleve.NewSearchRequest(q)
+		legacyRequest.Size = 0
+		legacyRequest.AddFacet("_group", bleve.NewFacetRequest("channel_id", maxGroupChannels))
+		legacyResult, err := s.msgIndex.Search(legacyRequest)
+		if err != nil {
+			return nil, err
+		}
+		cost += legacyResult.Cost
+		if facetResult := legacyResult.Facets["_group"]; facetResult != nil {
+			for _, t := range facetResult.Terms.Terms() {
+				groups = append(groups, &SearchGroup{
+					ChannelId: t.Term,
+					Count:     t.Count,
+				})
+			}
+			truncated = facetResult.Other > 0
+		}
+	}
+	SortGroups(groups)
+	groupTotal := len(groups)
+
+	groups = pageSlice(groups, req.Page, req.Limit)
+
+	// 每个分组的第一条消息
+	for _, group := range groups {
+		channelQuery := newChannelsQuery([]*pluginproto.Channel{{
+			ChannelId:   group.ChannelId,
+			ChannelType: uint32(group.ChannelType),
+		}}, nil)
+		searchRequest := bleve.NewSearchRequest(bleve.NewConjunctionQuery(q, channelQuery))
+		searchRequest.Fields = []string{"*"}
+		searchRequest.Size = 1
+		searchRequest.SortBy(searchSortBy(req.Sort))
+		if len(req.Highlights) > 0 {
+			searchRequest.Highlight = bleve.NewHighlight()
+			for _, field := range req.Highlights {
+				searchRequest.Highlight.AddField(field)
+			}
+		}
+		searchResult, err := s.msgIndex.Search(searchRequest)
+		if err != nil {
+			return nil, err
+		}
+		cost += searchResult.Cost
+		if len(searchResult.Hits) == 0 {
+			continue
+		}
+		hit := searchResult.Hits[0]
+		msg := newMessageFromHit(hit)
+		score := hit.Score
+		msg.Score = &score
+		group.Message = msg
+		group.ChannelType = msg.ChannelType
+	}
+
+	return &SearchResp{
+		Cost:       cost,
+		Total:      countResult.Total,
+		Limit:      req.Limit,
+		Page:       req.Page,
+		Messages:   []*Message{},
+		Groups:     groups,
+		GroupTotal: groupTotal,
+		Facets:     buildFacetResults(req.Facets, countResult.Facets),
+
+		GroupTruncated: truncated,
+	}, nil
+}
+
+// SortGroups 分组按照命中数量降序，数量相同时按照频道排序
+func SortGroups(groups []*SearchGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		if groups[i].ChannelId != groups[j].ChannelId {
+			return groups[i].ChannelId < groups[j].ChannelId
+		}
+		return groups[i].ChannelType < groups[j].ChannelType
+	})
+}
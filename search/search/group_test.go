@@ -0,0 +1,67 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchGroups(t *testing.T) {
+	s := newTestSearch(t)
+	// 同一个频道ID的两种频道类型是不同的分组
+	indexTestMessages(t, s, 0,
+		newTestMessage("c1", 2, 1, "u1", "release notes"),
+		newTestMessage("c1", 2, 2, "u2", "release day"),
+		newTestMessage("c1", 2, 3, "u1", "lunch"),
+	)
+	indexTestMessages(t, s, 0, newTestMessage("c1", 1, 1, "u1", "release"))
+	indexTestMessages(t, s, 0,
+		newTestMessage("c2", 2, 1, "u3", "release"),
+		newTestMessage("c2", 2, 2, "u3", "release"),
+		newTestMessage("c2", 2, 3, "u3", "release"),
+	)
+
+	tests := []struct {
+		name        string
+		page, limit int
+		want        []string
+	}{
+		{"all groups", 1, 10, []string{"c2:2:3", "c1:2:2", "c1:1:1"}},
+		{"second page", 2, 2, []string{"c1:1:1"}},
+		{"past the end", 5, 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Search(SearchReq{Payload: map[string]string{"content": "release"}, Group: true, Page: tt.page, Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GroupTotal != 3 || resp.GroupTruncated {
+				t.Errorf("GroupTotal = %d GroupTruncated = %v, want 3 false", resp.GroupTotal, resp.GroupTruncated)
+			}
+			got := make([]string, 0, len(resp.Groups))
+			for _, g := range resp.Groups {
+				if g.Message == nil || g.Message.ChannelId != g.ChannelId || g.Message.ChannelType != g.ChannelType {
+					t.Errorf("group %s:%d has message %+v", g.ChannelId, g.ChannelType, g.Message)
+				}
+				got = append(got, channelKey(g.ChannelId, g.ChannelType)+":"+string(rune('0'+g.Count)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Groups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchRejectsNegativePaging(t *testing.T) {
+	s := newTestSearch(t)
+	indexTestMessages(t, s, 0, newTestMessage("c1", 2, 1, "u1", "release"))
+	for _, req := range []SearchReq{
+		{Group: true, Limit: -1},
+		{Group: true, Limit: 10, Page: -1},
+		{Limit: -1},
+	} {
+		if _, err := s.Search(req); !IsBadRequest(err) {
+			t.Errorf("Search(page=%d limit=%d group=%v) error = %v, want bad request", req.Page, req.Limit, req.Group, err)
+		}
+	}
+}
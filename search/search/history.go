@@ -0,0 +1,95 @@
+package search
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// 每个用户最多保存的搜索历史数量
+const maxSearchHistory = 50
+
+type SearchHistory struct {
+	Q    string `json:"q"`    // 搜索内容
+	Time int64  `json:"time"` // 最后一次搜索的时间
+}
+
+// AddSearchHistory 记录用户的搜索，相同的内容只保留最近一次
+func (s *Search) AddSearchHistory(uid string, q string) error {
+	q = strings.TrimSpace(q)
+	if uid == "" || q == "" {
+		return nil
+	}
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+
+	histories, err := s.SearchHistories(uid)
+	if err != nil {
+		return err
+	}
+	newHistories := make([]*SearchHistory, 0, len(histories)+1)
+	newHistories = append(newHistories, &SearchHistory{
+		Q:    q,
+		Time: time.Now().Unix(),
+	})
+	for _, h := range histories {
+		if h.Q == q {
+			continue
+		}
+		newHistories = append(newHistories, h)
+	}
+	if len(newHistories) > maxSearchHistory {
+		newHistories = newHistories[:maxSearchHistory]
+	}
+	return s.saveSearchHistories(uid, newHistories)
+}
+
+// DeleteSearchHistory 删除用户的一条搜索历史
+func (s *Search) DeleteSearchHistory(uid string, q string) error {
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+
+	histories, err := s.SearchHistories(uid)
+	if err != nil {
+		return err
+	}
+	newHistories := make([]*SearchHistory, 0, len(histories))
+	for _, h := range histories {
+		if h.Q == q {
+			continue
+		}
+		newHistories = append(newHistories, h)
+	}
+	return s.saveSearchHistories(uid, newHistories)
+}
+
+// ClearSearchHistory 清空用户的搜索历史
+func (s *Search) ClearSearchHistory(uid string) error {
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+	return s.saveSearchHistories(uid, []*SearchHistory{})
+}
+
+func (s *Search) saveSearchHistories(uid string, histories []*SearchHistory) error {
+	data, err := json.Marshal(histories)
+	if err != nil {
+		return err
+	}
+	return s.db.setSearchHistory(uid, data)
+}
+
+// SearchHistories 获取用户的搜索历史，最近的在前
+func (s *Search) SearchHistories(uid string) ([]*SearchHistory, error) {
+	data, err := s.db.getSearchHistory(uid)
+	if err != nil {
+		return nil, err
+	}
+	histories := make([]*SearchHistory, 0)
+	if len(data) == 0 {
+		return histories, nil
+	}
+	if err = json.Unmarshal(data, &histories); err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// 搜索历史的内容，最近的在前
+func historyQs(t *testing.T, s *Search, uid string) []string {
+	t.Helper()
+	histories, err := s.SearchHistories(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := make([]string, 0, len(histories))
+	for _, h := range histories {
+		qs = append(qs, h.Q)
+	}
+	return qs
+}
+
+func TestSearchHistory(t *testing.T) {
+	s := newTestSearch(t)
+	for _, q := range []string{"a", " b ", "", "a", "c"} {
+		if err := s.AddSearchHistory("u1", q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddSearchHistory("", "d"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复的搜索移到最前，空内容不记录
+	if got, want := historyQs(t, s, "u1"), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SearchHistories() = %v, want %v", got, want)
+	}
+	if got := historyQs(t, s, "u2"); len(got) != 0 {
+		t.Errorf("SearchHistories() of another user = %v", got)
+	}
+
+	if err := s.DeleteSearchHistory("u1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := historyQs(t, s, "u1"), []string{"c", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SearchHistories() after delete = %v, want %v", got, want)
+	}
+	if err := s.ClearSearchHistory("u1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := historyQs(t, s, "u1"); len(got) != 0 {
+		t.Errorf("SearchHistories() after clear = %v", got)
+	}
+}
+
+func TestSearchHistoryLimit(t *testing.T) {
+	s := newTestSearch(t)
+	for i := 0; i <= maxSearchHistory; i++ {
+		if err := s.AddSearchHistory("u1", fmt.Sprintf("q%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := historyQs(t, s, "u1")
+	if len(got) != maxSearchHistory || got[0] != fmt.Sprintf("q%d", maxSearchHistory) || got[len(got)-1] != "q1" {
+		t.Errorf("SearchHistories() = %d items from %s to %s, want the latest %d", len(got), got[0], got[len(got)-1], maxSearchHistory)
+	}
+}
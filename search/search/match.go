@@ -0,0 +1,108 @@
+package search
+
+import (
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const (
+	MatchDefault = ""       // 分词后匹配（默认）
+	MatchExact   = "exact"  // 精确匹配短语
+	MatchFuzzy   = "fuzzy"  // 模糊匹配，允许拼写错误
+	MatchPrefix  = "prefix" // 前缀匹配，最后一个词作为前缀（边输入边搜索）
+)
+
+// 模糊匹配的编辑距离，bleve最大支持2
+const (
+	defaultFuzziness = 1
+	maxFuzziness     = 2
+)
+
+// 不同匹配方式的权重，精确匹配排在模糊匹配之前
+const (
+	exactMatchBoost   = 4.0
+	defaultMatchBoost = 2.0
+	fuzzyMatchBoost   = 1.0
+)
+
+// 文本的匹配方式
+type MatchOptions struct {
+	Mode      string // 匹配方式
+	Fuzziness int    // 模糊匹配的编辑距离
+}
+
+func (o MatchOptions) check() error {
+	switch o.Mode {
+	case MatchDefault, MatchExact, MatchFuzzy, MatchPrefix:
+	default:
+		return newBadRequest("unknown match: %s", o.Mode)
+	}
+	if o.Fuzziness < 0 || o.Fuzziness > maxFuzziness {
+		return newBadRequest("fuzziness must be between 0 and %d", maxFuzziness)
+	}
+	return nil
+}
+
+// 根据匹配方式生成文本字段的查询
+func buildMatchQuery(field string, text string, opts MatchOptions) query.Query {
+	switch opts.Mode {
+	case MatchExact:
+		return newMatchPhraseQuery(field, text, 1)
+	case MatchFuzzy:
+		fuzziness := opts.Fuzziness
+		if fuzziness == 0 {
+			fuzziness = defaultFuzziness
+		}
+		fuzzyQuery := newMatchQuery(field, text, fuzzyMatchBoost)
+		fuzzyQuery.SetFuzziness(fuzziness)
+		return bleve.NewDisjunctionQuery(
+			newMatchPhraseQuery(field, text, exactMatchBoost),
+			newMatchQuery(field, text, defaultMatchBoost),
+			fuzzyQuery,
+		)
+	case MatchPrefix:
+		return bleve.NewDisjunctionQuery(
+			newMatchPhraseQuery(field, text, exactMatchBoost),
+			newMatchQuery(field, text, defaultMatchBoost),
+			newPrefixMatchQuery(field, text, fuzzyMatchBoost),
+		)
+	}
+	q := bleve.NewMatchQuery(text)
+	q.SetField(field)
+	return q
+}
+
+func newMatchQuery(field string, text string, boost float64) *query.MatchQuery {
+	q := bleve.NewMatchQuery(text)
+	q.SetField(field)
+	q.SetOperator(query.MatchQueryOperatorAnd) // 分词后的词需要全部匹配
+	q.SetBoost(boost)
+	return q
+}
+
+func newMatchPhraseQuery(field string, text string, boost float64) *query.MatchPhraseQuery {
+	q := bleve.NewMatchPhraseQuery(text)
+	q.SetField(field)
+	q.SetBoost(boost)
+	return q
+}
+
+// 前面的词完整匹配，最后一个词作为前缀
+func newPrefixMatchQuery(field string, text string, boost float64) query.Query {
+	words := strings.Fields(text)
+	last := words[len(words)-1]
+	prefixQuery := bleve.NewPrefixQuery(strings.ToLower(last))
+	prefixQuery.SetField(field)
+	if len(words) == 1 {
+		prefixQuery.SetBoost(boost)
+		return prefixQuery
+	}
+	q := bleve.NewConjunctionQuery(
+		newMatchQuery(field, strings.Join(words[:len(words)-1], " "), 1),
+		prefixQuery,
+	)
+	q.SetBoost(boost)
+	return q
+}
@@ -0,0 +1,102 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchOptionsCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    MatchOptions
+		wantErr bool
+	}{
+		{"default", MatchOptions{}, false},
+		{"fuzzy", MatchOptions{Mode: MatchFuzzy, Fuzziness: maxFuzziness}, false},
+		{"unknown mode", MatchOptions{Mode: "regexp"}, true},
+		{"negative fuzziness", MatchOptions{Mode: MatchFuzzy, Fuzziness: -1}, true},
+		{"fuzziness too large", MatchOptions{Mode: MatchFuzzy, Fuzziness: maxFuzziness + 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.check(); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSearchMatch(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "release notes")
+	m2 := newTestMessage("c1", 2, 2, "u1", "notes about the release")
+	m3 := newTestMessage("c1", 2, 3, "u1", "relase notes")
+	m4 := newTestMessage("c1", 2, 4, "u1", "releasing soon")
+	indexTestMessages(t, s, 0, m1, m2, m3, m4)
+
+	tests := []struct {
+		name  string
+		req   SearchReq
+		want  []int64
+		first int64 // 按相关度排序时排在第一的消息
+	}{
+		{
+			name: "default matches any word",
+			req:  SearchReq{Payload: map[string]string{"content": "release notes"}},
+			want: []int64{m1.MessageId, m2.MessageId, m3.MessageId},
+		},
+		{
+			name: "exact matches the phrase",
+			req:  SearchReq{Payload: map[string]string{"content": "release notes"}, Match: MatchExact},
+			want: []int64{m1.MessageId},
+		},
+		{
+			name:  "fuzzy matches misspellings and ranks exact first",
+			req:   SearchReq{Payload: map[string]string{"content": "release notes"}, Match: MatchFuzzy},
+			want:  []int64{m1.MessageId, m2.MessageId, m3.MessageId},
+			first: m1.MessageId,
+		},
+		{
+			name: "fuzziness 0 uses the default",
+			req:  SearchReq{Payload: map[string]string{"content": "relase"}, Match: MatchFuzzy, Fuzziness: 0},
+			want: []int64{m1.MessageId, m2.MessageId, m3.MessageId},
+		},
+		{
+			name: "prefix of the last word",
+			req:  SearchReq{Payload: map[string]string{"content": "relea"}, Match: MatchPrefix},
+			want: []int64{m1.MessageId, m2.MessageId, m4.MessageId},
+		},
+		{
+			name: "prefix after complete words",
+			req:  SearchReq{Payload: map[string]string{"content": "release no"}, Match: MatchPrefix},
+			want: []int64{m1.MessageId, m2.MessageId},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Limit = 100
+			resp, err := s.Search(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[int64]bool)
+			for _, m := range resp.Messages {
+				got[m.MessageId] = true
+			}
+			want := make(map[int64]bool)
+			for _, id := range tt.want {
+				want[id] = true
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Search() = %v, want %v", got, want)
+			}
+			if tt.first != 0 && len(resp.Messages) > 0 && resp.Messages[0].MessageId != tt.first {
+				t.Errorf("Search() first = %d, want %d", resp.Messages[0].MessageId, tt.first)
+			}
+		})
+	}
+
+	if _, err := s.Search(SearchReq{Payload: map[string]string{"content": "release"}, Match: "regexp"}); !IsBadRequest(err) {
+		t.Errorf("Search() with unknown match error = %v, want BadRequestError", err)
+	}
+}
@@ -0,0 +1,40 @@
+package search
+
+import (
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/tidwall/gjson"
+)
+
+// 解析消息内容中的提及，格式为 {"mention":{"uids":["u1","u2"],"all":1}}
+func parseMention(payload gjson.Result) ([]string, bool) {
+	mention := payload.Get("mention")
+	if !mention.Exists() {
+		return nil, false
+	}
+	var uids []string
+	for _, uid := range mention.Get("uids").Array() {
+		if uid.String() != "" {
+			uids = append(uids, uid.String())
+		}
+	}
+	// all 可能是 1 或 true
+	all := mention.Get("all").Bool()
+	return uids, all
+}
+
+// 提及了用户的消息，包含@所有人的消息（不包含用户自己发送的）
+func newMentionQuery(uid string) query.Query {
+	uidQuery := bleve.NewTermQuery(uid)
+	uidQuery.SetField("mention_uids")
+
+	allQuery := bleve.NewBoolFieldQuery(true)
+	allQuery.SetField("mention_all")
+	fromQuery := bleve.NewTermQuery(uid)
+	fromQuery.SetField("from_uid")
+	mentionAllQuery := bleve.NewBooleanQuery()
+	mentionAllQuery.AddMust(allQuery)
+	mentionAllQuery.AddMustNot(fromQuery)
+
+	return bleve.NewDisjunctionQuery(uidQuery, mentionAllQuery)
+}
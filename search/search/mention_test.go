@@ -0,0 +1,70 @@
+package search
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseMention(t *testing.T) {
+	tests := []struct {
+		payload string
+		uids    []string
+		all     bool
+	}{
+		{`{"type":1,"content":"hi","mention":{"uids":["u1","","u2"]}}`, []string{"u1", "u2"}, false},
+		{`{"type":1,"mention":{"all":1}}`, nil, true},
+		{`{"type":1,"mention":{"uids":["u1"],"all":true}}`, []string{"u1"}, true},
+		{`{"type":1,"mention":{"all":0}}`, nil, false},
+		{`{"type":1,"content":"@u1"}`, nil, false},
+	}
+	for _, tt := range tests {
+		uids, all := parseMention(gjson.Parse(tt.payload))
+		if !reflect.DeepEqual(uids, tt.uids) || all != tt.all {
+			t.Errorf("parseMention(%s) = %v %v, want %v %v", tt.payload, uids, all, tt.uids, tt.all)
+		}
+	}
+}
+
+func TestSearchMentioned(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u2", "")
+	m1.Payload = []byte(`{"type":1,"content":"@u1 review","mention":{"uids":["u1","u3"]}}`)
+	m2 := newTestMessage("c1", 2, 2, "u2", "")
+	m2.Payload = []byte(`{"type":1,"content":"@all standup","mention":{"all":1}}`)
+	m3 := newTestMessage("c1", 2, 3, "u1", "")
+	m3.Payload = []byte(`{"type":1,"content":"@all lunch","mention":{"all":true}}`)
+	m4 := newTestMessage("c1", 2, 4, "u2", "")
+	m4.Payload = []byte(`{"type":1,"content":"@u3 review","mention":{"uids":["u3"]}}`)
+	indexTestMessages(t, s, 0, m1, m2, m3, m4)
+
+	tests := []struct {
+		name string
+		req  SearchReq
+		want []int64
+	}{
+		// 自己发送的@所有人不算提及
+		{"mentioned uid", SearchReq{MentionedUid: "u1"}, []int64{m1.MessageId, m2.MessageId}},
+		{"mentioned by all", SearchReq{MentionedUid: "u4"}, []int64{m2.MessageId, m3.MessageId}},
+		{"with content", SearchReq{MentionedUid: "u3", Payload: map[string]string{"content": "review"}}, []int64{m1.MessageId, m4.MessageId}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Limit = 100
+			resp, err := s.Search(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int64, 0, len(resp.Messages))
+			for _, m := range resp.Messages {
+				got = append(got, m.MessageId)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package search
+
+import (
+	"strings"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+// 多节点搜索失败的节点
+type NodeError struct {
+	NodeId uint64 `json:"node_id"` // 节点id
+	Error  string `json:"error"`   // 错误信息
+}
+
+// NodeReq 生成发送给各节点的搜索请求
+func (s SearchReq) NodeReq(channels []*pluginproto.Channel) SearchReq {
+	req := s.Clone()
+	req.Channels = channels
+	req.Facets = nodeFacets(req.Facets)
+	if strings.TrimSpace(req.Cursor) == "" && req.Page > 1 {
+		// 合并后才能确定第page页的内容，每个节点需要返回前page页的所有消息
+		req.Limit = req.Page * req.Limit
+		req.Page = 1
+	}
+	return req
+}
+
+// MergeSearchResps 合并各节点的搜索结果，总数为各节点之和，消息按照请求的排序方式全局排序
+// 各节点并行搜索，耗时取最慢的节点
+func MergeSearchResps(req SearchReq, resps []*SearchResp) *SearchResp {
+	result := &SearchResp{
+		Page:  req.Page,
+		Limit: req.Limit,
+	}
+	messages := make([]*Message, 0)
+	groups := make([]*SearchGroup, 0)
+	facets := make([]map[string]*FacetResult, 0, len(resps))
+	for _, resp := range resps {
+		if resp.Cost > result.Cost {
+			result.Cost = resp.Cost
+		}
+		result.Total += resp.Total
+		result.GroupTotal += resp.GroupTotal
+		result.GroupTruncated = result.GroupTruncated || resp.GroupTruncated
+		messages = append(messages, resp.Messages...)
+		groups = append(groups, resp.Groups...)
+		facets = append(facets, resp.Facets)
+	}
+	result.Facets = MergeFacetResults(req.Facets, facets)
+
+	// 频道只属于一个节点，各节点的分组不会重复
+	if req.Group {
+		SortGroups(groups)
+		result.Groups = pageSlice(groups, req.Page, req.Limit)
+		result.Messages = messages
+		return result
+	}
+
+	// 与各节点使用相同的排序，游标才能在合并后的结果中继续使用
+	SortMessages(req.Sort, messages)
+
+	// 截取第page页的消息
+	page := req.Page
+	if strings.TrimSpace(req.Cursor) != "" {
+		page = 1
+	}
+	messages = pageSlice(messages, page, req.Limit)
+	if req.Limit > 0 && len(messages) >= req.Limit {
+		result.NextCursor = EncodeCursor(messages[len(messages)-1])
+	}
+	result.Messages = messages
+	return result
+}
+
+// 截取第page页，limit小于等于0时返回空
+func pageSlice[T any](items []T, page int, limit int) []T {
+	if limit <= 0 {
+		return items[:0]
+	}
+	if page > 1 {
+		offset := (page - 1) * limit
+		if offset > len(items) {
+			offset = len(items)
+		}
+		items = items[offset:]
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
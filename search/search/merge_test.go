@@ -0,0 +1,147 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeSearchResps(t *testing.T) {
+	msg := func(id string, timestamp uint32) *Message {
+		return &Message{MessageIdStr: id, Timestamp: timestamp}
+	}
+	resps := func() []*SearchResp {
+		return []*SearchResp{
+			{Cost: 10, Total: 2, Messages: []*Message{msg("4", 400), msg("1", 100)}},
+			{Cost: 30, Total: 3, Messages: []*Message{msg("5", 500), msg("3", 300), msg("2", 200)}},
+		}
+	}
+	tests := []struct {
+		name       string
+		req        SearchReq
+		wantIds    []string
+		wantCursor bool
+	}{
+		{"first page", SearchReq{Sort: SortTime, Page: 1, Limit: 2}, []string{"5", "4"}, true},
+		{"second page", SearchReq{Sort: SortTime, Page: 2, Limit: 2}, []string{"3", "2"}, true},
+		{"last page", SearchReq{Sort: SortTime, Page: 3, Limit: 2}, []string{"1"}, false},
+		{"out of range", SearchReq{Sort: SortTime, Page: 4, Limit: 2}, []string{}, false},
+		{"cursor ignores page", SearchReq{Sort: SortTime, Page: 3, Limit: 2, Cursor: "x"}, []string{"5", "4"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := MergeSearchResps(tt.req, resps())
+			if result.Total != 5 {
+				t.Errorf("Total = %d, want 5", result.Total)
+			}
+			if result.Cost != 30 {
+				t.Errorf("Cost = %d, want 30", result.Cost)
+			}
+			ids := make([]string, 0, len(result.Messages))
+			for _, m := range result.Messages {
+				ids = append(ids, m.MessageIdStr)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIds) {
+				t.Errorf("Messages = %v, want %v", ids, tt.wantIds)
+			}
+			if (result.NextCursor != "") != tt.wantCursor {
+				t.Errorf("NextCursor = %q, want cursor %v", result.NextCursor, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestMergeSearchRespsGroups(t *testing.T) {
+	resps := []*SearchResp{
+		{GroupTotal: 2, Groups: []*SearchGroup{{ChannelId: "a", ChannelType: 2, Count: 1}, {ChannelId: "b", ChannelType: 2, Count: 5}}},
+		{GroupTotal: 2, GroupTruncated: true, Groups: []*SearchGroup{{ChannelId: "a", ChannelType: 1, Count: 3}, {ChannelId: "c", ChannelType: 2, Count: 1}}},
+	}
+	result := MergeSearchResps(SearchReq{Group: true, Page: 1, Limit: 3}, resps)
+	if result.GroupTotal != 4 {
+		t.Errorf("GroupTotal = %d, want 4", result.GroupTotal)
+	}
+	if !result.GroupTruncated {
+		t.Errorf("GroupTruncated = false, want true")
+	}
+	want := []string{"b:2", "a:1", "a:2"}
+	got := make([]string, 0, len(result.Groups))
+	for _, g := range result.Groups {
+		got = append(got, channelKey(g.ChannelId, g.ChannelType))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Groups = %v, want %v", got, want)
+	}
+}
+
+func TestNodeReq(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       SearchReq
+		wantPage  int
+		wantLimit int
+	}{
+		{"first page", SearchReq{Page: 1, Limit: 20}, 1, 20},
+		{"third page returns all previous pages", SearchReq{Page: 3, Limit: 20}, 1, 60},
+		{"cursor keeps page", SearchReq{Page: 3, Limit: 20, Cursor: "x"}, 3, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req.NodeReq(nil)
+			if req.Page != tt.wantPage || req.Limit != tt.wantLimit {
+				t.Errorf("NodeReq() page = %d limit = %d, want %d %d", req.Page, req.Limit, tt.wantPage, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestPageSlice(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	tests := []struct {
+		name        string
+		page, limit int
+		want        []int
+	}{
+		{"first page", 1, 2, []int{1, 2}},
+		{"zero page is first page", 0, 2, []int{1, 2}},
+		{"last partial page", 3, 2, []int{5}},
+		{"past the end", 4, 2, []int{}},
+		{"zero limit", 1, 0, []int{}},
+		{"negative limit", 1, -1, []int{}},
+		{"negative limit on later page", 2, -1, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pageSlice(items, tt.page, tt.limit); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pageSlice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchReqCheckWindow(t *testing.T) {
+	cursor := EncodeCursor(&Message{MessageIdStr: "1", MessageSeq: 1, Timestamp: 1})
+	tests := []struct {
+		name    string
+		req     SearchReq
+		wantErr bool
+	}{
+		{"last allowed page", SearchReq{Page: 500, Limit: 20}, false},
+		{"beyond the window", SearchReq{Page: 501, Limit: 20}, true},
+		{"huge page", SearchReq{Page: 1 << 40, Limit: 1000}, true},
+		{"groups beyond the window", SearchReq{Group: true, Page: 101, Limit: 100}, true},
+		{"cursor ignores page", SearchReq{Page: 100000, Limit: 20, Cursor: cursor}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.Check()
+			if tt.wantErr != IsBadRequest(err) || (!tt.wantErr && err != nil) {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// 通过校验的请求发给各节点的数量不超过上限（使用游标时忽略page）
+			if err == nil && tt.req.Cursor == "" {
+				if req := tt.req.NodeReq(nil); req.Page*req.Limit > maxSearchWindow {
+					t.Errorf("NodeReq() page = %d limit = %d", req.Page, req.Limit)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/tidwall/gjson"
+)
+
+// 消息的内容类型
+const (
+	KindImage = "image" // 图片
+	KindVoice = "voice" // 语音
+	KindVideo = "video" // 视频
+	KindFile  = "file"  // 文件
+	KindCard  = "card"  // 名片
+	KindLink  = "link"  // 包含链接
+)
+
+// 从消息内容中提取元数据的规则
+type MetadataRule struct {
+	PayloadTypes []int  `json:"payload_types"` // 适用的消息类型(payload.type)，为空适用所有类型
+	Kind         string `json:"kind"`          // 内容类型，设置了LinkPath时只有提取到链接才是此类型
+	NamePath     string `json:"name_path"`     // 文件名的路径（gjson语法），扩展名从文件名中获取
+	SizePath     string `json:"size_path"`     // 文件大小的路径
+	TitlePath    string `json:"title_path"`    // 卡片标题的路径
+	LinkPath     string `json:"link_path"`     // 从此路径的内容中提取链接
+}
+
+// 默认的规则，对应悟空IM的消息类型
+var DefaultMetadataRules = []MetadataRule{
+	{PayloadTypes: []int{2, 3}, Kind: KindImage}, // 图片、GIF
+	{PayloadTypes: []int{4}, Kind: KindVoice},
+	{PayloadTypes: []int{5}, Kind: KindVideo},
+	{PayloadTypes: []int{7}, Kind: KindCard, TitlePath: "name"},
+	{PayloadTypes: []int{8}, Kind: KindFile, NamePath: "name", SizePath: "size"},
+	{Kind: KindLink, LinkPath: "content"},
+}
+
+var (
+	metadataRulesLock sync.RWMutex
+	metadataRules     = DefaultMetadataRules
+)
+
+// SetMetadataRules 设置提取元数据的规则，修改后只对之后索引的消息生效（重建索引可以应用到已有消息）
+func SetMetadataRules(rules []MetadataRule) {
+	metadataRulesLock.Lock()
+	defer metadataRulesLock.Unlock()
+	metadataRules = rules
+}
+
+// ParseMetadataRules 解析JSON格式的规则列表，为空时返回默认规则
+func ParseMetadataRules(text string) ([]MetadataRule, error) {
+	if strings.TrimSpace(text) == "" {
+		return DefaultMetadataRules, nil
+	}
+	var rules []MetadataRule
+	if err := json.Unmarshal([]byte(text), &rules); err != nil {
+		return nil, fmt.Errorf("invalid metadata rules: %w", err)
+	}
+	for i, rule := range rules {
+		if rule.Kind == "" && rule.NamePath == "" && rule.SizePath == "" && rule.TitlePath == "" && rule.LinkPath == "" {
+			return nil, fmt.Errorf("metadata rule %d has no kind or path", i)
+		}
+		for _, t := range rule.PayloadTypes {
+			if t < 0 {
+				return nil, fmt.Errorf("metadata rule %d has invalid payload type: %d", i, t)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func getMetadataRules() []MetadataRule {
+	metadataRulesLock.RLock()
+	defer metadataRulesLock.RUnlock()
+	return metadataRules
+}
+
+var linkRegexp = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// 提取消息内容中的元数据
+func (m *Message) parseMetadata(payload gjson.Result) {
+	payloadType := int(payload.Get("type").Int())
+	for _, rule := range getMetadataRules() {
+		if !rule.match(payloadType) {
+			continue
+		}
+		if rule.LinkPath != "" {
+			hosts := parseLinkHosts(payload.Get(rule.LinkPath).String())
+			if len(hosts) == 0 {
+				continue
+			}
+			m.UrlHosts = appendUnique(m.UrlHosts, hosts...)
+		}
+		if rule.Kind != "" {
+			m.Kinds = appendUnique(m.Kinds, rule.Kind)
+		}
+		if rule.NamePath != "" {
+			if name := payload.Get(rule.NamePath).String(); name != "" {
+				m.FileName = name
+				m.FileExt = strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+			}
+		}
+		if rule.SizePath != "" {
+			if size := payload.Get(rule.SizePath); size.Exists() {
+				fileSize := size.Int()
+				m.FileSize = &fileSize
+			}
+		}
+		if rule.TitlePath != "" {
+			m.CardTitle = payload.Get(rule.TitlePath).String()
+		}
+	}
+}
+
+func (r MetadataRule) match(payloadType int) bool {
+	if len(r.PayloadTypes) == 0 {
+		return true
+	}
+	for _, t := range r.PayloadTypes {
+		if t == payloadType {
+			return true
+		}
+	}
+	return false
+}
+
+// 提取文本中链接的域名，同时包含上级域名，例如 a.b.com 返回 a.b.com 和 b.com
+func parseLinkHosts(text string) []string {
+	if text == "" {
+		return nil
+	}
+	var hosts []string
+	for _, link := range linkRegexp.FindAllString(text, -1) {
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		hosts = appendUnique(hosts, host)
+		labels := strings.Split(host, ".")
+		for i := 1; i < len(labels)-1; i++ {
+			hosts = appendUnique(hosts, strings.Join(labels[i:], "."))
+		}
+	}
+	return hosts
+}
+
+func appendUnique(values []string, items ...string) []string {
+	for _, item := range items {
+		exist := false
+		for _, v := range values {
+			if v == item {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// 内容类型、文件扩展名和链接域名的过滤条件
+func newMetadataQuery(req SearchReq) []query.Query {
+	queries := make([]query.Query, 0)
+	if len(req.Kinds) > 0 {
+		queries = append(queries, newKeywordsQuery("kinds", req.Kinds))
+	}
+	if len(req.FileExts) > 0 {
+		exts := make([]string, 0, len(req.FileExts))
+		for _, ext := range req.FileExts {
+			exts = append(exts, strings.TrimPrefix(ext, "."))
+		}
+		queries = append(queries, newKeywordsQuery("file_ext", exts))
+	}
+	if strings.TrimSpace(req.LinkDomain) != "" {
+		queries = append(queries, newKeywordsQuery("url_hosts", []string{req.LinkDomain}))
+	}
+	return queries
+}
+
+// 字段等于任意一个值（不区分大小写）
+func newKeywordsQuery(field string, values []string) query.Query {
+	orQuery := bleve.NewDisjunctionQuery()
+	for _, v := range values {
+		termQuery := bleve.NewTermQuery(strings.ToLower(strings.TrimSpace(v)))
+		termQuery.SetField(field)
+		orQuery.AddQuery(termQuery)
+	}
+	return orQuery
+}
@@ -0,0 +1,122 @@
+package search
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseMetadataRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []MetadataRule
+		wantErr bool
+	}{
+		{"empty uses default", " ", DefaultMetadataRules, false},
+		{"rules", `[{"payload_types":[20],"kind":"file","name_path":"file.name"}]`, []MetadataRule{{PayloadTypes: []int{20}, Kind: KindFile, NamePath: "file.name"}}, false},
+		{"not json", `kind=file`, nil, true},
+		{"rule without kind or path", `[{"payload_types":[20]}]`, nil, true},
+		{"negative payload type", `[{"payload_types":[-1],"kind":"file"}]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMetadataRules(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMetadataRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMetadataRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLinkHosts(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"see https://Docs.Example.com/a?b=1 and http://example.com", []string{"docs.example.com", "example.com"}},
+		{"<https://a.b.c.io/x>", []string{"a.b.c.io", "b.c.io", "c.io"}},
+		{"ftp://example.com example.com", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := parseLinkHosts(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLinkHosts(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMessageParseMetadata(t *testing.T) {
+	size := int64(2048)
+	tests := []struct {
+		name    string
+		payload string
+		want    Message
+	}{
+		{"image", `{"type":2,"url":"https://cdn.example.com/a.png"}`, Message{Kinds: []string{KindImage}}},
+		{"file", `{"type":8,"name":"Report.PDF","size":2048}`, Message{Kinds: []string{KindFile}, FileName: "Report.PDF", FileExt: "pdf", FileSize: &size}},
+		{"card", `{"type":7,"name":"Alice"}`, Message{Kinds: []string{KindCard}, CardTitle: "Alice"}},
+		{"text with link", `{"type":1,"content":"read https://go.dev/doc"}`, Message{Kinds: []string{KindLink}, UrlHosts: []string{"go.dev"}}},
+		{"text without link", `{"type":1,"content":"hello"}`, Message{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{}
+			m.parseMetadata(gjson.Parse(tt.payload))
+			if !reflect.DeepEqual(*m, tt.want) {
+				t.Errorf("parseMetadata() = %+v, want %+v", *m, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchMetadata(t *testing.T) {
+	// 自定义的文件消息类型
+	SetMetadataRules(append([]MetadataRule{{PayloadTypes: []int{20}, Kind: KindFile, NamePath: "file.name"}}, DefaultMetadataRules...))
+	defer SetMetadataRules(DefaultMetadataRules)
+
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "")
+	m1.Payload = []byte(`{"type":8,"name":"plan.pdf","size":10}`)
+	m2 := newTestMessage("c1", 2, 2, "u1", "")
+	m2.Payload = []byte(`{"type":20,"file":{"name":"notes.md"}}`)
+	m3 := newTestMessage("c1", 2, 3, "u1", "")
+	m3.Payload = []byte(`{"type":1,"content":"doc https://wiki.example.com/plan"}`)
+	m4 := newTestMessage("c1", 2, 4, "u1", "")
+	m4.Payload = []byte(`{"type":2,"url":"https://example.com/a.png"}`)
+	indexTestMessages(t, s, 0, m1, m2, m3, m4)
+
+	tests := []struct {
+		name string
+		req  SearchReq
+		want []int64
+	}{
+		{"kinds", SearchReq{Kinds: []string{KindFile, "Image"}}, []int64{m1.MessageId, m2.MessageId, m4.MessageId}},
+		{"file ext", SearchReq{FileExts: []string{".PDF"}}, []int64{m1.MessageId}},
+		{"custom rule ext", SearchReq{FileExts: []string{"md"}}, []int64{m2.MessageId}},
+		{"link domain includes subdomains", SearchReq{LinkDomain: "example.com"}, []int64{m3.MessageId}},
+		{"link kind", SearchReq{Kinds: []string{KindLink}}, []int64{m3.MessageId}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Limit = 100
+			resp, err := s.Search(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int64, 0, len(resp.Messages))
+			for _, m := range resp.Messages {
+				got = append(got, m.MessageId)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
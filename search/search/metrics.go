@@ -0,0 +1,308 @@
+package search
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 状态中返回的等待最久的频道数量
+const statusLaggingChannels = 10
+
+// 索引目录大小的缓存时间，遍历目录的开销较大
+const indexSizeCacheTTL = time.Second * 30
+
+// 索引批次耗时的直方图区间（秒）
+var batchLatencyBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 索引的运行指标
+type metrics struct {
+	indexedMessages     atomic.Uint64 // 已索引的消息数量
+	failedMessages      atomic.Uint64 // 索引失败的消息数量
+	getMessagesRequests atomic.Uint64 // 拉取频道消息的请求次数
+	getMessagesErrors   atomic.Uint64 // 拉取频道消息失败的次数
+
+	skipLock sync.Mutex
+	skipped  map[string]uint64 // 未索引的消息数量，key为原因
+
+	batchLock    sync.Mutex
+	batchCounts  []uint64 // 每个区间的批次数量（不累加）
+	batchCount   uint64
+	batchSeconds float64
+
+	sizeLock   sync.Mutex
+	sizeDir    string
+	size       int64
+	sizeExpire time.Time
+}
+
+// 索引目录占用的磁盘空间，缓存indexSizeCacheTTL
+func (m *metrics) indexSize(dir string) int64 {
+	m.sizeLock.Lock()
+	defer m.sizeLock.Unlock()
+	now := time.Now()
+	if dir != m.sizeDir || now.After(m.sizeExpire) {
+		m.sizeDir = dir
+		m.size = dirSize(dir)
+		m.sizeExpire = now.Add(indexSizeCacheTTL)
+	}
+	return m.size
+}
+
+// 记录一次索引批次的耗时
+func (m *metrics) observeBatch(d time.Duration) {
+	seconds := d.Seconds()
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+	if m.batchCounts == nil {
+		m.batchCounts = make([]uint64, len(batchLatencyBounds)+1)
+	}
+	i := sort.SearchFloat64s(batchLatencyBounds, seconds)
+	m.batchCounts[i]++
+	m.batchCount++
+	m.batchSeconds += seconds
+}
+
+// 记录一条未索引的消息
+func (m *metrics) skip(reason string) {
+	m.skipLock.Lock()
+	defer m.skipLock.Unlock()
+	if m.skipped == nil {
+		m.skipped = make(map[string]uint64)
+	}
+	m.skipped[reason]++
+}
+
+func (m *metrics) skippedMessages() map[string]uint64 {
+	m.skipLock.Lock()
+	defer m.skipLock.Unlock()
+	skipped := make(map[string]uint64, len(m.skipped))
+	for reason, count := range m.skipped {
+		skipped[reason] = count
+	}
+	return skipped
+}
+
+// 直方图的累计数量，与batchLatencyBounds一一对应，最后一个为+Inf
+func (m *metrics) batchHistogram() ([]uint64, uint64, float64) {
+	m.batchLock.Lock()
+	defer m.batchLock.Unlock()
+	cumulative := make([]uint64, len(batchLatencyBounds)+1)
+	var total uint64
+	for i := range cumulative {
+		if m.batchCounts != nil {
+			total += m.batchCounts[i]
+		}
+		cumulative[i] = total
+	}
+	return cumulative, m.batchCount, m.batchSeconds
+}
+
+// 频道的等待情况
+type PendingChannel struct {
+	ChannelId   string `json:"channel_id"`
+	ChannelType uint8  `json:"channel_type"`
+	Since       int64  `json:"since"` // 开始等待索引的时间
+	Lag         int64  `json:"lag"`   // 已等待的秒数
+}
+
+type BucketStatus struct {
+	Id              int `json:"id"`
+	QueueLength     int `json:"queue_length"`     // indexChan中的频道数量
+	QueueCapacity   int `json:"queue_capacity"`   // indexChan的容量
+	PendingChannels int `json:"pending_channels"` // 还未索引完成的频道数量
+}
+
+// 索引的状态
+type Status struct {
+	IndexName           string            `json:"index_name"`            // 消息索引目录
+	SchemaVersion       int               `json:"schema_version"`        // 消息索引结构版本
+	Migrating           bool              `json:"migrating"`             // 是否正在迁移索引
+	DocCount            uint64            `json:"doc_count"`             // 索引中的消息数量
+	Partitions          int               `json:"partitions"`            // 分区数量
+	IndexSize           int64             `json:"index_size"`            // 消息索引占用的磁盘空间（缓存30秒）
+	DbSize              uint64            `json:"db_size"`               // pebble占用的磁盘空间
+	IndexedMessages     uint64            `json:"indexed_messages"`      // 启动后已索引的消息数量
+	FailedMessages      uint64            `json:"failed_messages"`       // 启动后索引失败的消息数量
+	SkippedMessages     map[string]uint64 `json:"skipped_messages"`      // 启动后未索引的消息数量，key为原因
+	GetMessagesRequests uint64            `json:"get_messages_requests"` // 启动后拉取频道消息的请求次数
+	GetMessagesErrors   uint64            `json:"get_messages_errors"`   // 启动后拉取频道消息失败的次数
+	BatchCount          uint64            `json:"batch_count"`           // 启动后写入索引的批次数量
+	BatchAvgMs          float64           `json:"batch_avg_ms"`          // 批次的平均耗时（毫秒）
+	ThrottleMs          int64             `json:"throttle_ms"`           // 服务端出错后拉取消息前的等待时间（毫秒）
+	Buckets             []BucketStatus    `json:"buckets"`
+	PendingChannels     int               `json:"pending_channels"` // 还未索引完成的频道数量
+	OldestPending       *PendingChannel   `json:"oldest_pending"`   // 等待最久的频道
+	LaggingChannels     []*PendingChannel `json:"lagging_channels"` // 等待最久的频道（最多10个）
+}
+
+// Status 索引的状态
+func (s *Search) Status() (*Status, error) {
+	s.indexLock.RLock()
+	index := s.activeIndex
+	migrating := s.migrateIndex != nil
+	s.indexLock.RUnlock()
+	if index == nil {
+		return nil, fmt.Errorf("message index is not open")
+	}
+
+	status := s.runtimeStatus()
+	status.Migrating = migrating
+	name, version, err := s.db.getMessageIndexMeta()
+	if err != nil {
+		return nil, err
+	}
+	status.IndexName = name
+	status.SchemaVersion = version
+	if status.DocCount, err = s.msgIndex.DocCount(); err != nil {
+		return nil, err
+	}
+	status.Partitions = len(index.partitionNames())
+	status.IndexSize = s.metrics.indexSize(index.dir)
+	status.DbSize = s.db.diskSize()
+	return status, nil
+}
+
+// 不需要读取索引的状态（计数和bucket），索引没有打开时也可以获取
+func (s *Search) runtimeStatus() *Status {
+	status := &Status{
+		IndexedMessages:     s.metrics.indexedMessages.Load(),
+		FailedMessages:      s.metrics.failedMessages.Load(),
+		SkippedMessages:     s.metrics.skippedMessages(),
+		GetMessagesRequests: s.metrics.getMessagesRequests.Load(),
+		GetMessagesErrors:   s.metrics.getMessagesErrors.Load(),
+		ThrottleMs:          s.throttle.current().Milliseconds(),
+		Buckets:             make([]BucketStatus, 0),
+		LaggingChannels:     make([]*PendingChannel, 0),
+	}
+	_, batchCount, batchSeconds := s.metrics.batchHistogram()
+	status.BatchCount = batchCount
+	if batchCount > 0 {
+		status.BatchAvgMs = batchSeconds * 1000 / float64(batchCount)
+	}
+
+	now := time.Now()
+	pending := make([]*PendingChannel, 0)
+	for _, b := range s.bucketList() {
+		bucketStatus, channels := b.status(now)
+		status.Buckets = append(status.Buckets, bucketStatus)
+		pending = append(pending, channels...)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Since < pending[j].Since
+	})
+	status.PendingChannels = len(pending)
+	if len(pending) > 0 {
+		status.OldestPending = pending[0]
+	}
+	if len(pending) > statusLaggingChannels {
+		pending = pending[:statusLaggingChannels]
+	}
+	status.LaggingChannels = append(status.LaggingChannels, pending...)
+	return status
+}
+
+// WriteMetrics 以Prometheus文本格式输出指标
+// 索引没有打开时search_index_available为0，只输出计数和bucket的指标
+func (s *Search) WriteMetrics(w io.Writer) error {
+	status, err := s.Status()
+	available := err == nil
+	if !available {
+		status = s.runtimeStatus()
+	}
+	p := &metricsWriter{w: w}
+	p.metric("search_index_available", "gauge", "Whether the message index is open and readable.", boolValue(available))
+	if available {
+		p.metric("search_index_documents", "gauge", "Number of messages in the index.", float64(status.DocCount))
+		p.metric("search_index_partitions", "gauge", "Number of index partitions.", float64(status.Partitions))
+		p.metric("search_index_size_bytes", "gauge", "On-disk size of the message index.", float64(status.IndexSize))
+		p.metric("search_db_size_bytes", "gauge", "On-disk size of the pebble db.", float64(status.DbSize))
+		p.metric("search_index_migrating", "gauge", "Whether the message index is being migrated.", boolValue(status.Migrating))
+	}
+	p.metric("search_indexed_messages_total", "counter", "Messages written to the index.", float64(status.IndexedMessages))
+	p.metric("search_index_failed_messages_total", "counter", "Messages that failed to be indexed.", float64(status.FailedMessages))
+	reasons := make([]string, 0, len(status.SkippedMessages))
+	for reason := range status.SkippedMessages {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	p.header("search_skipped_messages_total", "counter", "Messages that were not indexed, by reason.")
+	for _, reason := range reasons {
+		p.sample("search_skipped_messages_total", fmt.Sprintf(`{reason="%s"}`, reason), float64(status.SkippedMessages[reason]))
+	}
+	p.metric("search_get_channel_messages_total", "counter", "GetChannelMessages requests.", float64(status.GetMessagesRequests))
+	p.metric("search_get_channel_messages_errors_total", "counter", "GetChannelMessages requests that failed.", float64(status.GetMessagesErrors))
+	p.metric("search_pull_throttle_seconds", "gauge", "Delay before pulling messages after server errors.", float64(status.ThrottleMs)/1000)
+
+	p.header("search_bucket_queue_length", "gauge", "Channels waiting in the bucket indexChan.")
+	for _, b := range status.Buckets {
+		p.sample("search_bucket_queue_length", fmt.Sprintf(`{bucket="%d"}`, b.Id), float64(b.QueueLength))
+	}
+	p.header("search_bucket_pending_channels", "gauge", "Channels of the bucket that are not fully indexed.")
+	for _, b := range status.Buckets {
+		p.sample("search_bucket_pending_channels", fmt.Sprintf(`{bucket="%d"}`, b.Id), float64(b.PendingChannels))
+	}
+	var oldestLag float64
+	if status.OldestPending != nil {
+		oldestLag = float64(status.OldestPending.Lag)
+	}
+	p.metric("search_index_oldest_pending_seconds", "gauge", "Seconds the oldest unindexed channel has been waiting.", oldestLag)
+
+	cumulative, count, sum := s.metrics.batchHistogram()
+	p.header("search_index_batch_duration_seconds", "histogram", "Latency of writing an index batch.")
+	for i, bound := range batchLatencyBounds {
+		p.sample("search_index_batch_duration_seconds_bucket", fmt.Sprintf(`{le="%g"}`, bound), float64(cumulative[i]))
+	}
+	p.sample("search_index_batch_duration_seconds_bucket", `{le="+Inf"}`, float64(cumulative[len(cumulative)-1]))
+	p.sample("search_index_batch_duration_seconds_sum", "", sum)
+	p.sample("search_index_batch_duration_seconds_count", "", float64(count))
+	return p.err
+}
+
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *metricsWriter) header(name, typ, help string) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *metricsWriter) sample(name, labels string, value float64) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, "%s%s %g\n", name, labels, value)
+}
+
+func (p *metricsWriter) metric(name, typ, help string, value float64) {
+	p.header(name, typ, help)
+	p.sample(name, "", value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 目录占用的磁盘空间，遍历时删除的文件忽略
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,101 @@
+package search
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsBatchHistogram(t *testing.T) {
+	var m metrics
+	m.observeBatch(3 * time.Millisecond)
+	m.observeBatch(10 * time.Millisecond) // 等于上界的计入此区间
+	m.observeBatch(time.Minute)
+	cumulative, count, sum := m.batchHistogram()
+	if len(cumulative) != len(batchLatencyBounds)+1 {
+		t.Fatalf("histogram buckets = %d, want %d", len(cumulative), len(batchLatencyBounds)+1)
+	}
+	if cumulative[0] != 1 || cumulative[1] != 2 || cumulative[len(cumulative)-2] != 2 || cumulative[len(cumulative)-1] != 3 {
+		t.Errorf("histogram = %v", cumulative)
+	}
+	if count != 3 || sum < 60 {
+		t.Errorf("histogram count = %d sum = %g", count, sum)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	empty := newTestMessage("c1", 2, 3, "u1", "")
+	empty.Payload = nil
+	indexTestMessages(t, s, 0,
+		newTestMessage("c1", 2, 1, "u1", "hello"),
+		newTestMessage("c1", 2, 2, "u1", "world"),
+		empty,
+	)
+	s.MakeIndex("c2", 1)
+	s.throttle.failure()
+
+	status, err := s.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DocCount != 2 || status.IndexedMessages != 2 || status.Partitions == 0 || status.BatchCount != 1 {
+		t.Errorf("Status() = %+v", status)
+	}
+	if want := map[string]uint64{SkipEmptyPayload: 1}; !reflect.DeepEqual(status.SkippedMessages, want) {
+		t.Errorf("Status() skipped = %v, want %v", status.SkippedMessages, want)
+	}
+	if status.ThrottleMs <= 0 {
+		t.Errorf("Status() throttle = %d after a failure", status.ThrottleMs)
+	}
+	if status.PendingChannels != 1 || status.OldestPending == nil || status.OldestPending.ChannelId != "c2" || len(status.LaggingChannels) != 1 {
+		t.Errorf("Status() pending = %d %+v", status.PendingChannels, status.OldestPending)
+	}
+	if len(status.Buckets) != 1 || status.Buckets[0].QueueLength != 1 || status.Buckets[0].QueueCapacity != 4 {
+		t.Errorf("Status() buckets = %+v", status.Buckets)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	indexTestMessages(t, s, 0, newTestMessage("c1", 2, 1, "u1", "hello"))
+	s.metrics.skip(SkipExpired)
+
+	var buf bytes.Buffer
+	if err := s.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"search_index_available 1",
+		"search_index_documents 1",
+		"search_indexed_messages_total 1",
+		`search_skipped_messages_total{reason="expired"} 1`,
+		`search_bucket_queue_length{bucket="0"} 0`,
+		`search_index_batch_duration_seconds_bucket{le="+Inf"} 1`,
+		"search_index_batch_duration_seconds_count 1",
+		"# TYPE search_index_batch_duration_seconds histogram",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("WriteMetrics() does not contain %q", line)
+		}
+	}
+
+	// 索引没有打开时只输出计数和bucket的指标
+	s.indexLock.Lock()
+	s.activeIndex = nil
+	s.indexLock.Unlock()
+	buf.Reset()
+	if err := s.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "search_index_available 0\n") || strings.Contains(buf.String(), "search_index_documents") {
+		t.Errorf("WriteMetrics() without index:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "search_indexed_messages_total 1\n") {
+		t.Errorf("WriteMetrics() without index does not contain the counters")
+	}
+}
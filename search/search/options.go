@@ -0,0 +1,132 @@
+package search
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bucket的最大数量
+const maxBuckets = 256
+
+// 索引的默认配置
+var defaultIndexOptions = IndexOptions{
+	Buckets:      10,
+	QueueSize:    1000,
+	BatchSize:    100,
+	PullLimit:    500,
+	PullInterval: time.Millisecond * 500,
+}
+
+// 索引的配置，为0时使用默认值
+type IndexOptions struct {
+	Buckets      int           // bucket数量，频道按Hash分配到bucket
+	QueueSize    int           // 每个bucket的indexChan容量
+	BatchSize    int           // 每批拉取消息的频道数量
+	PullLimit    int           // 每个频道每次拉取的消息数量
+	PullInterval time.Duration // 频道还有消息时再次拉取的间隔
+}
+
+func (o IndexOptions) withDefaults() IndexOptions {
+	if o.Buckets <= 0 {
+		o.Buckets = defaultIndexOptions.Buckets
+	}
+	if o.Buckets > maxBuckets {
+		o.Buckets = maxBuckets
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultIndexOptions.QueueSize
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultIndexOptions.BatchSize
+	}
+	if o.PullLimit <= 0 {
+		o.PullLimit = defaultIndexOptions.PullLimit
+	}
+	if o.PullInterval <= 0 {
+		o.PullInterval = defaultIndexOptions.PullInterval
+	}
+	return o
+}
+
+func (s *Search) getIndexOptions() IndexOptions {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.indexOptions
+}
+
+// SetIndexOptions 修改索引的配置，立即生效
+// bucket数量或队列容量变化时重建bucket，旧bucket队列中的频道按Hash重新分配到新的bucket
+func (s *Search) SetIndexOptions(opts IndexOptions) error {
+	opts = opts.withDefaults()
+
+	s.resizeLock.Lock()
+	defer s.resizeLock.Unlock()
+
+	s.bucketLock.Lock()
+	prev := s.indexOptions
+	s.indexOptions = opts
+	if opts.Buckets == prev.Buckets && opts.QueueSize == prev.QueueSize {
+		s.bucketLock.Unlock()
+		return nil
+	}
+	if s.stopping() {
+		s.bucketLock.Unlock()
+		return ErrStopped
+	}
+	old := s.buckets
+	buckets := make([]*bucket, opts.Buckets)
+	for i := range buckets {
+		buckets[i] = newBucket(i, s, opts.QueueSize)
+	}
+	s.buckets = buckets
+	s.bucketLock.Unlock()
+
+	// 旧的bucket处理完当前批次后退出，之后再启动新的bucket，防止同一个频道同时在两个bucket中索引
+	for _, b := range old {
+		b.quit()
+	}
+	for _, b := range old {
+		<-b.done
+	}
+	for _, b := range old {
+		b.handover()
+	}
+	for _, b := range buckets {
+		b.start()
+	}
+	s.Info("resize buckets", zap.Int("from", len(old)), zap.Int("to", len(buckets)), zap.Int("queueSize", opts.QueueSize))
+	return nil
+}
+
+// 频道所在的bucket
+func (s *Search) bucketOf(channelId string) *bucket {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.buckets[s.bucketIndex(channelId)]
+}
+
+// 放入频道所在bucket的队列，持有锁防止放入已替换的bucket
+func (s *Search) enqueueIndex(req indexReq) bool {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.buckets[s.bucketIndex(req.channelId)].enqueue(req)
+}
+
+// 频道还未索引完成时放入队列，返回false表示需要先写入待索引记录
+func (s *Search) enqueuePendingIndex(req indexReq) bool {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.buckets[s.bucketIndex(req.channelId)].enqueueIfPending(req)
+}
+
+func (s *Search) bucketList() []*bucket {
+	s.bucketLock.RLock()
+	defer s.bucketLock.RUnlock()
+	return s.buckets
+}
+
+// 调用时需持有bucketLock
+func (s *Search) bucketIndex(channelId string) int {
+	return int(Hash(channelId) % uint32(len(s.buckets)))
+}
@@ -0,0 +1,80 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIndexOptionsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		opts IndexOptions
+		want IndexOptions
+	}{
+		{"zero", IndexOptions{}, defaultIndexOptions},
+		{"negative", IndexOptions{Buckets: -1, QueueSize: -1, BatchSize: -1, PullLimit: -1, PullInterval: -1}, defaultIndexOptions},
+		{"too many buckets", IndexOptions{Buckets: maxBuckets + 1}, IndexOptions{Buckets: maxBuckets, QueueSize: 1000, BatchSize: 100, PullLimit: 500, PullInterval: 500 * time.Millisecond}},
+		{"custom", IndexOptions{Buckets: 2, QueueSize: 3, BatchSize: 4, PullLimit: 5, PullInterval: time.Second}, IndexOptions{Buckets: 2, QueueSize: 3, BatchSize: 4, PullLimit: 5, PullInterval: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.withDefaults(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetIndexOptions(t *testing.T) {
+	s := newTestSearch(t)
+	defer s.Stop()
+	stubChannelMessages(t)
+	s.indexOptions = IndexOptions{Buckets: 1, QueueSize: 4}.withDefaults()
+	b := newBucket(0, s, 4)
+	s.buckets = []*bucket{b}
+	b.start()
+
+	// 只修改拉取参数时不重建bucket
+	if err := s.SetIndexOptions(IndexOptions{Buckets: 1, QueueSize: 4, PullLimit: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.bucketList(); len(got) != 1 || got[0] != b || s.getIndexOptions().PullLimit != 20 {
+		t.Errorf("buckets = %d, pull limit = %d, want the same bucket", len(got), s.getIndexOptions().PullLimit)
+	}
+
+	if err := s.SetIndexOptions(IndexOptions{Buckets: 3, QueueSize: 8}); err != nil {
+		t.Fatal(err)
+	}
+	buckets := s.bucketList()
+	if len(buckets) != 3 {
+		t.Fatalf("buckets = %d, want 3", len(buckets))
+	}
+	for _, nb := range buckets {
+		if cap(nb.indexChan) != 8 {
+			t.Errorf("bucket %d queue capacity = %d, want 8", nb.id, cap(nb.indexChan))
+		}
+	}
+	select {
+	case <-b.done:
+	default:
+		t.Errorf("old bucket is not stopped")
+	}
+
+	// 新的bucket开始索引
+	for _, channelId := range []string{"c1", "c2", "c3", "c4"} {
+		s.MakeIndex(channelId, 2)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pendingChannels(t, s)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending channels = %v, want all indexed", pendingChannels(t, s))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Stop()
+	if err := s.SetIndexOptions(IndexOptions{Buckets: 2}); err != ErrStopped {
+		t.Errorf("SetIndexOptions() after stop error = %v, want %v", err, ErrStopped)
+	}
+}
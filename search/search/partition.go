@@ -0,0 +1,416 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+)
+
+// 消息索引按照消息时间（UTC）每月一个分区，每个分区是一个bleve索引，查询时通过索引别名一起搜索，
+// 过期的分区可以整体删除。
+// 频道的检查点写入同一个batch中最新的分区，读取时取所有分区中最大的。
+
+// 分区名的格式，例如 202401
+const partitionLayout = "200601"
+
+// 按月分区的消息索引
+type messageIndex struct {
+	dir     string
+	legacy  bool                 // 旧版本不分区的索引，只有一个分区
+	mapping mapping.IndexMapping // 新建分区使用的mapping，同一个索引的分区保持一致
+
+	lock       sync.RWMutex
+	partitions map[string]bleve.Index
+	alias      bleve.IndexAlias
+}
+
+// 分区信息
+type PartitionInfo struct {
+	Name     string `json:"name"`      // 分区名，例如 202401
+	Start    int64  `json:"start"`     // 分区开始时间（包含）
+	End      int64  `json:"end"`       // 分区结束时间（不包含）
+	DocCount uint64 `json:"doc_count"` // 消息数量
+}
+
+// 打开已有的索引，目录不存在返回bleve.ErrorIndexPathDoesNotExist
+func openMessageIndexDir(dir string, legacy bool, buildMapping func() *mapping.IndexMappingImpl) (*messageIndex, error) {
+	m := &messageIndex{
+		dir:        dir,
+		legacy:     legacy,
+		partitions: make(map[string]bleve.Index),
+		alias:      bleve.NewIndexAlias(),
+	}
+	if legacy {
+		index, err := bleve.Open(dir)
+		if err != nil {
+			return nil, err
+		}
+		m.addPartition("", index)
+		m.mapping = index.Mapping()
+		return m, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, bleve.ErrorIndexPathDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err = time.Parse(partitionLayout, entry.Name()); err != nil {
+			continue
+		}
+		index, err := bleve.Open(path.Join(dir, entry.Name()))
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.addPartition(entry.Name(), index)
+		if m.mapping == nil {
+			m.mapping = index.Mapping()
+		}
+	}
+	if m.mapping == nil {
+		m.mapping = buildMapping()
+	}
+	if err = m.ensurePartition(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// 创建新的分区索引，目录已存在时先删除
+func createMessageIndexDir(dir string, indexMapping mapping.IndexMapping) (*messageIndex, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m := &messageIndex{
+		dir:        dir,
+		mapping:    indexMapping,
+		partitions: make(map[string]bleve.Index),
+		alias:      bleve.NewIndexAlias(),
+	}
+	if err := m.ensurePartition(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// 没有分区时创建当前月份的分区，别名中没有索引时无法查询
+func (m *messageIndex) ensurePartition() error {
+	if len(m.partitionNames()) > 0 {
+		return nil
+	}
+	_, err := m.getPartition(m.partitionOf(0))
+	return err
+}
+
+func (m *messageIndex) addPartition(name string, index bleve.Index) {
+	m.partitions[name] = index
+	m.alias.Add(index)
+}
+
+// 消息所在的分区，没有时间的消息使用当前时间
+func (m *messageIndex) partitionOf(timestamp uint32) string {
+	if m.legacy {
+		return ""
+	}
+	t := time.Now()
+	if timestamp > 0 {
+		t = time.Unix(int64(timestamp), 0)
+	}
+	return t.UTC().Format(partitionLayout)
+}
+
+// 获取分区，不存在时创建
+func (m *messageIndex) getPartition(name string) (bleve.Index, error) {
+	m.lock.RLock()
+	index := m.partitions[name]
+	m.lock.RUnlock()
+	if index != nil {
+		return index, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if index = m.partitions[name]; index != nil {
+		return index, nil
+	}
+	index, err := bleve.New(path.Join(m.dir, name), m.mapping)
+	if err != nil {
+		return nil, err
+	}
+	m.addPartition(name, index)
+	return index, nil
+}
+
+// 分区名，从旧到新
+func (m *messageIndex) partitionNames() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	names := make([]string, 0, len(m.partitions))
+	for name := range m.partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 最新的分区名，没有分区时为当前月份
+func (m *messageIndex) latestPartition() string {
+	names := m.partitionNames()
+	if len(names) == 0 {
+		return m.partitionOf(0)
+	}
+	return names[len(names)-1]
+}
+
+// 频道的检查点，写入时只保留在一个分区中，兼容旧数据读取时取所有分区中最大的，ok为false表示没有分区保存了检查点
+func (m *messageIndex) checkpoint(key []byte) (uint64, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var (
+		max uint64
+		ok  bool
+	)
+	for _, index := range m.partitions {
+		data, err := index.GetInternal(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(data) != 8 {
+			continue
+		}
+		if seq := decodeMessageSeq(data); !ok || seq > max {
+			max = seq
+		}
+		ok = true
+	}
+	return max, ok, nil
+}
+
+// Partitions 所有分区的信息，从旧到新
+func (m *messageIndex) Partitions() ([]*PartitionInfo, error) {
+	infos := make([]*PartitionInfo, 0)
+	for _, name := range m.partitionNames() {
+		m.lock.RLock()
+		index := m.partitions[name]
+		m.lock.RUnlock()
+		if index == nil {
+			continue
+		}
+		count, err := index.DocCount()
+		if err != nil {
+			return nil, err
+		}
+		info := &PartitionInfo{
+			Name:     name,
+			DocCount: count,
+		}
+		if start, err := time.Parse(partitionLayout, name); err == nil {
+			info.Start = start.Unix()
+			info.End = start.AddDate(0, 1, 0).Unix()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// 删除分区（包括目录）
+func (m *messageIndex) dropPartition(name string) error {
+	m.lock.Lock()
+	index := m.partitions[name]
+	if index == nil {
+		m.lock.Unlock()
+		return nil
+	}
+	delete(m.partitions, name)
+	m.alias.Remove(index)
+	m.lock.Unlock()
+
+	if err := index.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path.Join(m.dir, name)); err != nil {
+		return err
+	}
+	return m.ensurePartition()
+}
+
+// 复制索引到dir，保持分区的目录结构
+func (m *messageIndex) copyTo(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for name, index := range m.partitions {
+		copyable, ok := index.(bleve.IndexCopyable)
+		if !ok {
+			return fmt.Errorf("message index does not support copy")
+		}
+		if err := copyable.CopyTo(bleve.FileSystemDirectory(path.Join(dir, name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *messageIndex) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var closeErr error
+	for name, index := range m.partitions {
+		if err := index.Close(); err != nil {
+			closeErr = err
+		}
+		m.alias.Remove(index)
+		delete(m.partitions, name)
+	}
+	return closeErr
+}
+
+func (m *messageIndex) NewBatch() *messageBatch {
+	return &messageBatch{
+		index:   m,
+		batches: make(map[string]*bleve.Batch),
+	}
+}
+
+// 按照分区写入batch，从旧到新依次写入
+func (m *messageIndex) Batch(b *messageBatch) error {
+	if b.err != nil {
+		return b.err
+	}
+	// 删除的消息和检查点在所有分区中删除
+	if len(b.deletes) > 0 || len(b.deleteInternals) > 0 {
+		for _, name := range m.partitionNames() {
+			batch, err := b.batch(name)
+			if err != nil {
+				return err
+			}
+			for _, id := range b.deletes {
+				batch.Delete(id)
+			}
+			for _, key := range b.deleteInternals {
+				batch.DeleteInternal(key)
+			}
+		}
+	}
+	if len(b.internals) > 0 {
+		latest := ""
+		for name := range b.batches {
+			if name > latest {
+				latest = name
+			}
+		}
+		if len(b.batches) == 0 {
+			latest = m.latestPartition()
+		}
+		batch, err := b.batch(latest)
+		if err != nil {
+			return err
+		}
+		for _, kv := range b.internals {
+			batch.SetInternal(kv.key, kv.val)
+		}
+		// 其他分区中的旧值要删除，否则读取时取最大值会忽略检查点的回退
+		for _, name := range m.partitionNames() {
+			if name == latest {
+				continue
+			}
+			other, err := b.batch(name)
+			if err != nil {
+				return err
+			}
+			for _, kv := range b.internals {
+				other.DeleteInternal(kv.key)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(b.batches))
+	for name := range b.batches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		index, err := m.getPartition(name)
+		if err != nil {
+			return err
+		}
+		if err = index.Batch(b.batches[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 分区索引的batch，消息按照时间写入对应的分区
+type messageBatch struct {
+	index           *messageIndex
+	batches         map[string]*bleve.Batch
+	deletes         []string
+	internals       []internalKV
+	deleteInternals [][]byte
+	err             error
+}
+
+type internalKV struct {
+	key []byte
+	val []byte
+}
+
+func (b *messageBatch) batch(name string) (*bleve.Batch, error) {
+	if batch := b.batches[name]; batch != nil {
+		return batch, nil
+	}
+	index, err := b.index.getPartition(name)
+	if err != nil {
+		return nil, err
+	}
+	batch := index.NewBatch()
+	b.batches[name] = batch
+	return batch, nil
+}
+
+// Index 写入消息，消息所在的分区不存在时创建
+func (b *messageBatch) Index(id string, msg *Message) error {
+	msg.ChannelKey = channelKey(msg.ChannelId, msg.ChannelType)
+	batch, err := b.batch(b.index.partitionOf(msg.Timestamp))
+	if err != nil {
+		b.err = err
+		return err
+	}
+	return batch.Index(id, msg)
+}
+
+// Delete 在所有分区中删除消息
+func (b *messageBatch) Delete(id string) {
+	b.deletes = append(b.deletes, id)
+}
+
+// SetInternal 写入最新的分区，并从其他分区中删除
+func (b *messageBatch) SetInternal(key, val []byte) {
+	b.internals = append(b.internals, internalKV{key: key, val: val})
+}
+
+// DeleteInternal 在所有分区中删除
+func (b *messageBatch) DeleteInternal(key []byte) {
+	b.deleteInternals = append(b.deleteInternals, key)
+}
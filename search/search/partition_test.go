@@ -0,0 +1,167 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+func TestPartitionOf(t *testing.T) {
+	unix := func(year int, month time.Month, day, hour int) uint32 {
+		return uint32(time.Date(year, month, day, hour, 0, 0, 0, time.UTC).Unix())
+	}
+	tests := []struct {
+		name      string
+		legacy    bool
+		timestamp uint32
+		want      string
+	}{
+		{"first second of month", false, unix(2024, 1, 1, 0), "202401"},
+		{"last hour of month", false, unix(2024, 1, 31, 23), "202401"},
+		{"leap day", false, unix(2024, 2, 29, 12), "202402"},
+		{"end of year", false, unix(2023, 12, 31, 23), "202312"},
+		{"no timestamp uses now", false, 0, time.Now().UTC().Format(partitionLayout)},
+		{"legacy index has one partition", true, unix(2024, 1, 1, 0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &messageIndex{legacy: tt.legacy}
+			if got := m.partitionOf(tt.timestamp); got != tt.want {
+				t.Errorf("partitionOf() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageBatchRouting(t *testing.T) {
+	index, err := createMessageIndexDir(t.TempDir(), bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	messages := []*Message{
+		{MessageIdStr: "1", ChannelId: "c", ChannelType: 2, Timestamp: uint32(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC).Unix())},
+		{MessageIdStr: "2", ChannelId: "c", ChannelType: 2, Timestamp: uint32(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC).Unix())},
+		{MessageIdStr: "3", ChannelId: "c", ChannelType: 2, Timestamp: uint32(time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC).Unix())},
+	}
+	key := channelCheckpointKey("c", 2)
+	batch := index.NewBatch()
+	for _, m := range messages {
+		if err = batch.Index(m.MessageIdStr, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch.SetInternal(key, encodeMessageSeq(3))
+	if err = index.Batch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// 创建索引时已有当前月份的分区
+	current := index.partitionOf(0)
+	if got, want := index.partitionNames(), []string{"202401", "202403", current}; !reflect.DeepEqual(got, want) {
+		t.Errorf("partitionNames() = %v, want %v", got, want)
+	}
+	for name, want := range map[string]uint64{"202401": 1, "202403": 2} {
+		partition, err := index.getPartition(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, _ := partition.DocCount(); count != want {
+			t.Errorf("partition %s DocCount() = %d, want %d", name, count, want)
+		}
+	}
+	// 检查点写入最新的分区
+	latest, _ := index.getPartition("202403")
+	if data, _ := latest.GetInternal(key); len(data) != 8 || decodeMessageSeq(data) != 3 {
+		t.Errorf("checkpoint is not in the latest partition")
+	}
+
+	// 删除在所有分区中执行
+	batch = index.NewBatch()
+	batch.Delete("1")
+	batch.Delete("3")
+	batch.DeleteInternal(key)
+	if err = index.Batch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := index.alias.DocCount(); count != 1 {
+		t.Errorf("DocCount() = %d, want 1", count)
+	}
+	if _, ok, _ := index.checkpoint(key); ok {
+		t.Errorf("checkpoint is not deleted")
+	}
+}
+
+func TestMessageBatchCheckpointRewind(t *testing.T) {
+	index, err := createMessageIndexDir(t.TempDir(), bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	key := channelCheckpointKey("c", 2)
+	write := func(m *Message, seq uint64) {
+		batch := index.NewBatch()
+		if m != nil {
+			if err := batch.Index(m.MessageIdStr, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		batch.SetInternal(key, encodeMessageSeq(seq))
+		if err := index.Batch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 检查点保存在旧的分区中，之后其他频道的消息创建了新的分区
+	write(&Message{MessageIdStr: "1", ChannelId: "c", ChannelType: 2, Timestamp: uint32(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC).Unix())}, 10)
+	other := index.NewBatch()
+	if err = other.Index("2", &Message{MessageIdStr: "2", ChannelId: "d", ChannelType: 2, Timestamp: uint32(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Batch(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回退检查点
+	write(nil, 4)
+	if seq, ok, err := index.checkpoint(key); err != nil || !ok || seq != 4 {
+		t.Errorf("checkpoint() = %d %v %v, want 4", seq, ok, err)
+	}
+	old, _ := index.getPartition("202401")
+	if data, _ := old.GetInternal(key); len(data) != 0 {
+		t.Errorf("checkpoint is left in the old partition")
+	}
+
+	// 写入旧分区的消息同样只保留一个检查点
+	write(&Message{MessageIdStr: "3", ChannelId: "c", ChannelType: 2, Timestamp: uint32(time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC).Unix())}, 3)
+	if seq, ok, err := index.checkpoint(key); err != nil || !ok || seq != 3 {
+		t.Errorf("checkpoint() = %d %v %v, want 3", seq, ok, err)
+	}
+}
+
+func TestEmptyMessageIndex(t *testing.T) {
+	s := newTestSearch(t)
+	// 新建的索引和删除了所有分区的索引都可以查询
+	if got := searchTestContent(t, s, "release"); len(got) != 0 {
+		t.Errorf("search = %v, want none", got)
+	}
+	for _, name := range s.activeIndex.partitionNames() {
+		if err := s.activeIndex.dropPartition(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.activeIndex.partitionNames(); len(got) != 1 {
+		t.Errorf("partitionNames() = %v, want the current month", got)
+	}
+	if got := searchTestContent(t, s, "release"); len(got) != 0 {
+		t.Errorf("search = %v, want none", got)
+	}
+	SetRetentionOptions(RetentionOptions{Days: 30})
+	defer SetRetentionOptions(RetentionOptions{})
+	if _, err := s.CleanupRetention(); err != nil {
+		t.Errorf("CleanupRetention() error = %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package search
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/tidwall/gjson"
+)
+
+// 内置的解码器
+const (
+	DecoderBase64Json = "base64_json" // base64编码的JSON
+	DecoderText       = "text"        // 纯文本，转换为文本消息 {"type":1,"content":"..."}
+)
+
+// 消息不被索引的原因
+const (
+	SkipRemoved            = "removed"             // 已撤回或删除
+	SkipExpired            = "expired"             // 超过保留时间
+	SkipEmptyPayload       = "empty_payload"       // 消息内容为空
+	SkipUnsupportedPayload = "unsupported_payload" // 不是JSON，也没有匹配的解码器
+	SkipDecodeFailed       = "decode_failed"       // 匹配的解码器都解码失败
+)
+
+// 文本消息的类型(payload.type)
+const textPayloadType = 1
+
+// 消息内容的解码器，把不是JSON的消息内容转换为可以索引的JSON
+type PayloadDecoder struct {
+	Name   string                               // 名称，同名的解码器会被替换
+	Match  func(m *pluginproto.Message) bool    // 匹配规则，为nil时匹配所有消息
+	Decode func(payload []byte) ([]byte, error) // 解码，返回的内容必须是JSON对象
+}
+
+var (
+	payloadDecodersLock sync.RWMutex
+	payloadDecoders     []PayloadDecoder // 注册的解码器，按注册顺序匹配
+	enabledDecoders     []string         // 启用的解码器，为空时启用所有注册的解码器
+)
+
+// RegisterPayloadDecoder 注册解码器，不是JSON的消息内容按顺序使用第一个匹配且解码成功的解码器
+func RegisterPayloadDecoder(decoder PayloadDecoder) error {
+	if decoder.Name == "" {
+		return fmt.Errorf("decoder name is empty")
+	}
+	if decoder.Decode == nil {
+		return fmt.Errorf("decoder %s has no decode func", decoder.Name)
+	}
+	payloadDecodersLock.Lock()
+	defer payloadDecodersLock.Unlock()
+	for i, d := range payloadDecoders {
+		if d.Name == decoder.Name {
+			payloadDecoders[i] = decoder
+			return nil
+		}
+	}
+	payloadDecoders = append(payloadDecoders, decoder)
+	return nil
+}
+
+// SetPayloadDecoders 设置启用的解码器和使用顺序，为空时按注册顺序使用所有解码器
+func SetPayloadDecoders(names []string) error {
+	payloadDecodersLock.Lock()
+	defer payloadDecodersLock.Unlock()
+	for _, name := range names {
+		if findPayloadDecoder(name) == nil {
+			return fmt.Errorf("unknown payload decoder: %s", name)
+		}
+	}
+	enabledDecoders = names
+	return nil
+}
+
+// 调用时需持有payloadDecodersLock
+func findPayloadDecoder(name string) *PayloadDecoder {
+	for i := range payloadDecoders {
+		if payloadDecoders[i].Name == name {
+			return &payloadDecoders[i]
+		}
+	}
+	return nil
+}
+
+func getPayloadDecoders() []PayloadDecoder {
+	payloadDecodersLock.RLock()
+	defer payloadDecodersLock.RUnlock()
+	if len(enabledDecoders) == 0 {
+		return append([]PayloadDecoder(nil), payloadDecoders...)
+	}
+	decoders := make([]PayloadDecoder, 0, len(enabledDecoders))
+	for _, name := range enabledDecoders {
+		if d := findPayloadDecoder(name); d != nil {
+			decoders = append(decoders, *d)
+		}
+	}
+	return decoders
+}
+
+// MatchTopic 匹配指定topic的消息
+func MatchTopic(topics ...string) func(m *pluginproto.Message) bool {
+	return func(m *pluginproto.Message) bool {
+		for _, topic := range topics {
+			if m.Topic == topic {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchPayloadPrefix 匹配消息内容以prefix开头的消息，例如自定义二进制消息的类型标识
+func MatchPayloadPrefix(prefix []byte) func(m *pluginproto.Message) bool {
+	return func(m *pluginproto.Message) bool {
+		return bytes.HasPrefix(m.Payload, prefix)
+	}
+}
+
+// 解码消息内容，返回可以索引的JSON，不能索引时返回原因
+func decodePayload(m *pluginproto.Message) ([]byte, string) {
+	if len(bytes.TrimSpace(m.Payload)) == 0 {
+		return nil, SkipEmptyPayload
+	}
+	if isJsonObject(m.Payload) {
+		return m.Payload, ""
+	}
+	matched := false
+	for _, decoder := range getPayloadDecoders() {
+		if decoder.Match != nil && !decoder.Match(m) {
+			continue
+		}
+		matched = true
+		payload, err := decoder.Decode(m.Payload)
+		if err == nil && isJsonObject(payload) {
+			return payload, ""
+		}
+	}
+	if matched {
+		return nil, SkipDecodeFailed
+	}
+	return nil, SkipUnsupportedPayload
+}
+
+// 只索引JSON对象，其他JSON值（字符串、数字等）需要解码
+func isJsonObject(data []byte) bool {
+	return gjson.ValidBytes(data) && gjson.ParseBytes(data).IsObject()
+}
+
+// base64编码的JSON
+func decodeBase64Json(payload []byte) ([]byte, error) {
+	payload = bytes.TrimSpace(payload)
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+	n, err := base64.StdEncoding.Decode(data, payload)
+	if err != nil {
+		return nil, err
+	}
+	data = data[:n]
+	if !isJsonObject(data) {
+		return nil, fmt.Errorf("payload is not base64 json")
+	}
+	return data, nil
+}
+
+// 纯文本转换为文本消息，包含控制字符的认为是二进制内容
+func decodeText(payload []byte) ([]byte, error) {
+	if !utf8.Valid(payload) {
+		return nil, fmt.Errorf("payload is not utf8 text")
+	}
+	for _, r := range string(payload) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return nil, fmt.Errorf("payload is not text")
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":    textPayloadType,
+		"content": string(payload),
+	})
+}
+
+func init() {
+	RegisterPayloadDecoder(PayloadDecoder{Name: DecoderBase64Json, Decode: decodeBase64Json})
+	RegisterPayloadDecoder(PayloadDecoder{Name: DecoderText, Decode: decodeText})
+}
@@ -0,0 +1,120 @@
+package search
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestDecodePayload(t *testing.T) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name       string
+		payload    string
+		want       string
+		wantReason string
+	}{
+		{"json object", `{"type":1,"content":"hi"}`, `{"type":1,"content":"hi"}`, ""},
+		{"empty", "", "", SkipEmptyPayload},
+		{"blank", " \n ", "", SkipEmptyPayload},
+		{"base64 json", b64(`{"type":1,"content":"hi"}`), `{"type":1,"content":"hi"}`, ""},
+		{"plain text", "hello world", `{"content":"hello world","type":1}`, ""},
+		{"json string is text", `"hi"`, `{"content":"\"hi\"","type":1}`, ""},
+		{"binary", "\x00\x01\x02", "", SkipDecodeFailed},
+		{"invalid utf8", "\xff\xfe", "", SkipDecodeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := decodePayload(&pluginproto.Message{Payload: []byte(tt.payload)})
+			if reason != tt.wantReason {
+				t.Fatalf("decodePayload() reason = %q, want %q", reason, tt.wantReason)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodePayload() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePayloadEnabledDecoders(t *testing.T) {
+	defer SetPayloadDecoders(nil)
+	tests := []struct {
+		name       string
+		decoders   []string
+		payload    string
+		wantReason string
+	}{
+		{"text only", []string{DecoderText}, "hello", ""},
+		{"base64 only rejects text", []string{DecoderBase64Json}, "hello", SkipDecodeFailed},
+		{"empty enables all", []string{}, "hello", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetPayloadDecoders(tt.decoders); err != nil {
+				t.Fatal(err)
+			}
+			if _, reason := decodePayload(&pluginproto.Message{Payload: []byte(tt.payload)}); reason != tt.wantReason {
+				t.Errorf("decodePayload() reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+	if err := SetPayloadDecoders([]string{"unknown"}); err == nil {
+		t.Errorf("SetPayloadDecoders() accepted an unknown decoder")
+	}
+}
+
+func TestDecodePayloadMatch(t *testing.T) {
+	const name = "test_topic"
+	err := RegisterPayloadDecoder(PayloadDecoder{
+		Name:  name,
+		Match: MatchTopic("custom"),
+		Decode: func(payload []byte) ([]byte, error) {
+			return []byte(fmt.Sprintf(`{"type":1,"content":"%x"}`, payload)), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetPayloadDecoders([]string{name}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPayloadDecoders(nil)
+
+	tests := []struct {
+		topic      string
+		want       string
+		wantReason string
+	}{
+		{"custom", `{"type":1,"content":"0102"}`, ""},
+		{"other", "", SkipUnsupportedPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got, reason := decodePayload(&pluginproto.Message{Topic: tt.topic, Payload: []byte{1, 2}})
+			if reason != tt.wantReason || string(got) != tt.want {
+				t.Errorf("decodePayload() = %s %q, want %s %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestRegisterPayloadDecoderInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoder PayloadDecoder
+	}{
+		{"no name", PayloadDecoder{Decode: decodeText}},
+		{"no decode func", PayloadDecoder{Name: "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RegisterPayloadDecoder(tt.decoder); err == nil {
+				t.Errorf("RegisterPayloadDecoder() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// 请求参数错误，http接口返回4xx
+type BadRequestError struct {
+	msg string
+}
+
+func newBadRequest(format string, args ...interface{}) *BadRequestError {
+	return &BadRequestError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *BadRequestError) Error() string {
+	return e.msg
+}
+
+// IsBadRequest 是否是请求参数错误
+func IsBadRequest(err error) bool {
+	var e *BadRequestError
+	return errors.As(err, &e)
+}
+
+// 查询语句中默认搜索的字段
+const queryDefaultField = "payload.content"
+
+// 查询语句中的字段别名 -> 索引字段
+var queryFieldAliases = map[string]string{
+	"from":            "from_uid",
+	"from_uid":        "from_uid",
+	"topic":           "topic",
+	"content":         "payload.content",
+	"payload.content": "payload.content",
+	"timestamp":       "timestamp",
+	"time":            "timestamp",
+	"date":            "timestamp",
+	"after":           "timestamp",
+	"before":          "timestamp",
+	"has":             "kinds",
+	"ext":             "file_ext",
+	"file":            "file_name",
+	"domain":          "url_hosts",
+	"site":            "url_hosts",
+	"lang":            "lang",
+}
+
+// 不分词的字段，has/ext/domain/lang的值不区分大小写
+var queryKeywordFields = map[string]bool{
+	"from_uid":  true,
+	"kinds":     true,
+	"file_ext":  true,
+	"url_hosts": true,
+	"lang":      true,
+}
+
+// ParseQueryString 解析查询语句，支持的语法：
+//
+//	release notes        同时包含两个词（默认AND）
+//	release OR notes     包含任意一个词
+//	"release notes"      短语
+//	-draft / NOT draft   排除
+//	rel*                 前缀匹配
+//	(a OR b) c           分组
+//	from:alice topic:x content:y
+//	has:file has:link ext:pdf file:report domain:github.com lang:en
+//	after:2024-01-01 before:2024-02-01 date:2024-01-01 timestamp:>=1700000000
+//
+// 没有使用引号和通配符的词按照opts的方式匹配
+func ParseQueryString(q string, opts MatchOptions) (query.Query, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens, opts: opts}
+	result, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return result, nil
+}
+
+type queryTokenType int
+
+const (
+	tokenWord queryTokenType = iota
+	tokenPhrase
+	tokenField
+	tokenLParen
+	tokenRParen
+	tokenMinus
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type queryToken struct {
+	typ  queryTokenType
+	text string
+	pos  int
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	runes := []rune(q)
+	tokens := make([]queryToken, 0)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{typ: tokenLParen, text: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{typ: tokenRParen, text: ")", pos: i})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{typ: tokenMinus, text: "-", pos: i})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end >= len(runes) {
+				return nil, newBadRequest("query syntax error at %d: unclosed quote", i)
+			}
+			tokens = append(tokens, queryToken{typ: tokenPhrase, text: string(runes[i+1 : end]), pos: i})
+			i = end + 1
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != '"' {
+				if runes[i] == ':' {
+					if _, ok := queryFieldAliases[strings.ToLower(string(runes[start:i]))]; ok {
+						break
+					}
+				}
+				i++
+			}
+			text := string(runes[start:i])
+			if i < len(runes) && runes[i] == ':' {
+				tokens = append(tokens, queryToken{typ: tokenField, text: strings.ToLower(text), pos: start})
+				i++
+				continue
+			}
+			switch text {
+			case "AND":
+				tokens = append(tokens, queryToken{typ: tokenAnd, text: text, pos: start})
+			case "OR":
+				tokens = append(tokens, queryToken{typ: tokenOr, text: text, pos: start})
+			case "NOT":
+				tokens = append(tokens, queryToken{typ: tokenNot, text: text, pos: start})
+			default:
+				tokens = append(tokens, queryToken{typ: tokenWord, text: text, pos: start})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	opts   MatchOptions
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	pos := -1
+	if !p.eof() {
+		pos = p.peek().pos
+	}
+	if pos < 0 {
+		return newBadRequest("query syntax error at end: %s", fmt.Sprintf(format, args...))
+	}
+	return newBadRequest("query syntax error at %d: %s", pos, fmt.Sprintf(format, args...))
+}
+
+// orExpr := andExpr ("OR" andExpr)*
+func (p *queryParser) parseOr(field string) (query.Query, error) {
+	first, err := p.parseAnd(field)
+	if err != nil {
+		return nil, err
+	}
+	queries := []query.Query{first}
+	for !p.eof() && p.peek().typ == tokenOr {
+		p.pos++
+		next, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, next)
+	}
+	if len(queries) == 1 {
+		return first, nil
+	}
+	return bleve.NewDisjunctionQuery(queries...), nil
+}
+
+// andExpr := unary (["AND"] unary)*
+func (p *queryParser) parseAnd(field string) (query.Query, error) {
+	must := make([]query.Query, 0)
+	mustNot := make([]query.Query, 0)
+	for !p.eof() {
+		tok := p.peek()
+		if tok.typ == tokenOr || tok.typ == tokenRParen {
+			break
+		}
+		if tok.typ == tokenAnd {
+			if len(must) == 0 && len(mustNot) == 0 {
+				return nil, p.errorf("unexpected AND")
+			}
+			p.pos++
+			if p.eof() {
+				return nil, p.errorf("missing term after AND")
+			}
+			continue
+		}
+		q, negate, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			mustNot = append(mustNot, q)
+		} else {
+			must = append(must, q)
+		}
+	}
+	if len(must) == 0 && len(mustNot) == 0 {
+		if !p.eof() {
+			return nil, p.errorf("unexpected %q", p.peek().text)
+		}
+		return nil, p.errorf("missing term")
+	}
+	if len(mustNot) == 0 {
+		if len(must) == 1 {
+			return must[0], nil
+		}
+		return bleve.NewConjunctionQuery(must...), nil
+	}
+	boolQuery := bleve.NewBooleanQuery()
+	if len(must) == 0 {
+		// 只有排除条件时，从所有消息中排除
+		boolQuery.AddMust(bleve.NewMatchAllQuery())
+	} else {
+		boolQuery.AddMust(must...)
+	}
+	boolQuery.AddMustNot(mustNot...)
+	return boolQuery, nil
+}
+
+// unary := ("-" | "NOT") unary | primary
+func (p *queryParser) parseUnary(field string) (query.Query, bool, error) {
+	tok := p.peek()
+	if tok.typ == tokenMinus || tok.typ == tokenNot {
+		p.pos++
+		if p.eof() {
+			return nil, false, p.errorf("missing term after %s", tok.text)
+		}
+		q, negate, err := p.parseUnary(field)
+		if err != nil {
+			return nil, false, err
+		}
+		return q, !negate, nil
+	}
+	q, err := p.parsePrimary(field)
+	return q, false, err
+}
+
+// primary := "(" orExpr ")" | field ":" primary | word | phrase
+func (p *queryParser) parsePrimary(field string) (query.Query, error) {
+	tok := p.peek()
+	switch tok.typ {
+	case tokenLParen:
+		p.pos++
+		if p.eof() {
+			return nil, p.errorf("unclosed parenthesis")
+		}
+		q, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if p.eof() || p.peek().typ != tokenRParen {
+			return nil, p.errorf("unclosed parenthesis")
+		}
+		p.pos++
+		return q, nil
+	case tokenField:
+		if field != "" {
+			return nil, p.errorf("nested field %q", tok.text)
+		}
+		p.pos++
+		if p.eof() {
+			return nil, p.errorf("missing value for field %q", tok.text)
+		}
+		next := p.peek()
+		if next.typ == tokenLParen {
+			if queryFieldAliases[tok.text] == "timestamp" {
+				return nil, p.errorf("field %q does not support groups", tok.text)
+			}
+			return p.parsePrimary(tok.text)
+		}
+		if next.typ != tokenWord && next.typ != tokenPhrase {
+			return nil, p.errorf("missing value for field %q", tok.text)
+		}
+		p.pos++
+		q, err := buildFieldQuery(tok.text, next, p.opts)
+		if err != nil {
+			return nil, newBadRequest("query syntax error at %d: %s", next.pos, err.Error())
+		}
+		return q, nil
+	case tokenWord, tokenPhrase:
+		p.pos++
+		q, err := buildFieldQuery(field, tok, p.opts)
+		if err != nil {
+			return nil, newBadRequest("query syntax error at %d: %s", tok.pos, err.Error())
+		}
+		return q, nil
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+// 根据字段生成查询
+func buildFieldQuery(alias string, tok queryToken, opts MatchOptions) (query.Query, error) {
+	field := queryDefaultField
+	if alias != "" {
+		field = queryFieldAliases[alias]
+	}
+	value := tok.text
+	if strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+
+	if field == "timestamp" {
+		return buildTimeQuery(alias, value)
+	}
+
+	prefix := false
+	if tok.typ == tokenWord {
+		if strings.HasSuffix(value, "*") {
+			prefix = true
+			value = strings.TrimSuffix(value, "*")
+		}
+		if value == "" || strings.Contains(value, "*") {
+			return nil, fmt.Errorf("only prefix wildcard is supported: %q", tok.text)
+		}
+	}
+
+	// from_uid 区分大小写，其他字段索引的词都是小写
+	if field != "from_uid" && (prefix || queryKeywordFields[field]) {
+		value = strings.ToLower(value)
+	}
+	if field == "file_ext" {
+		value = strings.TrimPrefix(value, ".")
+	}
+
+	if prefix {
+		return withContentVariants(field, value, MatchOptions{Mode: MatchPrefix}, func(field string) query.Query {
+			q := bleve.NewPrefixQuery(value)
+			q.SetField(field)
+			return q
+		}), nil
+	}
+
+	// 不分词的字段精确匹配
+	if queryKeywordFields[field] {
+		q := bleve.NewTermQuery(value)
+		q.SetField(field)
+		return q, nil
+	}
+
+	if tok.typ == tokenPhrase {
+		return newMatchPhraseQuery(field, value, 1), nil
+	}
+	return withContentVariants(field, value, opts, func(field string) query.Query {
+		if opts.Mode == MatchDefault {
+			return newMatchQuery(field, value, 1)
+		}
+		return buildMatchQuery(field, value, opts)
+	}), nil
+}
+
+// 时间查询，值可以是unix时间戳(秒)、日期(2006-01-02，UTC)或RFC3339时间
+//
+//	after:X  timestamp >= X
+//	before:X timestamp < X
+//	date:D   D这一天
+//	timestamp:>X timestamp:>=X timestamp:<X timestamp:<=X timestamp:X
+func buildTimeQuery(alias string, value string) (query.Query, error) {
+	op := ""
+	switch alias {
+	case "after":
+		op = ">="
+	case "before":
+		op = "<"
+	default:
+		for _, o := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(value, o) {
+				op = o
+				value = strings.TrimPrefix(value, o)
+				break
+			}
+		}
+	}
+
+	start, end, err := parseQueryTime(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var min, max *float64
+	inclusive := true
+	exclusive := false
+	var minInclusive, maxInclusive *bool
+	switch op {
+	case ">=":
+		min, minInclusive = &start, &inclusive
+	case ">":
+		min, minInclusive = &end, &inclusive
+	case "<":
+		max, maxInclusive = &start, &exclusive
+	case "<=":
+		max, maxInclusive = &end, &exclusive
+	default:
+		min, minInclusive = &start, &inclusive
+		max, maxInclusive = &end, &exclusive
+	}
+	q := bleve.NewNumericRangeInclusiveQuery(min, max, minInclusive, maxInclusive)
+	q.SetField("timestamp")
+	return q, nil
+}
+
+// 解析时间，返回时间区间[start, end)
+func parseQueryTime(value string) (float64, float64, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return float64(ts), float64(ts + 1), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return float64(t.Unix()), float64(t.AddDate(0, 0, 1).Unix()), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return float64(t.Unix()), float64(t.Unix() + 1), nil
+	}
+	return 0, 0, fmt.Errorf("invalid time: %q", value)
+}
@@ -0,0 +1,126 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+func TestLexQuery(t *testing.T) {
+	tests := []struct {
+		q     string
+		want  []queryTokenType
+		texts []string
+	}{
+		{`release notes`, []queryTokenType{tokenWord, tokenWord}, []string{"release", "notes"}},
+		{`"release notes" OR x`, []queryTokenType{tokenPhrase, tokenOr, tokenWord}, []string{"release notes", "OR", "x"}},
+		{`-draft NOT y`, []queryTokenType{tokenMinus, tokenWord, tokenNot, tokenWord}, []string{"-", "draft", "NOT", "y"}},
+		{`(a AND b)`, []queryTokenType{tokenLParen, tokenWord, tokenAnd, tokenWord, tokenRParen}, []string{"(", "a", "AND", "b", ")"}},
+		{`From:alice`, []queryTokenType{tokenField, tokenWord}, []string{"from", "alice"}},
+		{`http://a.com`, []queryTokenType{tokenWord}, []string{"http://a.com"}},
+		{`a - b`, []queryTokenType{tokenWord, tokenWord, tokenWord}, []string{"a", "-", "b"}},
+		{`or and`, []queryTokenType{tokenWord, tokenWord}, []string{"or", "and"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			tokens, err := lexQuery(tt.q)
+			if err != nil {
+				t.Fatalf("lexQuery() error = %v", err)
+			}
+			types := make([]queryTokenType, 0, len(tokens))
+			texts := make([]string, 0, len(tokens))
+			for _, tok := range tokens {
+				types = append(types, tok.typ)
+				texts = append(texts, tok.text)
+			}
+			if !reflect.DeepEqual(types, tt.want) || !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("lexQuery() = %v %q, want %v %q", types, texts, tt.want, tt.texts)
+			}
+		})
+	}
+}
+
+func TestParseQueryString(t *testing.T) {
+	tests := []struct {
+		q    string
+		want query.Query
+	}{
+		{`from:alice`, &query.TermQuery{}},
+		{`has:FILE`, &query.TermQuery{}},
+		{`a OR b`, &query.DisjunctionQuery{}},
+		{`a b`, &query.ConjunctionQuery{}},
+		{`a AND b`, &query.ConjunctionQuery{}},
+		{`a -b`, &query.BooleanQuery{}},
+		{`NOT b`, &query.BooleanQuery{}},
+		{`"release notes"`, &query.MatchPhraseQuery{}},
+		{`after:2024-01-01`, &query.NumericRangeQuery{}},
+		{`from:(alice OR bob)`, &query.DisjunctionQuery{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got, err := ParseQueryString(tt.q, MatchOptions{})
+			if err != nil {
+				t.Fatalf("ParseQueryString() error = %v", err)
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("ParseQueryString() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryStringField(t *testing.T) {
+	tests := []struct {
+		q         string
+		wantField string
+		wantTerm  string
+	}{
+		{`from:Alice`, "from_uid", "Alice"},
+		{`has:FILE`, "kinds", "file"},
+		{`ext:.PDF`, "file_ext", "pdf"},
+		{`domain:GitHub.com`, "url_hosts", "github.com"},
+		{`lang:EN`, "lang", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got, err := ParseQueryString(tt.q, MatchOptions{})
+			if err != nil {
+				t.Fatalf("ParseQueryString() error = %v", err)
+			}
+			term, ok := got.(*query.TermQuery)
+			if !ok {
+				t.Fatalf("ParseQueryString() = %T, want *query.TermQuery", got)
+			}
+			if term.Field() != tt.wantField || term.Term != tt.wantTerm {
+				t.Errorf("ParseQueryString() = %s:%s, want %s:%s", term.Field(), term.Term, tt.wantField, tt.wantTerm)
+			}
+		})
+	}
+}
+
+func TestParseQueryStringError(t *testing.T) {
+	tests := []string{
+		``,
+		`"unclosed`,
+		`(a OR b`,
+		`a)`,
+		`AND a`,
+		`a AND`,
+		`a OR`,
+		`NOT`,
+		`from:`,
+		`from:(a from:b)`,
+		`a*b`,
+		`after:(a OR b)`,
+		`after:yesterday`,
+	}
+	for _, q := range tests {
+		t.Run(q, func(t *testing.T) {
+			_, err := ParseQueryString(q, MatchOptions{})
+			if !IsBadRequest(err) {
+				t.Errorf("ParseQueryString() error = %v, want BadRequestError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk"
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"go.uber.org/zap"
+)
+
+type ReindexStatus string
+
+const (
+	ReindexStatusRunning  ReindexStatus = "running"  // 进行中
+	ReindexStatusPaused   ReindexStatus = "paused"   // 已暂停
+	ReindexStatusCanceled ReindexStatus = "canceled" // 已取消
+	ReindexStatusFinished ReindexStatus = "finished" // 已完成
+)
+
+var (
+	ErrReindexRunning    = errors.New("reindex is running")
+	ErrReindexNotRunning = errors.New("reindex is not running")
+)
+
+// 重建索引时每次拉取的消息数量
+const reindexPullLimit = 500
+
+type ReindexReq struct {
+	ChannelId   string                 `json:"channel_id"`   // 重建单个频道
+	ChannelType uint8                  `json:"channel_type"` // 频道类型
+	Channels    []*pluginproto.Channel `json:"channels"`     // 重建多个频道
+	All         bool                   `json:"all"`          // 重建本节点所有已索引过的频道（只包含当前节点，集群中需要对每个节点调用）
+	Uids        []string               `json:"uids"`         // All为true时，额外重建这些用户会话中的频道（用于安装插件前已有的历史消息）
+}
+
+type ReindexProgress struct {
+	Status          ReindexStatus `json:"status"`           // 状态
+	TotalChannels   int           `json:"total_channels"`   // 需要重建的频道数量
+	DoneChannels    int           `json:"done_channels"`    // 已完成的频道数量
+	IndexedMessages uint64        `json:"indexed_messages"` // 已索引的消息数量
+	Errors          int           `json:"errors"`           // 错误次数
+	LastError       string        `json:"last_error"`       // 最后一次错误
+	ChannelId       string        `json:"channel_id"`       // 正在重建的频道
+	ChannelType     uint8         `json:"channel_type"`     // 正在重建的频道类型
+	StartedAt       int64         `json:"started_at"`       // 开始时间
+	FinishedAt      int64         `json:"finished_at"`      // 结束时间
+}
+
+type reindexTask struct {
+	s        *Search
+	channels []*pluginproto.Channel
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	progress ReindexProgress
+	pending  map[string]struct{} // 还未重建完成的频道
+}
+
+func newReindexTask(s *Search, channels []*pluginproto.Channel) *reindexTask {
+	t := &reindexTask{
+		s:        s,
+		channels: channels,
+		pending:  make(map[string]struct{}, len(channels)),
+		progress: ReindexProgress{
+			Status:        ReindexStatusRunning,
+			TotalChannels: len(channels),
+			StartedAt:     time.Now().Unix(),
+		},
+	}
+	t.cond = sync.NewCond(&t.mu)
+	for _, channel := range channels {
+		t.pending[channelKey(channel.ChannelId, uint8(channel.ChannelType))] = struct{}{}
+	}
+	return t
+}
+
+// StartReindex 开始重建索引，同一时间只能有一个重建任务
+func (s *Search) StartReindex(req ReindexReq) (ReindexProgress, error) {
+	s.reindexLock.Lock()
+	defer s.reindexLock.Unlock()
+
+	if s.stopping() {
+		return ReindexProgress{}, ErrStopped
+	}
+	if s.reindex != nil && !s.reindex.finished() {
+		return s.reindex.getProgress(), ErrReindexRunning
+	}
+
+	channels, err := s.reindexChannels(req)
+	if err != nil {
+		return ReindexProgress{}, err
+	}
+	if len(channels) == 0 {
+		return ReindexProgress{}, fmt.Errorf("no channel to reindex")
+	}
+	s.reindex = newReindexTask(s, channels)
+	s.goTask(s.reindex.run)
+
+	s.Info("start reindex", zap.Int("channels", len(channels)))
+
+	return s.reindex.getProgress(), nil
+}
+
+// ReindexProgress 获取重建索引的进度
+func (s *Search) ReindexProgress() (ReindexProgress, error) {
+	s.reindexLock.Lock()
+	defer s.reindexLock.Unlock()
+	if s.reindex == nil {
+		return ReindexProgress{}, ErrReindexNotRunning
+	}
+	return s.reindex.getProgress(), nil
+}
+
+// PauseReindex 暂停重建索引
+func (s *Search) PauseReindex() (ReindexProgress, error) {
+	return s.setReindexStatus(ReindexStatusRunning, ReindexStatusPaused)
+}
+
+// ResumeReindex 继续重建索引
+func (s *Search) ResumeReindex() (ReindexProgress, error) {
+	return s.setReindexStatus(ReindexStatusPaused, ReindexStatusRunning)
+}
+
+// CancelReindex 取消重建索引，已重建的频道不会回滚
+func (s *Search) CancelReindex() (ReindexProgress, error) {
+	return s.setReindexStatus("", ReindexStatusCanceled)
+}
+
+func (s *Search) setReindexStatus(from, to ReindexStatus) (ReindexProgress, error) {
+	s.reindexLock.Lock()
+	defer s.reindexLock.Unlock()
+	if s.reindex == nil || s.reindex.finished() {
+		return ReindexProgress{}, ErrReindexNotRunning
+	}
+	t := s.reindex
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if from != "" && t.progress.Status != from {
+		return t.progress, fmt.Errorf("reindex is %s", t.progress.Status)
+	}
+	t.progress.Status = to
+	t.cond.Broadcast()
+	return t.progress, nil
+}
+
+// 频道是否正在等待重建索引，重建中的频道由重建任务负责索引
+func (s *Search) isReindexing(channelId string, channelType uint8) bool {
+	s.reindexLock.Lock()
+	t := s.reindex
+	s.reindexLock.Unlock()
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress.Status == ReindexStatusCanceled || t.progress.Status == ReindexStatusFinished {
+		return false
+	}
+	_, ok := t.pending[channelKey(channelId, channelType)]
+	return ok
+}
+
+// 获取需要重建索引的频道
+func (s *Search) reindexChannels(req ReindexReq) ([]*pluginproto.Channel, error) {
+	channels := make([]*pluginproto.Channel, 0, len(req.Channels)+1)
+	exists := make(map[string]struct{})
+	add := func(channelId string, channelType uint8) bool {
+		key := channelKey(channelId, channelType)
+		if _, ok := exists[key]; ok {
+			return true
+		}
+		exists[key] = struct{}{}
+		channels = append(channels, &pluginproto.Channel{
+			ChannelId:   channelId,
+			ChannelType: uint32(channelType),
+		})
+		return true
+	}
+
+	if req.ChannelId != "" {
+		add(req.ChannelId, req.ChannelType)
+	}
+	for _, channel := range req.Channels {
+		add(channel.ChannelId, uint8(channel.ChannelType))
+	}
+	if !req.All {
+		return channels, nil
+	}
+
+	if err := s.db.rangeIndexedChannels(add); err != nil {
+		return nil, err
+	}
+	if err := s.db.rangePendingIndex(add); err != nil {
+		return nil, err
+	}
+	for _, uid := range req.Uids {
+		resp, err := pdk.S.ConversationChannels(uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range resp.Channels {
+			add(channel.ChannelId, uint8(channel.ChannelType))
+		}
+	}
+	return channels, nil
+}
+
+func (t *reindexTask) run() {
+	for _, channel := range t.channels {
+		if !t.waitRunning() {
+			break
+		}
+		t.reindexChannel(channel.ChannelId, uint8(channel.ChannelType))
+	}
+
+	t.mu.Lock()
+	if t.progress.Status != ReindexStatusCanceled {
+		t.progress.Status = ReindexStatusFinished
+	}
+	t.progress.ChannelId = ""
+	t.progress.ChannelType = 0
+	t.progress.FinishedAt = time.Now().Unix()
+	progress := t.progress
+	t.mu.Unlock()
+
+	t.s.Info("reindex end", zap.String("status", string(progress.Status)), zap.Int("doneChannels", progress.DoneChannels), zap.Uint64("indexedMessages", progress.IndexedMessages), zap.Int("errors", progress.Errors))
+}
+
+func (t *reindexTask) reindexChannel(channelId string, channelType uint8) {
+	t.mu.Lock()
+	t.progress.ChannelId = channelId
+	t.progress.ChannelType = channelType
+	t.mu.Unlock()
+
+	// 无论成功与否，交还给bucket继续索引新消息
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, channelKey(channelId, channelType))
+		t.mu.Unlock()
+		t.s.MakeIndex(channelId, channelType)
+	}()
+
+	err := t.s.resetChannelMaxMessageSeq(channelId, channelType)
+	if err != nil {
+		t.addError(channelId, channelType, err)
+		return
+	}
+	// 先删除频道已有的索引，已不存在或不再需要索引的消息不会残留
+	_, err = t.s.deleteMatched(newChannelsQuery([]*pluginproto.Channel{{ChannelId: channelId, ChannelType: uint32(channelType)}}, nil))
+	if err != nil {
+		t.addError(channelId, channelType, err)
+		return
+	}
+
+	b := t.s.bucketOf(channelId)
+	startSeq := uint64(1)
+	for {
+		if !t.waitRunning() {
+			return
+		}
+		// 服务端出错后退避
+		if delay := t.s.throttle.current(); delay > 0 && !t.s.sleep(delay) {
+			return
+		}
+		t.s.metrics.getMessagesRequests.Add(1)
+		resp, err := getChannelMessages(&pluginproto.ChannelMessageBatchReq{
+			ChannelMessageReqs: []*pluginproto.ChannelMessageReq{
+				{
+					ChannelId:       channelId,
+					ChannelType:     uint32(channelType),
+					StartMessageSeq: startSeq,
+					Limit:           reindexPullLimit,
+				},
+			},
+		})
+		if err != nil {
+			t.s.metrics.getMessagesErrors.Add(1)
+			t.s.throttle.failure()
+			t.addError(channelId, channelType, err)
+			return
+		}
+		t.s.throttle.success()
+		if len(resp.ChannelMessageResps) == 0 || len(resp.ChannelMessageResps[0].Messages) == 0 {
+			break
+		}
+		messages := resp.ChannelMessageResps[0].Messages
+		if err = b.buildIndex(channelId, channelType, startSeq-1, messages); err != nil {
+			t.addError(channelId, channelType, err)
+			return
+		}
+		lastMsg := messages[len(messages)-1]
+
+		t.mu.Lock()
+		t.progress.IndexedMessages += uint64(len(messages))
+		t.mu.Unlock()
+
+		if len(messages) < reindexPullLimit {
+			break
+		}
+		startSeq = lastMsg.MessageSeq + 1
+		t.s.sleep(time.Millisecond * 100) // 防止请求过快
+	}
+
+	t.mu.Lock()
+	t.progress.DoneChannels++
+	t.mu.Unlock()
+}
+
+// 暂停时阻塞，返回false表示任务已取消
+func (t *reindexTask) waitRunning() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.progress.Status == ReindexStatusPaused {
+		t.cond.Wait()
+	}
+	return t.progress.Status == ReindexStatusRunning
+}
+
+func (t *reindexTask) addError(channelId string, channelType uint8, err error) {
+	t.s.Error("reindex channel error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+	t.mu.Lock()
+	t.progress.Errors++
+	t.progress.LastError = fmt.Sprintf("%s:%d %s", channelId, channelType, err.Error())
+	t.mu.Unlock()
+}
+
+func (t *reindexTask) getProgress() ReindexProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress
+}
+
+func (t *reindexTask) finished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress.FinishedAt > 0
+}
+
+func channelKey(channelId string, channelType uint8) string {
+	return fmt.Sprintf("%s:%d", channelId, channelType)
+}
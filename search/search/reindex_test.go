@@ -0,0 +1,173 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+// 等待重建任务结束
+func waitReindex(t *testing.T, s *Search) ReindexProgress {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		progress, err := s.ReindexProgress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if progress.FinishedAt > 0 {
+			return progress
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("reindex is not finished")
+	return ReindexProgress{}
+}
+
+func TestReindexChannel(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	old := []*pluginproto.Message{
+		newTestMessage("c1", 2, 1, "u1", "draft"),
+		newTestMessage("c1", 2, 2, "u1", "draft"),
+	}
+	indexTestMessages(t, s, 0, old...)
+
+	// 服务端的第2条消息已删除，第3条是新消息
+	m1 := newTestMessage("c1", 2, 1, "u1", "final")
+	m1.MessageId = old[0].MessageId
+	m3 := newTestMessage("c1", 2, 3, "u1", "final")
+	stubChannelMessages(t, m1, m3)
+
+	if _, err := s.StartReindex(ReindexReq{ChannelId: "c1", ChannelType: 2}); err != nil {
+		t.Fatal(err)
+	}
+	progress := waitReindex(t, s)
+	if progress.Status != ReindexStatusFinished || progress.DoneChannels != 1 || progress.IndexedMessages != 2 || progress.Errors != 0 {
+		t.Errorf("progress = %+v", progress)
+	}
+	if got := searchTestContent(t, s, "draft"); len(got) != 0 {
+		t.Errorf("search draft = %v, want none", got)
+	}
+	if got, want := searchTestContent(t, s, "final"), []int64{m3.MessageId, m1.MessageId}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search final = %v, want %v", got, want)
+	}
+	if checkpoint, _ := s.getChannelMaxMessageSeq("c1", 2); checkpoint != 3 {
+		t.Errorf("checkpoint = %d, want 3", checkpoint)
+	}
+	// 重建后交还给bucket继续索引新消息
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Errorf("pending channels = %v, want [c1:2]", got)
+	}
+	if s.isReindexing("c1", 2) {
+		t.Errorf("isReindexing() = true after reindex")
+	}
+}
+
+func TestReindexPauseCancel(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+
+	// 第一次拉取消息时阻塞，在此期间暂停
+	pulling := make(chan struct{})
+	release := make(chan struct{})
+	old := getChannelMessages
+	defer func() { getChannelMessages = old }()
+	getChannelMessages = func(req *pluginproto.ChannelMessageBatchReq) (*pluginproto.ChannelMessageBatchResp, error) {
+		select {
+		case pulling <- struct{}{}:
+			<-release
+		default:
+		}
+		return &pluginproto.ChannelMessageBatchResp{}, nil
+	}
+
+	channels := []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 2}, {ChannelId: "c2", ChannelType: 2}}
+	if _, err := s.StartReindex(ReindexReq{Channels: channels}); err != nil {
+		t.Fatal(err)
+	}
+	<-pulling
+	if _, err := s.StartReindex(ReindexReq{ChannelId: "c3", ChannelType: 2}); err != ErrReindexRunning {
+		t.Errorf("StartReindex() error = %v, want %v", err, ErrReindexRunning)
+	}
+	if _, err := s.ResumeReindex(); err == nil {
+		t.Errorf("ResumeReindex() of a running task error = nil")
+	}
+	if progress, err := s.PauseReindex(); err != nil || progress.Status != ReindexStatusPaused {
+		t.Fatalf("PauseReindex() = %+v %v", progress, err)
+	}
+	close(release)
+
+	// 暂停后当前频道完成，不再开始下一个频道
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress, _ := s.ReindexProgress()
+		if progress.DoneChannels == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("progress = %+v, want the first channel done", progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if progress, _ := s.ReindexProgress(); progress.DoneChannels != 1 || progress.Status != ReindexStatusPaused {
+		t.Fatalf("progress = %+v, want paused after one channel", progress)
+	}
+	if !s.isReindexing("c2", 2) || s.isReindexing("c1", 2) {
+		t.Errorf("isReindexing() c1 = %v c2 = %v, want false true", s.isReindexing("c1", 2), s.isReindexing("c2", 2))
+	}
+
+	if _, err := s.CancelReindex(); err != nil {
+		t.Fatal(err)
+	}
+	progress := waitReindex(t, s)
+	if progress.Status != ReindexStatusCanceled || progress.DoneChannels != 1 {
+		t.Errorf("progress = %+v, want canceled after one channel", progress)
+	}
+	if _, err := s.PauseReindex(); err != ErrReindexNotRunning {
+		t.Errorf("PauseReindex() error = %v, want %v", err, ErrReindexNotRunning)
+	}
+	// 取消后可以开始新的任务
+	if _, err := s.StartReindex(ReindexReq{ChannelId: "c3", ChannelType: 2}); err != nil {
+		t.Errorf("StartReindex() error = %v", err)
+	}
+	waitReindex(t, s)
+}
+
+func TestReindexChannels(t *testing.T) {
+	s := newTestSearch(t)
+	if err := s.db.setChannelMaxMessageSeq("c1", 2, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.addPendingIndex("c2", 1); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		req  ReindexReq
+		want []string
+	}{
+		{"channel", ReindexReq{ChannelId: "c3", ChannelType: 2}, []string{"c3:2"}},
+		{"channels without duplicates", ReindexReq{ChannelId: "c3", ChannelType: 2, Channels: []*pluginproto.Channel{{ChannelId: "c3", ChannelType: 2}, {ChannelId: "c4", ChannelType: 1}}}, []string{"c3:2", "c4:1"}},
+		{"all", ReindexReq{All: true}, []string{"c1:2", "c2:1"}},
+		{"all with channel", ReindexReq{All: true, ChannelId: "c1", ChannelType: 2}, []string{"c1:2", "c2:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channels, err := s.reindexChannels(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(channels))
+			for _, c := range channels {
+				got = append(got, channelKey(c.ChannelId, uint8(c.ChannelType)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reindexChannels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"go.uber.org/zap"
+)
+
+const (
+	// 自动清理过期消息的间隔
+	retentionInterval = time.Hour
+	// 清理时每次删除的消息数量
+	retentionDeletePageSize = 1000
+)
+
+// 消息索引的保留策略，保留天数为0表示永久保留
+type RetentionOptions struct {
+	Days            int           // 所有频道的保留天数
+	ChannelTypeDays map[uint8]int // 指定频道类型的保留天数，优先于Days
+}
+
+// 清理的结果
+type RetentionResult struct {
+	Partitions []string `json:"partitions"` // 整体删除的分区
+	Deleted    uint64   `json:"deleted"`    // 在分区中删除的消息数量
+	Events     uint64   `json:"events"`     // 删除的撤回和编辑记录数量
+}
+
+var (
+	retentionOptionsLock sync.RWMutex
+	retentionOptions     RetentionOptions
+)
+
+// SetRetentionOptions 设置保留策略，过期的消息不再索引，已索引的在下一次清理时删除
+func SetRetentionOptions(opts RetentionOptions) {
+	retentionOptionsLock.Lock()
+	defer retentionOptionsLock.Unlock()
+	retentionOptions = opts
+}
+
+func getRetentionOptions() RetentionOptions {
+	retentionOptionsLock.RLock()
+	defer retentionOptionsLock.RUnlock()
+	return retentionOptions
+}
+
+// ParseChannelTypeDays 解析按频道类型的保留天数，格式为 频道类型:天数，逗号分隔，例如 1:30,2:365
+func ParseChannelTypeDays(text string) (map[uint8]int, error) {
+	result := make(map[uint8]int)
+	for _, item := range ParseWords(text) {
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid channel type days: %s", item)
+		}
+		channelType, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel type: %s", item)
+		}
+		days, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid days: %s", item)
+		}
+		result[uint8(channelType)] = days
+	}
+	return result, nil
+}
+
+// 频道类型的保留天数
+func (o RetentionOptions) days(channelType uint8) int {
+	if days, ok := o.ChannelTypeDays[channelType]; ok {
+		return days
+	}
+	return o.Days
+}
+
+// 频道类型的过期时间，此时间之前的消息过期，0表示不过期
+func (o RetentionOptions) cutoff(channelType uint8, now time.Time) uint32 {
+	return daysCutoff(o.days(channelType), now)
+}
+
+func daysCutoff(days int, now time.Time) uint32 {
+	if days <= 0 {
+		return 0
+	}
+	return uint32(now.AddDate(0, 0, -days).Unix())
+}
+
+// 所有频道都过期的时间，此时间之前的分区可以整体删除，0表示有频道永久保留
+func (o RetentionOptions) partitionCutoff(now time.Time) uint32 {
+	days := o.Days
+	for _, d := range o.ChannelTypeDays {
+		if d <= 0 || days <= 0 {
+			return 0
+		}
+		if d > days {
+			days = d
+		}
+	}
+	return daysCutoff(days, now)
+}
+
+// 消息是否已过期
+func isMessageExpired(channelType uint8, timestamp uint32) bool {
+	cutoff := getRetentionOptions().cutoff(channelType, time.Now())
+	return cutoff > 0 && timestamp > 0 && timestamp < cutoff
+}
+
+// 定时清理过期的消息
+func (s *Search) loopRetention() {
+	tk := time.NewTicker(retentionInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-s.stopper:
+			return
+		case <-tk.C:
+		}
+		result, err := s.CleanupRetention()
+		if err != nil {
+			s.Warn("cleanup retention error", zap.Error(err))
+			continue
+		}
+		if len(result.Partitions) > 0 || result.Deleted > 0 || result.Events > 0 {
+			s.Info("cleanup retention", zap.Strings("partitions", result.Partitions), zap.Uint64("deleted", result.Deleted), zap.Uint64("events", result.Events))
+		}
+	}
+}
+
+// CleanupRetention 清理过期的消息，整个分区都过期时删除分区，否则在分区中删除过期的消息
+func (s *Search) CleanupRetention() (*RetentionResult, error) {
+	// 迁移期间不清理，迁移时会跳过过期的消息
+	if !s.migrateLock.TryLock() {
+		return nil, fmt.Errorf("message index is migrating")
+	}
+	defer s.migrateLock.Unlock()
+
+	result := &RetentionResult{
+		Partitions: make([]string, 0),
+	}
+	s.indexLock.RLock()
+	index := s.activeIndex
+	s.indexLock.RUnlock()
+	if index == nil {
+		return nil, fmt.Errorf("message index is not open")
+	}
+
+	opts := getRetentionOptions()
+	now := time.Now()
+	if cutoff := opts.partitionCutoff(now); cutoff > 0 && !index.legacy {
+		for _, info := range mustPartitions(index) {
+			if info.End > int64(cutoff) {
+				break
+			}
+			if err := s.dropPartition(index, info.Name); err != nil {
+				return result, err
+			}
+			result.Partitions = append(result.Partitions, info.Name)
+		}
+	}
+
+	// 保留天数不同的频道类型单独删除
+	channelTypes := make([]uint8, 0, len(opts.ChannelTypeDays))
+	for channelType, days := range opts.ChannelTypeDays {
+		channelTypes = append(channelTypes, channelType)
+		cutoff := daysCutoff(days, now)
+		if cutoff == 0 {
+			continue
+		}
+		deleted, err := s.deleteMatched(bleve.NewConjunctionQuery(newChannelTypeQuery(channelType), newBeforeQuery(cutoff)))
+		result.Deleted += deleted
+		if err != nil {
+			return result, err
+		}
+	}
+	if cutoff := daysCutoff(opts.Days, now); cutoff > 0 {
+		q := bleve.NewBooleanQuery()
+		q.AddMust(newBeforeQuery(cutoff))
+		for _, channelType := range channelTypes {
+			q.AddMustNot(newChannelTypeQuery(channelType))
+		}
+		deleted, err := s.deleteMatched(q)
+		result.Deleted += deleted
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// 过期消息的撤回和编辑记录不再需要
+	events, err := s.db.pruneMessageEvents(func(channelType uint8) uint32 {
+		if channelType == unknownChannelType {
+			return opts.partitionCutoff(now)
+		}
+		return opts.cutoff(channelType, now)
+	}, uint32(now.Unix()))
+	result.Events = events
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Partitions 当前索引的分区
+func (s *Search) Partitions() ([]*PartitionInfo, error) {
+	s.indexLock.RLock()
+	index := s.activeIndex
+	s.indexLock.RUnlock()
+	if index == nil {
+		return nil, fmt.Errorf("message index is not open")
+	}
+	return index.Partitions()
+}
+
+func mustPartitions(index *messageIndex) []*PartitionInfo {
+	infos, _ := index.Partitions()
+	return infos
+}
+
+// 删除分区，分区中频道的检查点比其他分区新时先保存到最新的分区，防止频道重新从头索引
+func (s *Search) dropPartition(index *messageIndex, name string) error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	names := index.partitionNames()
+	if len(names) == 0 {
+		return nil
+	}
+	batch := index.NewBatch()
+	var rangeErr error
+	err := s.db.rangeIndexedChannels(func(channelId string, channelType uint8) bool {
+		key := channelCheckpointKey(channelId, channelType)
+		data, err := index.partitions[name].GetInternal(key)
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+		if len(data) != 8 {
+			return true
+		}
+		if decodeMessageSeq(data) > s.checkpointWithout(index, name, key) {
+			batch.SetInternal(key, data)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if rangeErr != nil {
+		return rangeErr
+	}
+	if len(batch.internals) > 0 {
+		// 保存到最新的分区，最新的就是要删除的分区时使用当前月份
+		latest := names[len(names)-1]
+		if latest == name {
+			latest = index.partitionOf(0)
+		}
+		if latest != name {
+			partitionBatch, err := batch.batch(latest)
+			if err != nil {
+				return err
+			}
+			for _, kv := range batch.internals {
+				partitionBatch.SetInternal(kv.key, kv.val)
+			}
+			batch.internals = nil
+			if err = index.Batch(batch); err != nil {
+				return err
+			}
+		}
+	}
+	return index.dropPartition(name)
+}
+
+// 除了指定分区外其他分区中的检查点
+func (s *Search) checkpointWithout(index *messageIndex, name string, key []byte) uint64 {
+	var max uint64
+	for n, partition := range index.partitions {
+		if n == name {
+			continue
+		}
+		data, err := partition.GetInternal(key)
+		if err != nil || len(data) != 8 {
+			continue
+		}
+		if seq := decodeMessageSeq(data); seq > max {
+			max = seq
+		}
+	}
+	return max
+}
+
+// 删除匹配的消息，返回删除的数量
+func (s *Search) deleteMatched(q query.Query) (uint64, error) {
+	var deleted uint64
+	for {
+		if s.stopping() {
+			return deleted, ErrStopped
+		}
+		searchRequest := bleve.NewSearchRequest(q)
+		searchRequest.Size = retentionDeletePageSize
+		searchResult, err := s.msgIndex.Search(searchRequest)
+		if err != nil {
+			return deleted, err
+		}
+		if len(searchResult.Hits) == 0 {
+			return deleted, nil
+		}
+		err = s.indexBatch(func(batch *messageBatch) {
+			for _, hit := range searchResult.Hits {
+				batch.Delete(hit.ID)
+			}
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += uint64(len(searchResult.Hits))
+	}
+}
+
+func newChannelTypeQuery(channelType uint8) query.Query {
+	start := float64(channelType)
+	end := start + 1
+	q := bleve.NewNumericRangeQuery(&start, &end)
+	q.SetField("channel_type")
+	return q
+}
+
+// timestamp < before
+func newBeforeQuery(before uint32) query.Query {
+	end := float64(before)
+	q := bleve.NewNumericRangeQuery(nil, &end)
+	q.SetField("timestamp")
+	return q
+}
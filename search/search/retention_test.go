@@ -0,0 +1,68 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseChannelTypeDays(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    map[uint8]int
+		wantErr bool
+	}{
+		{"", map[uint8]int{}, false},
+		{"1:30", map[uint8]int{1: 30}, false},
+		{" 1 : 30 , 2:365", map[uint8]int{1: 30, 2: 365}, false},
+		{"1:30\n2:0", map[uint8]int{1: 30, 2: 0}, false},
+		{"1", nil, true},
+		{"1:2:3", nil, true},
+		{"x:30", nil, true},
+		{"256:30", nil, true},
+		{"1:x", nil, true},
+		{"1:-1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := ParseChannelTypeDays(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChannelTypeDays() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChannelTypeDays() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	now := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) uint32 {
+		return uint32(now.AddDate(0, 0, -days).Unix())
+	}
+	tests := []struct {
+		name          string
+		opts          RetentionOptions
+		channelType   uint8
+		wantCutoff    uint32
+		wantPartition uint32
+	}{
+		{"keep forever", RetentionOptions{}, 2, 0, 0},
+		{"default days", RetentionOptions{Days: 30}, 2, daysAgo(30), daysAgo(30)},
+		{"channel type days", RetentionOptions{Days: 30, ChannelTypeDays: map[uint8]int{1: 7}}, 1, daysAgo(7), daysAgo(30)},
+		{"longest type days", RetentionOptions{Days: 30, ChannelTypeDays: map[uint8]int{1: 90}}, 2, daysAgo(30), daysAgo(90)},
+		{"one type kept forever", RetentionOptions{Days: 30, ChannelTypeDays: map[uint8]int{1: 0}}, 2, daysAgo(30), 0},
+		{"default kept forever", RetentionOptions{ChannelTypeDays: map[uint8]int{1: 7}}, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.cutoff(tt.channelType, now); got != tt.wantCutoff {
+				t.Errorf("cutoff() = %d, want %d", got, tt.wantCutoff)
+			}
+			if got := tt.opts.partitionCutoff(now); got != tt.wantPartition {
+				t.Errorf("partitionCutoff() = %d, want %d", got, tt.wantPartition)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package search
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 每个用户最多保存的搜索数量
+const maxSavedSearch = 100
+
+var ErrSavedSearchNotFound = newBadRequest("saved search not found")
+
+// 用户保存的搜索
+type SavedSearch struct {
+	Id        string    `json:"id"`         // 保存的搜索ID
+	Name      string    `json:"name"`       // 名称，例如 我的提及
+	Query     SearchReq `json:"query"`      // 搜索条件
+	Window    string    `json:"window"`     // 相对时间范围，例如 30m 24h 7d 2w，执行时搜索最近这段时间的消息
+	CreatedAt int64     `json:"created_at"` // 创建时间
+	UpdatedAt int64     `json:"updated_at"` // 更新时间
+}
+
+// Check 校验保存的搜索，参数错误返回BadRequestError
+func (s *SavedSearch) Check() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return newBadRequest("name is empty")
+	}
+	if _, err := ParseTimeWindow(s.Window); err != nil {
+		return err
+	}
+	return s.Query.Check()
+}
+
+// SearchReq 执行时的搜索条件，指定了相对时间范围时从now往前计算开始时间
+func (s *SavedSearch) SearchReq(now time.Time) SearchReq {
+	req := s.Query.Clone()
+	window, _ := ParseTimeWindow(s.Window)
+	if window > 0 {
+		req.StartTime = uint64(now.Add(-window).Unix())
+	}
+	return req
+}
+
+// ParseTimeWindow 解析相对时间范围，支持 m(分钟) h(小时) d(天) w(周)，空表示不限制
+func ParseTimeWindow(window string) (time.Duration, error) {
+	window = strings.TrimSpace(window)
+	if window == "" {
+		return 0, nil
+	}
+	units := map[byte]time.Duration{
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': time.Hour * 24,
+		'w': time.Hour * 24 * 7,
+	}
+	unit, ok := units[window[len(window)-1]]
+	if !ok {
+		return 0, newBadRequest("invalid window: %s", window)
+	}
+	n, err := strconv.Atoi(window[:len(window)-1])
+	if err != nil || n <= 0 {
+		return 0, newBadRequest("invalid window: %s", window)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// SavedSearches 获取用户保存的搜索
+func (s *Search) SavedSearches(uid string) ([]*SavedSearch, error) {
+	data, err := s.db.getSavedSearches(uid)
+	if err != nil {
+		return nil, err
+	}
+	saved := make([]*SavedSearch, 0)
+	if len(data) == 0 {
+		return saved, nil
+	}
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// GetSavedSearch 获取用户保存的一个搜索
+func (s *Search) GetSavedSearch(uid string, id string) (*SavedSearch, error) {
+	saved, err := s.SavedSearches(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range saved {
+		if ss.Id == id {
+			return ss, nil
+		}
+	}
+	return nil, ErrSavedSearchNotFound
+}
+
+// AddSavedSearch 保存搜索，返回保存后的搜索
+func (s *Search) AddSavedSearch(uid string, ss *SavedSearch) (*SavedSearch, error) {
+	if err := ss.Check(); err != nil {
+		return nil, err
+	}
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+
+	saved, err := s.SavedSearches(uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved) >= maxSavedSearch {
+		return nil, newBadRequest("saved searches exceed %d", maxSavedSearch)
+	}
+	now := time.Now()
+	newSaved := *ss
+	newSaved.Id = strconv.FormatInt(now.UnixNano(), 36)
+	newSaved.CreatedAt = now.Unix()
+	newSaved.UpdatedAt = now.Unix()
+	saved = append(saved, &newSaved)
+	if err = s.saveSavedSearches(uid, saved); err != nil {
+		return nil, err
+	}
+	return &newSaved, nil
+}
+
+// UpdateSavedSearch 修改保存的搜索
+func (s *Search) UpdateSavedSearch(uid string, ss *SavedSearch) (*SavedSearch, error) {
+	if err := ss.Check(); err != nil {
+		return nil, err
+	}
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+
+	saved, err := s.SavedSearches(uid)
+	if err != nil {
+		return nil, err
+	}
+	for i, exist := range saved {
+		if exist.Id != ss.Id {
+			continue
+		}
+		newSaved := *ss
+		newSaved.CreatedAt = exist.CreatedAt
+		newSaved.UpdatedAt = time.Now().Unix()
+		saved[i] = &newSaved
+		if err = s.saveSavedSearches(uid, saved); err != nil {
+			return nil, err
+		}
+		return &newSaved, nil
+	}
+	return nil, ErrSavedSearchNotFound
+}
+
+// DeleteSavedSearch 删除保存的搜索
+func (s *Search) DeleteSavedSearch(uid string, id string) error {
+	s.userDataLock.Lock()
+	defer s.userDataLock.Unlock()
+
+	saved, err := s.SavedSearches(uid)
+	if err != nil {
+		return err
+	}
+	newSaved := make([]*SavedSearch, 0, len(saved))
+	for _, ss := range saved {
+		if ss.Id == id {
+			continue
+		}
+		newSaved = append(newSaved, ss)
+	}
+	if len(newSaved) == len(saved) {
+		return ErrSavedSearchNotFound
+	}
+	return s.saveSavedSearches(uid, newSaved)
+}
+
+func (s *Search) saveSavedSearches(uid string, saved []*SavedSearch) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return s.db.setSavedSearches(uid, data)
+}
@@ -0,0 +1,114 @@
+package search
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"30m", 30 * time.Minute, false},
+		{" 24h ", 24 * time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"d", 0, true},
+		{"10s", 0, true},
+		{"1.5h", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeWindow(tt.window)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTimeWindow(%q) = %v, %v, want %v, wantErr %v", tt.window, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSavedSearchReq(t *testing.T) {
+	now := time.Unix(1704067200, 0)
+	ss := &SavedSearch{
+		Name:   "mentions",
+		Query:  SearchReq{MentionedUid: "u1", StartTime: 1, Facets: []FacetReq{{Field: FacetChannelId}}},
+		Window: "1d",
+	}
+	req := ss.SearchReq(now)
+	if req.StartTime != 1704067200-86400 || req.MentionedUid != "u1" {
+		t.Errorf("SearchReq() = %+v", req)
+	}
+	// 执行时的条件是副本，不修改保存的搜索
+	req.Facets[0].Field = FacetFromUid
+	if ss.Query.StartTime != 1 || ss.Query.Facets[0].Field != FacetChannelId {
+		t.Errorf("SearchReq() modified the saved query: %+v", ss.Query)
+	}
+	ss.Window = ""
+	if req = ss.SearchReq(now); req.StartTime != 1 {
+		t.Errorf("SearchReq() without window start time = %d, want 1", req.StartTime)
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	s := newTestSearch(t)
+	if _, err := s.AddSavedSearch("u1", &SavedSearch{Name: " "}); !IsBadRequest(err) {
+		t.Errorf("AddSavedSearch() without name error = %v, want BadRequestError", err)
+	}
+	if _, err := s.AddSavedSearch("u1", &SavedSearch{Name: "bad", Query: SearchReq{Sort: "size"}}); !IsBadRequest(err) {
+		t.Errorf("AddSavedSearch() with bad query error = %v, want BadRequestError", err)
+	}
+
+	added, err := s.AddSavedSearch("u1", &SavedSearch{Id: "ignored", Name: "mentions", Query: SearchReq{MentionedUid: "u1"}, Window: "7d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Id == "" || added.Id == "ignored" || added.CreatedAt == 0 {
+		t.Errorf("AddSavedSearch() = %+v, want a new id and created time", added)
+	}
+	got, err := s.GetSavedSearch("u1", added.Id)
+	if err != nil || got.Name != "mentions" || got.Query.MentionedUid != "u1" {
+		t.Errorf("GetSavedSearch() = %+v, %v", got, err)
+	}
+	if _, err = s.GetSavedSearch("u2", added.Id); err != ErrSavedSearchNotFound {
+		t.Errorf("GetSavedSearch() of another user error = %v, want %v", err, ErrSavedSearchNotFound)
+	}
+
+	updated, err := s.UpdateSavedSearch("u1", &SavedSearch{Id: added.Id, Name: "files", Query: SearchReq{Kinds: []string{"file"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.CreatedAt != added.CreatedAt || updated.Name != "files" {
+		t.Errorf("UpdateSavedSearch() = %+v", updated)
+	}
+	if _, err = s.UpdateSavedSearch("u1", &SavedSearch{Id: "missing", Name: "files"}); err != ErrSavedSearchNotFound {
+		t.Errorf("UpdateSavedSearch() of a missing search error = %v, want %v", err, ErrSavedSearchNotFound)
+	}
+	if saved, _ := s.SavedSearches("u1"); len(saved) != 1 || saved[0].Name != "files" {
+		t.Errorf("SavedSearches() = %v", saved)
+	}
+
+	if err = s.DeleteSavedSearch("u1", added.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteSavedSearch("u1", added.Id); err != ErrSavedSearchNotFound {
+		t.Errorf("DeleteSavedSearch() twice error = %v, want %v", err, ErrSavedSearchNotFound)
+	}
+	if saved, _ := s.SavedSearches("u1"); len(saved) != 0 {
+		t.Errorf("SavedSearches() after delete = %v", saved)
+	}
+}
+
+func TestSavedSearchLimit(t *testing.T) {
+	s := newTestSearch(t)
+	for i := 0; i < maxSavedSearch; i++ {
+		if _, err := s.AddSavedSearch("u1", &SavedSearch{Name: "s"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.AddSavedSearch("u1", &SavedSearch{Name: "s"}); !IsBadRequest(err) {
+		t.Errorf("AddSavedSearch() over the limit error = %v, want BadRequestError", err)
+	}
+}
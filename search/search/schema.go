@@ -0,0 +1,347 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/WuKongIM/go-pdk/pdk"
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	"go.uber.org/zap"
+)
+
+// 消息索引的结构版本，修改buildMessageMapping后需要加1，已有的索引会在后台自动迁移
+const messageSchemaVersion = 7
+
+// 从此版本开始消息索引按月分区
+const partitionSchemaVersion = 6
+
+// 迁移时每次复制的文档数量
+const migratePageSize = 500
+
+// 第一个版本的索引目录（没有保存版本信息的索引都是此版本）
+const defaultMessageIndexName = "message.bleve"
+
+func messageIndexName(version int) string {
+	if version <= 1 {
+		return defaultMessageIndexName
+	}
+	return fmt.Sprintf("message_v%d.bleve", version)
+}
+
+// 当前版本和分词选项对应的索引目录，分词或中文选项不是默认时目录名包含选项的指纹
+func currentMessageIndexName() string {
+	fingerprint := getAnalysisOptions().fingerprint(getChineseOptions())
+	if fingerprint == "" {
+		return messageIndexName(messageSchemaVersion)
+	}
+	return fmt.Sprintf("message_v%d_%s.bleve", messageSchemaVersion, fingerprint)
+}
+
+// 打开消息索引，版本过旧时在后台迁移到新版本
+func (s *Search) openMessageIndex() error {
+	name, version, err := s.db.getMessageIndexMeta()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = defaultMessageIndexName
+		version = 1
+	}
+
+	legacy := version < partitionSchemaVersion
+	index, err := openMessageIndexDir(path.Join(pdk.S.SandboxDir(), name), legacy, s.buildMessageMapping)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		return s.createMessageIndex()
+	}
+	if err != nil {
+		// 索引无法打开，创建新索引并重新拉取所有消息
+		s.Error("open message index error, rebuild it", zap.Error(err), zap.String("name", name))
+		if err = s.createMessageIndex(); err != nil {
+			return err
+		}
+		if _, err = s.StartReindex(ReindexReq{All: true}); err != nil {
+			s.Warn("start reindex error", zap.Error(err))
+		}
+		return nil
+	}
+
+	s.setActiveIndex(index)
+	s.checkMessageIndexSchema(name, version)
+	return nil
+}
+
+// 索引的版本过旧或分词选项修改了，在后台迁移
+func (s *Search) checkMessageIndexSchema(name string, version int) {
+	if version < messageSchemaVersion {
+		s.Info("message index schema is out of date, migrate it", zap.Int("version", version), zap.Int("latestVersion", messageSchemaVersion))
+		s.goTask(func() { s.migrateMessageIndex(name) })
+	} else if version > messageSchemaVersion {
+		s.Warn("message index schema is newer than plugin", zap.Int("version", version), zap.Int("latestVersion", messageSchemaVersion))
+	} else if name != currentMessageIndexName() {
+		s.Info("message index analysis changed, migrate it", zap.String("name", name), zap.String("newName", currentMessageIndexName()))
+		s.goTask(func() { s.migrateMessageIndex(name) })
+	}
+}
+
+// ReloadAnalysis 分词或中文选项修改后，在后台迁移到使用新选项的索引
+func (s *Search) ReloadAnalysis() {
+	s.indexLock.RLock()
+	opened := s.activeIndex != nil
+	s.indexLock.RUnlock()
+	// 未打开时会在打开索引时检查
+	if !opened {
+		return
+	}
+	name, _, err := s.db.getMessageIndexMeta()
+	if err != nil {
+		s.Error("get message index meta error", zap.Error(err))
+		return
+	}
+	if name == currentMessageIndexName() {
+		return
+	}
+	s.Info("message index analysis changed, migrate it", zap.String("name", name), zap.String("newName", currentMessageIndexName()))
+	s.goTask(func() { s.migrateMessageIndex(name) })
+}
+
+// 创建当前版本的消息索引
+func (s *Search) createMessageIndex() error {
+	name := currentMessageIndexName()
+	index, err := createMessageIndexDir(path.Join(pdk.S.SandboxDir(), name), s.buildMessageMapping())
+	if err != nil {
+		return err
+	}
+	if err = s.db.setMessageIndexMeta(name, messageSchemaVersion); err != nil {
+		index.Close()
+		return err
+	}
+	s.setActiveIndex(index)
+	return nil
+}
+
+func (s *Search) setActiveIndex(index *messageIndex) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if s.msgIndex == nil {
+		s.msgIndex = bleve.NewIndexAlias(index.alias)
+	} else {
+		s.msgIndex.Swap([]bleve.Index{index.alias}, []bleve.Index{s.activeIndex.alias})
+	}
+	s.activeIndex = index
+}
+
+// 批量写入消息索引，迁移期间同时写入新索引
+func (s *Search) indexBatch(build func(batch *messageBatch)) error {
+	s.indexLock.RLock()
+	defer s.indexLock.RUnlock()
+
+	if s.activeIndex == nil {
+		return fmt.Errorf("message index is not open")
+	}
+
+	batch := s.activeIndex.NewBatch()
+	build(batch)
+	if err := s.activeIndex.Batch(batch); err != nil {
+		return err
+	}
+
+	if s.migrateIndex != nil {
+		migrateBatch := s.migrateIndex.NewBatch()
+		build(migrateBatch)
+		if err := s.migrateIndex.Batch(migrateBatch); err != nil {
+			s.Warn("write migrate index error", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// 将旧索引中保存的文档复制到新版本的索引，完成后原子切换
+func (s *Search) migrateMessageIndex(oldName string) {
+	// 同一时间只进行一个迁移，迁移完成后会重新检查分词选项
+	if !s.migrateLock.TryLock() {
+		return
+	}
+	name := currentMessageIndexName()
+	finished := false
+	defer func() {
+		// 迁移期间分词选项又修改了
+		if finished && currentMessageIndexName() != name {
+			s.migrateMessageIndex(name)
+		}
+	}()
+	defer s.migrateLock.Unlock()
+	if name == oldName {
+		return
+	}
+	dir := path.Join(pdk.S.SandboxDir(), name)
+
+	// 清理上次未完成的迁移
+	newIndex, err := createMessageIndexDir(dir, s.buildMessageMapping())
+	if err != nil {
+		s.Error("create migrate index error", zap.Error(err))
+		return
+	}
+
+	s.indexLock.Lock()
+	oldIndex := s.activeIndex
+	s.migrateIndex = newIndex
+	s.indexLock.Unlock()
+
+	count, err := s.copyMessageIndex(oldIndex, newIndex)
+	if err != nil {
+		s.Error("migrate message index error", zap.Error(err))
+		s.indexLock.Lock()
+		s.migrateIndex = nil
+		s.indexLock.Unlock()
+		newIndex.Close()
+		os.RemoveAll(dir)
+		return
+	}
+
+	// 切换到新索引
+	s.indexLock.Lock()
+	if err = s.copyIndexCheckpoints(oldIndex, newIndex); err != nil {
+		s.migrateIndex = nil
+		s.indexLock.Unlock()
+		s.Error("copy index checkpoints error", zap.Error(err))
+		newIndex.Close()
+		os.RemoveAll(dir)
+		return
+	}
+	if err = s.db.setMessageIndexMeta(name, messageSchemaVersion); err != nil {
+		s.migrateIndex = nil
+		s.indexLock.Unlock()
+		s.Error("save message index meta error", zap.Error(err))
+		newIndex.Close()
+		os.RemoveAll(dir)
+		return
+	}
+	s.msgIndex.Swap([]bleve.Index{newIndex.alias}, []bleve.Index{oldIndex.alias})
+	s.activeIndex = newIndex
+	s.migrateIndex = nil
+	s.indexLock.Unlock()
+
+	if err = oldIndex.Close(); err != nil {
+		s.Warn("close old message index error", zap.Error(err))
+	}
+	if oldName != name {
+		if err = os.RemoveAll(path.Join(pdk.S.SandboxDir(), oldName)); err != nil {
+			s.Warn("remove old message index error", zap.Error(err))
+		}
+	}
+	s.Info("migrate message index finished", zap.String("name", name), zap.Uint64("count", count))
+	finished = true
+}
+
+func (s *Search) copyMessageIndex(from, to *messageIndex) (uint64, error) {
+	var (
+		count uint64
+		after string
+	)
+	for {
+		// 停止时放弃迁移，下次启动时重新迁移
+		if s.stopping() {
+			return count, ErrStopped
+		}
+		searchRequest := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+		searchRequest.Fields = []string{"*"}
+		searchRequest.Size = migratePageSize
+		searchRequest.SortBy([]string{"_id"})
+		if after != "" {
+			searchRequest.SetSearchAfter([]string{after})
+		}
+		searchResult, err := from.alias.Search(searchRequest)
+		if err != nil {
+			return count, err
+		}
+		if len(searchResult.Hits) == 0 {
+			return count, nil
+		}
+
+		// 与撤回、编辑的写入互斥，防止复制旧内容覆盖新内容
+		s.indexLock.Lock()
+		batch := to.NewBatch()
+		for _, hit := range searchResult.Hits {
+			msg := newMessageFromHit(hit)
+			if !s.prepareMigrateMessage(msg) {
+				continue
+			}
+			if err = batch.Index(hit.ID, msg); err != nil {
+				s.Warn("migrate message error", zap.Error(err), zap.String("messageId", hit.ID))
+			}
+		}
+		err = to.Batch(batch)
+		s.indexLock.Unlock()
+		if err != nil {
+			return count, err
+		}
+		count += uint64(len(searchResult.Hits))
+		after = searchResult.Hits[len(searchResult.Hits)-1].ID
+	}
+}
+
+// 将索引中保存的消息还原为可索引的消息，返回false表示消息不需要迁移
+func (s *Search) prepareMigrateMessage(msg *Message) bool {
+	if isMessageExpired(msg.ChannelType, msg.Timestamp) {
+		return false
+	}
+	removed, err := s.db.isMessageRemoved(msg.MessageId)
+	if err != nil {
+		s.Warn("get message removed error", zap.Error(err), zap.Int64("messageId", msg.MessageId))
+	}
+	if removed {
+		return false
+	}
+	payload, err := s.db.getMessageEdited(msg.MessageId)
+	if err != nil {
+		s.Warn("get message edited error", zap.Error(err), zap.Int64("messageId", msg.MessageId))
+	}
+	if len(payload) > 0 {
+		// 编辑后的内容可能需要解码，不能解码时保留原来的内容
+		decoded, reason := decodePayload(&pluginproto.Message{
+			MessageId: msg.MessageId,
+			Topic:     msg.Topic,
+			Payload:   payload,
+		})
+		if reason == "" {
+			msg.PayloadJson = string(decoded)
+		}
+	}
+	msg.setPayload(msg.PayloadJson)
+	return true
+}
+
+// 复制频道的检查点，迁移期间新写入的检查点不会被覆盖
+func (s *Search) copyIndexCheckpoints(from, to *messageIndex) error {
+	var rangeErr error
+	batch := to.NewBatch()
+	err := s.db.rangeIndexedChannels(func(channelId string, channelType uint8) bool {
+		key := channelCheckpointKey(channelId, channelType)
+		_, exist, err := to.checkpoint(key)
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+		if exist {
+			return true
+		}
+		messageSeq, ok, err := from.checkpoint(key)
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+		if ok {
+			batch.SetInternal(key, encodeMessageSeq(messageSeq))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if rangeErr != nil {
+		return rangeErr
+	}
+	return to.Batch(batch)
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMessageIndexName(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{0, defaultMessageIndexName},
+		{1, defaultMessageIndexName},
+		{2, "message_v2.bleve"},
+		{messageSchemaVersion, "message_v7.bleve"},
+	}
+	for _, tt := range tests {
+		if got := messageIndexName(tt.version); got != tt.want {
+			t.Errorf("messageIndexName(%d) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+	if got := currentMessageIndexName(); got != messageIndexName(messageSchemaVersion) {
+		t.Errorf("currentMessageIndexName() = %q with default options", got)
+	}
+}
+
+func TestCopyMessageIndex(t *testing.T) {
+	s := newTestSearch(t)
+	m1 := newTestMessage("c1", 2, 1, "u1", "release notes")
+	m2 := newTestMessage("c1", 2, 2, "u1", "release day")
+	m3 := newTestMessage("c1", 2, 3, "u1", "release party")
+	m4 := newTestMessage("c2", 1, 1, "u2", "release plan")
+	indexTestMessages(t, s, 0, m1, m2, m3)
+	indexTestMessages(t, s, 0, m4)
+	if err := s.RemoveIndex([]int64{m2.MessageId}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateIndex(m3.MessageId, []byte(`{"type":1,"content":"launch party"}`)); err != nil {
+		t.Fatal(err)
+	}
+	oldIndex := s.activeIndex
+
+	newIndex, err := createMessageIndexDir(filepath.Join(t.TempDir(), "index"), testMessageMapping(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.indexLock.Lock()
+	s.migrateIndex = newIndex
+	s.indexLock.Unlock()
+
+	// 迁移期间新拉取的消息同时写入新索引，检查点不会被旧索引覆盖
+	m5 := newTestMessage("c1", 2, 4, "u1", "release again")
+	indexTestMessages(t, s, 3, m5)
+
+	// 频道类型1的消息已过期，迁移时丢弃
+	SetRetentionOptions(RetentionOptions{ChannelTypeDays: map[uint8]int{1: 30}})
+	defer SetRetentionOptions(RetentionOptions{})
+
+	count, err := s.copyMessageIndex(oldIndex, newIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("copyMessageIndex() count = %d, want 4", count)
+	}
+	// 旧索引中检查点回退，新索引中已有的检查点保留
+	batch := oldIndex.NewBatch()
+	batch.SetInternal(channelCheckpointKey("c1", 2), encodeMessageSeq(1))
+	if err = oldIndex.Batch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.copyIndexCheckpoints(oldIndex, newIndex); err != nil {
+		t.Fatal(err)
+	}
+	s.indexLock.Lock()
+	s.migrateIndex = nil
+	s.indexLock.Unlock()
+	s.setActiveIndex(newIndex)
+	t.Cleanup(func() { newIndex.Close() })
+
+	if got, want := searchTestContent(t, s, "release"), []int64{m5.MessageId, m1.MessageId}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search release = %v, want %v", got, want)
+	}
+	if got := searchTestContent(t, s, "launch"); !reflect.DeepEqual(got, []int64{m3.MessageId}) {
+		t.Errorf("search launch = %v, want [%d]", got, m3.MessageId)
+	}
+	checkpoints := []struct {
+		channelId   string
+		channelType uint8
+		want        uint64
+	}{
+		{"c1", 2, 4},
+		{"c2", 1, 1},
+	}
+	for _, c := range checkpoints {
+		seq, ok, err := newIndex.checkpoint(channelCheckpointKey(c.channelId, c.channelType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || seq != c.want {
+			t.Errorf("checkpoint of %s = %d %v, want %d", c.channelId, seq, ok, c.want)
+		}
+	}
+}
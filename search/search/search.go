@@ -2,63 +2,126 @@ package search
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/WuKongIM/go-pdk/pdk"
 	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/WuKongIM/wklog"
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/mapping"
+	blevesearch "github.com/blevesearch/bleve/v2/search"
+	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
 	"github.com/tidwall/gjson"
-	gse "github.com/vcaesar/gse-bleve"
+	"go.uber.org/zap"
 )
 
+// 停止时等待后台任务的时间
+const stopTimeout = 10 * time.Second
+
+// 按页码分页时最多能读到的消息（分组）数量，page*limit超过时需要使用游标
+// 多节点搜索时每个节点都要返回前page页的所有消息
+const maxSearchWindow = 10000
+
+var ErrStopped = errors.New("search is stopped")
+
 type Search struct {
-	buckets  []*bucket
-	db       *db
-	msgIndex bleve.Index
+	buckets      []*bucket
+	bucketLock   sync.RWMutex // buckets和indexOptions的锁
+	indexOptions IndexOptions
+	resizeLock   sync.Mutex // 调整bucket的锁
+	throttle     throttle   // 拉取消息的自适应限速
+	db           *db
+	msgIndex     bleve.IndexAlias // 查询使用的索引别名，切换索引时原子替换
+	activeIndex  *messageIndex    // 当前使用的索引
+	migrateIndex *messageIndex    // 迁移中的新版本索引，迁移期间同时写入
+	indexLock    sync.RWMutex
+	migrateLock  sync.Mutex // 迁移索引的锁
+
+	reindexLock sync.Mutex
+	reindex     *reindexTask // 重建索引任务
+
+	userDataLock sync.Mutex // 修改用户数据（搜索历史、保存的搜索）的锁
+
+	metrics metrics // 索引的运行指标
+
+	stopLock sync.RWMutex
+	stopped  bool
+	stopper  chan struct{}  // 停止时关闭
+	wg       sync.WaitGroup // 后台任务（bucket、定时清理、重建索引）
+	wklog.Log
 }
 
 func New() *Search {
+	opts := defaultIndexOptions
 	s := &Search{
-		buckets: make([]*bucket, 10),
-		db:      newDb(),
+		buckets:      make([]*bucket, opts.Buckets),
+		indexOptions: opts,
+		db:           newDb(),
+		stopper:      make(chan struct{}),
+		Log:          wklog.NewWKLog("Search"),
 	}
 
 	for i := 0; i < len(s.buckets); i++ {
-		s.buckets[i] = newBucket(i, s)
+		s.buckets[i] = newBucket(i, s, opts.QueueSize)
 		s.buckets[i].start()
 	}
 
 	return s
 }
 
-// 索引频道的消息
+// 索引频道的消息，停止后忽略
 func (s *Search) MakeIndex(channelId string, channelType uint8) {
-	bucketIndex := s.bucketIndex(channelId)
-	bucket := s.buckets[bucketIndex]
-	bucket.indexChan <- indexReq{
-		channelId:   channelId,
-		channelType: channelType,
-	}
+	s.whenRunning(func() error {
+		req := indexReq{
+			channelId:   channelId,
+			channelType: channelType,
+		}
+		// 频道已在等待索引，db中已有记录，不需要每条消息都同步写入
+		if s.enqueuePendingIndex(req) {
+			return nil
+		}
+		// 先持久化，插件重启后可以继续索引
+		err := s.db.addPendingIndex(channelId, channelType)
+		if err != nil {
+			s.Error("add pending index error", zap.Error(err), zap.String("channelId", channelId), zap.Uint8("channelType", channelType))
+		}
+		s.enqueueIndex(req)
+		return nil
+	})
 }
 
-func (s *Search) buildMessageMapping(indexName string) *mapping.IndexMappingImpl {
-	opt := gse.Option{
-		Index: indexName,
-		// Dicts: "embed, ja",
-		Dicts: "embed, zh",
-		Opt:   "search-hmm",
-		Trim:  "trim",
-		Stop:  "",
+// 重新加载未完成索引的频道
+func (s *Search) replayPendingIndex() {
+	count := 0
+	err := s.db.rangePendingIndex(func(channelId string, channelType uint8) bool {
+		s.enqueueIndex(indexReq{
+			channelId:   channelId,
+			channelType: channelType,
+		})
+		count++
+		return true
+	})
+	if err != nil {
+		s.Error("replay pending index error", zap.Error(err))
+		return
 	}
-	var err error
-	indexMapping, err := gse.NewMapping(opt)
+	if count > 0 {
+		s.Info("replay pending index", zap.Int("count", count))
+	}
+}
+
+func (s *Search) buildMessageMapping() *mapping.IndexMappingImpl {
+	analysisOpts := getAnalysisOptions()
+	indexMapping := bleve.NewIndexMapping()
+	defaultAnalyzer, err := addLangAnalyzers(indexMapping, analysisOpts)
 	if err != nil {
 		panic(err)
 	}
+	indexMapping.DefaultAnalyzer = defaultAnalyzer
 
 	// 创建一个文档映射
 	docMapping := bleve.NewDocumentMapping()
@@ -78,6 +141,10 @@ func (s *Search) buildMessageMapping(indexName string) *mapping.IndexMappingImpl
 	channelTypeFieldMapping := bleve.NewNumericFieldMapping()
 	docMapping.AddFieldMappingsAt("channel_type", channelTypeFieldMapping)
 
+	// 频道ID和频道类型，按照频道分组
+	channelKeyFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("channel_key", channelKeyFieldMapping)
+
 	// messageSeq
 	messageSeqFieldMapping := bleve.NewNumericFieldMapping()
 	docMapping.AddFieldMappingsAt("message_seq", messageSeqFieldMapping)
@@ -95,16 +162,61 @@ func (s *Search) buildMessageMapping(indexName string) *mapping.IndexMappingImpl
 	payloadFieldMapping.Dynamic = true
 
 	// payload.content
-	contentFieldMapping := gse.NewTextMap()
+	contentFieldMapping := bleve.NewTextFieldMapping()
+	contentFieldMapping.Analyzer = defaultAnalyzer
 	contentFieldMapping.IncludeTermVectors = true
 	payloadFieldMapping.AddFieldMappingsAt("content", contentFieldMapping)
 
+	// payload.content 的繁简体、拼音子字段
+	if err = addChineseVariantMappings(indexMapping, payloadFieldMapping); err != nil {
+		panic(err)
+	}
+
 	// payload.type
 	typeFieldMapping := bleve.NewNumericFieldMapping()
 	payloadFieldMapping.AddFieldMappingsAt("type", typeFieldMapping)
 
 	docMapping.AddSubDocumentMapping("payload", payloadFieldMapping)
 
+	// 提及的用户
+	mentionUidsFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("mention_uids", mentionUidsFieldMapping)
+
+	// 是否@所有人
+	mentionAllFieldMapping := bleve.NewBooleanFieldMapping()
+	docMapping.AddFieldMappingsAt("mention_all", mentionAllFieldMapping)
+
+	// 内容类型 image voice video file card link
+	kindsFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("kinds", kindsFieldMapping)
+
+	// 文件名
+	fileNameFieldMapping := bleve.NewTextFieldMapping()
+	docMapping.AddFieldMappingsAt("file_name", fileNameFieldMapping)
+
+	// 文件扩展名
+	fileExtFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("file_ext", fileExtFieldMapping)
+
+	// 文件大小
+	fileSizeFieldMapping := bleve.NewNumericFieldMapping()
+	docMapping.AddFieldMappingsAt("file_size", fileSizeFieldMapping)
+
+	// 链接的域名
+	urlHostsFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("url_hosts", urlHostsFieldMapping)
+
+	// 名片标题
+	cardTitleFieldMapping := bleve.NewTextFieldMapping()
+	docMapping.AddFieldMappingsAt("card_title", cardTitleFieldMapping)
+
+	// 识别的语言
+	langFieldMapping := bleve.NewKeywordFieldMapping()
+	docMapping.AddFieldMappingsAt("lang", langFieldMapping)
+
+	// 按照语言分词的消息内容
+	addLangContentMappings(docMapping, analysisOpts)
+
 	// payload_json 原样的数据
 	payloadJsonFieldMapping := bleve.NewTextFieldMapping()
 	payloadJsonFieldMapping.Index = false
@@ -118,11 +230,25 @@ func (s *Search) buildMessageMapping(indexName string) *mapping.IndexMappingImpl
 func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 
 	if s.msgIndex == nil {
-		fmt.Println("search: msgIndex is nil")
-		return nil, nil
+		s.Warn("search: msg index is nil")
+		return nil, fmt.Errorf("message index is not open")
+	}
+
+	if err := req.Check(); err != nil {
+		return nil, err
 	}
 
 	query := bleve.NewConjunctionQuery()
+
+	// 查询语句
+	if strings.TrimSpace(req.Q) != "" {
+		q, err := ParseQueryString(req.Q, req.matchOptions())
+		if err != nil {
+			return nil, err
+		}
+		query.AddQuery(q)
+	}
+
 	if strings.TrimSpace(req.FromUid) != "" {
 		termQuery := bleve.NewTermQuery(req.FromUid)
 		termQuery.SetField("from_uid")
@@ -130,28 +256,7 @@ func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 	}
 
 	if len(req.Channels) > 0 {
-
-		orQuery := bleve.NewDisjunctionQuery()
-		for _, channel := range req.Channels {
-
-			channelQuery := bleve.NewConjunctionQuery()
-
-			termQuery := bleve.NewTermQuery(channel.ChannelId)
-			termQuery.SetField("channel_id")
-			channelQuery.AddQuery(termQuery)
-
-			if channel.ChannelType != 0 {
-				ftype := float64(channel.ChannelType)
-				start := ftype
-				end := ftype + 1
-				termQuery := bleve.NewNumericRangeQuery(&start, &end)
-				termQuery.SetField("channel_type")
-				channelQuery.AddQuery(termQuery)
-			}
-			orQuery.AddQuery(channelQuery)
-		}
-		query.AddQuery(orQuery)
-
+		query.AddQuery(newChannelsQuery(req.Channels, req.joinedAt))
 	}
 
 	if strings.TrimSpace(req.ChannelId) != "" {
@@ -179,15 +284,24 @@ func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 				continue
 			}
 			exist = true
-			bleveQuery := bleve.NewMatchQuery(v)
-			bleveQuery.SetField(fmt.Sprintf("payload.%s", k))
-			payloadQuery.AddQuery(bleveQuery)
+			text := v
+			payloadQuery.AddQuery(withContentVariants(fmt.Sprintf("payload.%s", k), text, req.matchOptions(), func(field string) bleveQuery.Query {
+				return buildMatchQuery(field, text, req.matchOptions())
+			}))
 		}
 		if exist {
 			query.AddQuery(payloadQuery)
 		}
 	}
 
+	// 提及的用户
+	if strings.TrimSpace(req.MentionedUid) != "" {
+		query.AddQuery(newMentionQuery(req.MentionedUid))
+	}
+
+	// 内容类型、文件扩展名、链接域名
+	query.AddQuery(newMetadataQuery(req)...)
+
 	if strings.TrimSpace(req.Topic) != "" {
 		termQuery := bleve.NewTermQuery(req.Topic)
 		termQuery.SetField("topic")
@@ -228,6 +342,11 @@ func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 		query.AddQuery(termQuery)
 	}
 
+	// 按照频道分组
+	if req.Group {
+		return s.searchGroups(req, query)
+	}
+
 	// 构建请求
 	searchRequest := bleve.NewSearchRequest(query)
 	searchRequest.Fields = []string{"*"}
@@ -239,14 +358,24 @@ func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 		}
 	}
 
-	from := 0
+	searchRequest.Size = req.Limit
+	searchRequest.SortBy(searchSortBy(req.Sort))
+
+	// 统计
+	if err := s.addFacets(searchRequest, req, query); err != nil {
+		return nil, err
+	}
 
-	if req.Page > 0 {
-		from = (req.Page - 1) * req.Limit
+	if strings.TrimSpace(req.Cursor) != "" {
+		// 游标分页，从上一页最后一条消息之后开始
+		cursor, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		searchRequest.SetSearchAfter(cursor.searchAfter(req.Sort))
+	} else if req.Page > 0 {
+		searchRequest.From = (req.Page - 1) * req.Limit
 	}
-	searchRequest.From = from
-	searchRequest.Size = req.Limit
-	searchRequest.SortBy([]string{"-_score", "-timestamp"}) // 先按照相关度排序，再按照时间排序
 
 	searchResult, err := s.msgIndex.Search(searchRequest)
 	if err != nil {
@@ -255,120 +384,160 @@ func (s *Search) Search(req SearchReq) (*SearchResp, error) {
 
 	resultMsgs := make([]*Message, 0, len(searchResult.Hits))
 	for _, hit := range searchResult.Hits {
-		fmt.Println(hit.ID, hit.Fields, hit.Fragments)
-		msgId, _ := strconv.ParseInt(hit.ID, 10, 64)
-		var (
-			messageSeq  uint64
-			clientMsgNo string
-			fromUid     string
-			channelId   string
-			channelType uint8
-			streamNo    string
-			streamId    uint64
-			topic       string
-			timestamp   uint32
-		)
-
-		// messageSeq
-		messageSeqObj := hit.Fields["message_seq"]
-		if messageSeqObj != nil {
-			messageSeq = uint64(messageSeqObj.(float64))
-		}
+		msg := newMessageFromHit(hit)
+		score := hit.Score
+		msg.Score = &score
+		resultMsgs = append(resultMsgs, msg)
+	}
+	var nextCursor string
+	if req.Limit > 0 && len(resultMsgs) >= req.Limit {
+		nextCursor = EncodeCursor(resultMsgs[len(resultMsgs)-1])
+	}
+	return &SearchResp{
+		Cost:       searchResult.Cost,
+		Total:      searchResult.Total,
+		Limit:      req.Limit,
+		Page:       req.Page,
+		NextCursor: nextCursor,
+		Messages:   resultMsgs,
+		Facets:     buildFacetResults(req.Facets, searchResult.Facets),
+	}, nil
+}
 
-		// clientMsgNo
-		clientMsgNoObj := hit.Fields["client_msg_no"]
-		if clientMsgNoObj != nil {
-			clientMsgNo = clientMsgNoObj.(string)
-		}
+// 消息属于任意一个频道，joinedAt中有加入时间的频道只匹配加入后的消息
+func newChannelsQuery(channels []*pluginproto.Channel, joinedAt map[string]uint32) *bleveQuery.DisjunctionQuery {
+	orQuery := bleve.NewDisjunctionQuery()
+	for _, channel := range channels {
 
-		// fromUid
-		fromUidObj := hit.Fields["from_uid"]
-		if fromUidObj != nil {
-			fromUid = fromUidObj.(string)
-		}
+		channelQuery := bleve.NewConjunctionQuery()
 
-		// channelId
-		channelIdObj := hit.Fields["channel_id"]
-		if channelIdObj != nil {
-			channelId = channelIdObj.(string)
-		}
+		termQuery := bleve.NewTermQuery(channel.ChannelId)
+		termQuery.SetField("channel_id")
+		channelQuery.AddQuery(termQuery)
 
-		// channelType
-		channelTypeObj := hit.Fields["channel_type"]
-		if channelTypeObj != nil {
-			channelType = uint8(channelTypeObj.(float64))
+		if channel.ChannelType != 0 {
+			ftype := float64(channel.ChannelType)
+			start := ftype
+			end := ftype + 1
+			termQuery := bleve.NewNumericRangeQuery(&start, &end)
+			termQuery.SetField("channel_type")
+			channelQuery.AddQuery(termQuery)
 		}
-
-		// streamNo
-		streamNoObj := hit.Fields["stream_no"]
-		if streamNoObj != nil {
-			streamNo = streamNoObj.(string)
+		if since, ok := joinedAt[channelKey(channel.ChannelId, uint8(channel.ChannelType))]; ok {
+			channelQuery.AddQuery(newSinceQuery(since))
 		}
+		orQuery.AddQuery(channelQuery)
+	}
+	return orQuery
+}
 
-		// streamId
-		streamSeqObj := hit.Fields["stream_id"]
-		if streamSeqObj != nil {
-			streamId = uint64(streamSeqObj.(float64))
-		}
+// 将搜索命中的文档转换为消息
+func newMessageFromHit(hit *blevesearch.DocumentMatch) *Message {
+	msgId, _ := strconv.ParseInt(hit.ID, 10, 64)
+	var (
+		messageSeq  uint64
+		clientMsgNo string
+		fromUid     string
+		channelId   string
+		channelType uint8
+		streamNo    string
+		streamId    uint64
+		topic       string
+		timestamp   uint32
+	)
 
-		// topic
-		topicObj := hit.Fields["topic"]
-		if topicObj != nil {
-			topic = topicObj.(string)
-		}
+	// messageSeq
+	messageSeqObj := hit.Fields["message_seq"]
+	if messageSeqObj != nil {
+		messageSeq = uint64(messageSeqObj.(float64))
+	}
 
-		// timestamp
-		timestampObj := hit.Fields["timestamp"]
-		if timestampObj != nil {
-			timestamp = uint32(timestampObj.(float64))
-		}
+	// clientMsgNo
+	clientMsgNoObj := hit.Fields["client_msg_no"]
+	if clientMsgNoObj != nil {
+		clientMsgNo = clientMsgNoObj.(string)
+	}
 
-		var payloadBytes []byte
-		var payloadJsonStr string
-		var payloadMap map[string]interface{}
-		if hit.Fields["payload_json"] != nil {
-			payloadJsonStr = hit.Fields["payload_json"].(string)
-			payloadMap = gjson.Parse(payloadJsonStr).Value().(map[string]interface{})
-		}
+	// fromUid
+	fromUidObj := hit.Fields["from_uid"]
+	if fromUidObj != nil {
+		fromUid = fromUidObj.(string)
+	}
 
-		if len(payloadMap) > 0 {
-			// 如果有高亮内容，替换payload原来的值
-			if len(hit.Fragments) > 0 {
-				for k, v := range hit.Fragments {
-					if strings.HasPrefix(k, "payload.") {
-						key := strings.TrimPrefix(k, "payload.")
-						payloadMap[key] = strings.Join(v, "")
-					}
+	// channelId
+	channelIdObj := hit.Fields["channel_id"]
+	if channelIdObj != nil {
+		channelId = channelIdObj.(string)
+	}
+
+	// channelType
+	channelTypeObj := hit.Fields["channel_type"]
+	if channelTypeObj != nil {
+		channelType = uint8(channelTypeObj.(float64))
+	}
+
+	// streamNo
+	streamNoObj := hit.Fields["stream_no"]
+	if streamNoObj != nil {
+		streamNo = streamNoObj.(string)
+	}
+
+	// streamId
+	streamSeqObj := hit.Fields["stream_id"]
+	if streamSeqObj != nil {
+		streamId = uint64(streamSeqObj.(float64))
+	}
+
+	// topic
+	topicObj := hit.Fields["topic"]
+	if topicObj != nil {
+		topic = topicObj.(string)
+	}
+
+	// timestamp
+	timestampObj := hit.Fields["timestamp"]
+	if timestampObj != nil {
+		timestamp = uint32(timestampObj.(float64))
+	}
+
+	var payloadBytes []byte
+	var payloadJsonStr string
+	var payloadMap map[string]interface{}
+	if hit.Fields["payload_json"] != nil {
+		payloadJsonStr = hit.Fields["payload_json"].(string)
+		payloadMap = gjson.Parse(payloadJsonStr).Value().(map[string]interface{})
+	}
+
+	if len(payloadMap) > 0 {
+		// 如果有高亮内容，替换payload原来的值
+		if len(hit.Fragments) > 0 {
+			for k, v := range hit.Fragments {
+				if strings.HasPrefix(k, "payload.") {
+					key := strings.TrimPrefix(k, "payload.")
+					payloadMap[key] = strings.Join(v, "")
 				}
 			}
-			payloadBytes, _ = json.Marshal(payloadMap)
-		}
-
-		msg := &Message{
-			MessageId:    msgId,
-			MessageIdStr: hit.ID,
-			MessageSeq:   messageSeq,
-			ClientMsgNo:  clientMsgNo,
-			FromUid:      fromUid,
-			ChannelId:    channelId,
-			ChannelType:  channelType,
-			StreamNo:     streamNo,
-			StreamId:     streamId,
-			Payload:      payloadBytes,
-			PayloadJson:  payloadJsonStr,
-			Topic:        topic,
-			Timestamp:    timestamp,
 		}
+		payloadBytes, _ = json.Marshal(payloadMap)
+	}
 
-		resultMsgs = append(resultMsgs, msg)
+	msg := &Message{
+		MessageId:    msgId,
+		MessageIdStr: hit.ID,
+		MessageSeq:   messageSeq,
+		ClientMsgNo:  clientMsgNo,
+		FromUid:      fromUid,
+		ChannelId:    channelId,
+		ChannelType:  channelType,
+		StreamNo:     streamNo,
+		StreamId:     streamId,
+		Payload:      payloadBytes,
+		PayloadJson:  payloadJsonStr,
+		Topic:        topic,
+		Timestamp:    timestamp,
 	}
-	return &SearchResp{
-		Cost:     searchResult.Cost,
-		Total:    searchResult.Total,
-		Limit:    req.Limit,
-		Page:     req.Page,
-		Messages: resultMsgs,
-	}, nil
+
+	return msg
 }
 
 func buildNestedPayload(fields map[string]interface{}) map[string]interface{} {
@@ -399,7 +568,14 @@ func buildNestedPayload(fields map[string]interface{}) map[string]interface{} {
 }
 
 func (s *Search) Start() {
+	restored := s.restoreOnStart()
 	s.initDb()
+	s.checkIndexConsistency()
+	if restored {
+		s.resumeRestoredChannels()
+	}
+	s.replayPendingIndex()
+	s.goTask(s.loopRetention)
 }
 
 func (s *Search) initDb() {
@@ -408,25 +584,131 @@ func (s *Search) initDb() {
 	if err != nil {
 		panic(err)
 	}
-	bleveDir := path.Join(pdk.S.SandboxDir(), "message.bleve")
-	s.msgIndex, err = bleve.Open(bleveDir)
+	err = s.openMessageIndex()
 	if err != nil {
-		if err == bleve.ErrorIndexPathDoesNotExist {
+		panic(err)
+	}
+}
 
-			s.msgIndex, err = bleve.New(bleveDir, s.buildMessageMapping("message.bleve"))
-			if err != nil {
-				panic(err)
-			}
+// Stop 停止索引：不再接收新的索引请求，等待bucket完成正在处理的批次（队列中剩余的频道已保存在db中，下次启动时继续），
+// 等待迁移、清理等任务结束后关闭消息索引，最后关闭db
+func (s *Search) Stop() {
+	s.stopLock.Lock()
+	if s.stopped {
+		s.stopLock.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.stopper)
+	s.stopLock.Unlock()
+
+	start := time.Now()
+	s.CancelReindex()
+
+	deadline := start.Add(stopTimeout)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	finished := true
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		finished = false
+		s.Warn("wait index tasks timeout", zap.Duration("timeout", stopTimeout))
+	}
+
+	// 迁移和清理会在下一批次前退出，备份和恢复需要等待完成，之后不会再开始
+	// 超时还没有完成的，不关闭索引和db
+	if !s.lockMigrate(deadline) {
+		s.Warn("wait backup or migration timeout, index is not closed", zap.Duration("timeout", stopTimeout))
+		return
+	}
+	s.closeMessageIndex()
+
+	// 超时未退出的任务可能还会访问db，不关闭
+	if finished {
+		s.db.close()
+	}
+	s.Info("search stopped", zap.Duration("cost", time.Since(start)))
+}
+
+// 在deadline之前获取migrateLock，超时返回false
+func (s *Search) lockMigrate(deadline time.Time) bool {
+	for !s.migrateLock.TryLock() {
+		if time.Now().After(deadline) {
+			return false
 		}
+		time.Sleep(time.Millisecond * 50)
 	}
+	return true
 }
 
-func (s *Search) Stop() {
-	s.db.close()
+// 关闭消息索引，等待正在写入的批次完成，之后的写入返回错误
+func (s *Search) closeMessageIndex() {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if s.migrateIndex != nil {
+		if err := s.migrateIndex.Close(); err != nil {
+			s.Warn("close migrate index error", zap.Error(err))
+		}
+		s.migrateIndex = nil
+	}
+	if s.activeIndex != nil {
+		s.msgIndex.Remove(s.activeIndex.alias)
+		if err := s.activeIndex.Close(); err != nil {
+			s.Error("close message index error", zap.Error(err))
+		}
+		s.activeIndex = nil
+	}
+}
+
+// 在未停止时执行fn，停止后返回ErrStopped，Stop会等待执行中的fn结束
+func (s *Search) whenRunning(fn func() error) error {
+	s.stopLock.RLock()
+	defer s.stopLock.RUnlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	return fn()
+}
+
+// 是否正在停止
+func (s *Search) stopping() bool {
+	select {
+	case <-s.stopper:
+		return true
+	default:
+		return false
+	}
 }
 
-func (s Search) bucketIndex(channelId string) int {
-	return int(Hash(channelId) % uint32(len(s.buckets)))
+// 启动后台任务，Stop时等待任务结束，停止后不再启动并返回false
+func (s *Search) goTask(fn func()) bool {
+	s.stopLock.RLock()
+	defer s.stopLock.RUnlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// 等待d，停止时提前返回false
+func (s *Search) sleep(d time.Duration) bool {
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		return true
+	case <-s.stopper:
+		return false
+	}
 }
 
 type SearchReq struct {
@@ -442,21 +724,89 @@ type SearchReq struct {
 	StartTime    uint64                 `json:"start_time"`    // 开始时间
 	EndTime      uint64                 `json:"end_time"`      // 结束时间(结果包含此时间)
 	Highlights   []string               `json:"highlights"`    // 高亮字段
+	Cursor       string                 `json:"cursor"`        // 分页游标，为上一页返回的next_cursor，指定后忽略page
+	Sort         string                 `json:"sort"`          // 排序方式 relevance:相关度(默认) time:时间
+	Q            string                 `json:"q"`             // 查询语句，例如 from:alice "release notes" -draft
+	Match        string                 `json:"match"`         // 内容的匹配方式 exact:精确 fuzzy:模糊 prefix:前缀，默认分词匹配
+	Fuzziness    int                    `json:"fuzziness"`     // 模糊匹配允许的编辑距离(1-2)，默认1
+	Facets       []FacetReq             `json:"facets"`        // 统计
+	Group        bool                   `json:"group"`         // 按照频道分组返回，page和limit对分组分页
+	MentionedUid string                 `json:"mentioned_uid"` // 提及了此用户的消息（包含@所有人）
+	Kinds        []string               `json:"kinds"`         // 内容类型 image voice video file card link（满足任意一个）
+	FileExts     []string               `json:"file_exts"`     // 文件扩展名，例如 pdf
+	LinkDomain   string                 `json:"link_domain"`   // 链接的域名（包含子域名）
+
+	joinedAt map[string]uint32 // 用户加入各频道的时间（SearchAs中设置），key为channelKey
+}
+
+func (s SearchReq) matchOptions() MatchOptions {
+	return MatchOptions{
+		Mode:      s.Match,
+		Fuzziness: s.Fuzziness,
+	}
+}
+
+// Check 校验请求参数，参数错误返回BadRequestError
+func (s SearchReq) Check() error {
+	if s.Sort != "" && s.Sort != SortRelevance && s.Sort != SortTime {
+		return newBadRequest("unknown sort: %s", s.Sort)
+	}
+	if s.Limit < 0 {
+		return newBadRequest("limit must not be negative")
+	}
+	if s.Page < 0 {
+		return newBadRequest("page must not be negative")
+	}
+	if strings.TrimSpace(s.Cursor) == "" && s.Limit > 0 && s.Page > maxSearchWindow/s.Limit {
+		if s.Group {
+			return newBadRequest("page * limit must not exceed %d", maxSearchWindow)
+		}
+		return newBadRequest("page * limit must not exceed %d, use cursor to read further", maxSearchWindow)
+	}
+	if err := s.matchOptions().check(); err != nil {
+		return err
+	}
+	if err := checkFacets(s.Facets); err != nil {
+		return err
+	}
+	if s.Group && strings.TrimSpace(s.Cursor) != "" {
+		return newBadRequest("cursor is not supported when group is true")
+	}
+	if strings.TrimSpace(s.Cursor) != "" {
+		if _, err := decodeCursor(s.Cursor); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(s.Q) != "" {
+		if _, err := ParseQueryString(s.Q, s.matchOptions()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s SearchReq) Clone() SearchReq {
 	req := s
 	req.Channels = make([]*pluginproto.Channel, len(s.Channels))
 	copy(req.Channels, s.Channels)
+	req.Facets = make([]FacetReq, len(s.Facets))
+	copy(req.Facets, s.Facets)
 	return req
 }
 
 type SearchResp struct {
-	Cost     uint64     `json:"cost"`     // 耗时
-	Total    uint64     `json:"total"`    // 总数
-	Limit    int        `json:"limit"`    // 消息数量限制
-	Page     int        `json:"page"`     // 页码
-	Messages []*Message `json:"messages"` // 消息列表
+	Cost       uint64                  `json:"cost"`                  // 耗时
+	Total      uint64                  `json:"total"`                 // 总数
+	Limit      int                     `json:"limit"`                 // 消息数量限制
+	Page       int                     `json:"page"`                  // 页码
+	NextCursor string                  `json:"next_cursor,omitempty"` // 下一页的游标，没有下一页时为空
+	Messages   []*Message              `json:"messages"`              // 消息列表
+	Facets     map[string]*FacetResult `json:"facets,omitempty"`      // 统计结果，key为统计字段
+	Groups     []*SearchGroup          `json:"groups,omitempty"`      // 按照频道分组的结果（group为true时返回）
+	GroupTotal int                     `json:"group_total,omitempty"` // 分组总数
+	Failures   []*NodeError            `json:"failures,omitempty"`    // 搜索失败的节点（多节点搜索时返回）
+
+	GroupTruncated bool `json:"group_truncated,omitempty"` // 命中的频道超过了分组数量上限，分组和分组总数不完整
 }
 
 type Channel struct {
@@ -465,26 +815,52 @@ type Channel struct {
 }
 
 type Message struct {
-	MessageId    int64   `json:"message_id,omitempty"`    // 消息ID
-	MessageIdStr string  `json:"message_idstr,omitempty"` // 消息ID字符串
-	MessageSeq   uint64  `json:"message_seq,omitempty"`   // 消息序号
-	ClientMsgNo  string  `json:"client_msg_no,omitempty"` // 客户端消息编号
-	FromUid      string  `json:"from_uid,omitempty"`      // 发送者
-	ChannelId    string  `json:"channel_id,omitempty"`    // 频道ID
-	ChannelType  uint8   `json:"channel_type,omitempty"`  // 频道类型
-	Payload      Payload `json:"payload,omitempty"`       // 消息内容
-	PayloadJson  string  `json:"payload_json,omitempty"`  // 消息内容 json形式
-	StreamNo     string  `json:"stream_no,omitempty"`     // 流编号
-	StreamId     uint64  `json:"stream_id,omitempty"`     // 流id
-	Topic        string  `json:"topic,omitempty"`         // 消息主题
-	Timestamp    uint32  `json:"timestamp,omitempty"`     // 时间戳
+	MessageId    int64    `json:"message_id,omitempty"`    // 消息ID
+	MessageIdStr string   `json:"message_idstr,omitempty"` // 消息ID字符串
+	MessageSeq   uint64   `json:"message_seq,omitempty"`   // 消息序号
+	ClientMsgNo  string   `json:"client_msg_no,omitempty"` // 客户端消息编号
+	FromUid      string   `json:"from_uid,omitempty"`      // 发送者
+	ChannelId    string   `json:"channel_id,omitempty"`    // 频道ID
+	ChannelType  uint8    `json:"channel_type,omitempty"`  // 频道类型
+	Payload      Payload  `json:"payload,omitempty"`       // 消息内容
+	PayloadJson  string   `json:"payload_json,omitempty"`  // 消息内容 json形式
+	StreamNo     string   `json:"stream_no,omitempty"`     // 流编号
+	StreamId     uint64   `json:"stream_id,omitempty"`     // 流id
+	Topic        string   `json:"topic,omitempty"`         // 消息主题
+	Timestamp    uint32   `json:"timestamp,omitempty"`     // 时间戳
+	Score        *float64 `json:"score,omitempty"`         // 相关度（只在搜索结果中返回，不写入索引）
+	MentionUids  []string `json:"mention_uids,omitempty"`  // 提及的用户（从payload中解析，用于索引）
+	MentionAll   bool     `json:"mention_all,omitempty"`   // 是否@所有人（从payload中解析，用于索引）
+	Kinds        []string `json:"kinds,omitempty"`         // 内容类型（从payload中解析，用于索引）
+	FileName     string   `json:"file_name,omitempty"`     // 文件名（从payload中解析，用于索引）
+	FileExt      string   `json:"file_ext,omitempty"`      // 文件扩展名（从payload中解析，用于索引）
+	FileSize     *int64   `json:"file_size,omitempty"`     // 文件大小（从payload中解析，用于索引）
+	UrlHosts     []string `json:"url_hosts,omitempty"`     // 链接的域名（从payload中解析，用于索引）
+	CardTitle    string   `json:"card_title,omitempty"`    // 名片标题（从payload中解析，用于索引）
+
+	ChannelKey  string            `json:"channel_key,omitempty"`  // 频道ID和频道类型（写入索引时设置，用于按照频道分组）
+	Lang        string            `json:"lang,omitempty"`         // 消息内容的语言（用于索引）
+	LangContent map[string]string `json:"lang_content,omitempty"` // 按照语言分词的消息内容（用于索引，不保存）
+}
+
+// 设置消息内容，并解析内容中需要单独索引的字段
+func (m *Message) setPayload(payloadJson string) {
+	payload := gjson.Parse(payloadJson)
+	m.Payload = payload.Value()
+	m.PayloadJson = payloadJson
+	m.MentionUids, m.MentionAll = parseMention(payload)
+	m.parseMetadata(payload)
+	m.parseLanguage(payload)
 }
 
 func newMessageFrom(m *pluginproto.Message) *Message {
+	return newMessageWithPayload(m, m.Payload)
+}
 
-	jsonObj := gjson.ParseBytes(m.Payload).Value()
+// payload为解码后的消息内容
+func newMessageWithPayload(m *pluginproto.Message, payload []byte) *Message {
 
-	return &Message{
+	msg := &Message{
 		MessageId:    int64(m.MessageId),
 		MessageIdStr: fmt.Sprintf("%d", m.MessageId),
 		MessageSeq:   m.MessageSeq,
@@ -492,13 +868,13 @@ func newMessageFrom(m *pluginproto.Message) *Message {
 		FromUid:      m.From,
 		ChannelId:    m.ChannelId,
 		ChannelType:  uint8(m.ChannelType),
-		Payload:      jsonObj,
-		PayloadJson:  string(m.Payload),
 		StreamNo:     m.StreamNo,
 		StreamId:     m.StreamId,
 		Topic:        m.Topic,
 		Timestamp:    m.Timestamp,
 	}
+	msg.setPayload(string(payload))
+	return msg
 }
 
 type Payload interface{}
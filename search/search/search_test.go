@@ -0,0 +1,95 @@
+package search
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/WuKongIM/wklog"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/cockroachdb/pebble"
+)
+
+var (
+	testMappingOnce sync.Once
+	testMapping     *mapping.IndexMappingImpl
+)
+
+// 默认选项的索引结构，分词器加载词典较慢，所有测试共用
+func testMessageMapping(s *Search) *mapping.IndexMappingImpl {
+	testMappingOnce.Do(func() {
+		testMapping = s.buildMessageMapping()
+	})
+	return testMapping
+}
+
+// 使用临时目录的数据库和索引，不启动bucket
+func newTestSearch(t *testing.T) *Search {
+	t.Helper()
+	dir := t.TempDir()
+	s := &Search{
+		indexOptions: defaultIndexOptions,
+		db:           newDb(),
+		stopper:      make(chan struct{}),
+		Log:          wklog.NewWKLog("Search"),
+	}
+	pebbleDb, err := pebble.Open(filepath.Join(dir, "db"), s.db.defaultPebbleOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.pebbleDb = pebbleDb
+	index, err := createMessageIndexDir(filepath.Join(dir, "index"), testMessageMapping(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setActiveIndex(index)
+	t.Cleanup(func() {
+		// Stop后已经关闭
+		if s.stopping() {
+			return
+		}
+		index.Close()
+		s.db.close()
+	})
+	return s
+}
+
+var testMessageId atomic.Int64
+
+// 测试用的文本消息，消息ID全局递增
+func newTestMessage(channelId string, channelType uint8, seq uint64, from string, content string) *pluginproto.Message {
+	return &pluginproto.Message{
+		MessageId:   testMessageId.Add(1),
+		MessageSeq:  seq,
+		From:        from,
+		ChannelId:   channelId,
+		ChannelType: uint32(channelType),
+		Timestamp:   1700000000 + uint32(seq),
+		Payload:     []byte(`{"type":1,"content":"` + content + `"}`),
+	}
+}
+
+// 按照拉取消息的流程索引，prevSeq为拉取前的检查点
+func indexTestMessages(t *testing.T, s *Search, prevSeq uint64, msgs ...*pluginproto.Message) {
+	t.Helper()
+	b := newBucket(0, s, 1)
+	if err := b.buildIndex(msgs[0].ChannelId, uint8(msgs[0].ChannelType), prevSeq, msgs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 按照消息内容搜索，返回命中的消息ID
+func searchTestContent(t *testing.T, s *Search, content string) []int64 {
+	t.Helper()
+	resp, err := s.Search(SearchReq{Payload: map[string]string{"content": content}, Sort: SortTime, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0, len(resp.Messages))
+	for _, m := range resp.Messages {
+		ids = append(ids, m.MessageId)
+	}
+	return ids
+}
@@ -0,0 +1,91 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestStopWaitsForTasks(t *testing.T) {
+	s := newTestSearch(t)
+	release := make(chan struct{})
+	finished := false
+	if !s.goTask(func() {
+		<-release
+		finished = true
+	}) {
+		t.Fatal("goTask() = false before stop")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop() returned before the task finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+	if !finished {
+		t.Errorf("task is not finished after Stop()")
+	}
+
+	// 停止后不再开始新的任务
+	if s.goTask(func() {}) {
+		t.Errorf("goTask() = true after stop")
+	}
+	if err := s.whenRunning(func() error { return nil }); err != ErrStopped {
+		t.Errorf("whenRunning() error = %v, want %v", err, ErrStopped)
+	}
+	if s.sleep(time.Minute) {
+		t.Errorf("sleep() = true after stop")
+	}
+	if _, err := s.Search(SearchReq{Payload: map[string]string{"content": "hello"}}); err == nil {
+		t.Errorf("Search() after stop error = nil")
+	}
+	s.Stop()
+}
+
+func TestStopCancelsPausedReindex(t *testing.T) {
+	s := newTestSearch(t)
+	s.buckets = []*bucket{newBucket(0, s, 4)}
+	pulling := make(chan struct{})
+	release := make(chan struct{})
+	old := getChannelMessages
+	defer func() { getChannelMessages = old }()
+	getChannelMessages = func(req *pluginproto.ChannelMessageBatchReq) (*pluginproto.ChannelMessageBatchResp, error) {
+		select {
+		case pulling <- struct{}{}:
+			<-release
+		default:
+		}
+		return &pluginproto.ChannelMessageBatchResp{}, nil
+	}
+
+	channels := []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 2}, {ChannelId: "c2", ChannelType: 2}}
+	if _, err := s.StartReindex(ReindexReq{Channels: channels}); err != nil {
+		t.Fatal(err)
+	}
+	<-pulling
+	if _, err := s.PauseReindex(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// 暂停中的任务不会阻塞停止
+	start := time.Now()
+	s.Stop()
+	if cost := time.Since(start); cost >= stopTimeout {
+		t.Errorf("Stop() cost = %v, want less than %v", cost, stopTimeout)
+	}
+	progress, err := s.ReindexProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Status != ReindexStatusCanceled || progress.DoneChannels != 1 {
+		t.Errorf("progress = %+v, want canceled after one channel", progress)
+	}
+}
@@ -0,0 +1,197 @@
+package search
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+	// 统计词频时最多取出的词数量，取出后再按照前缀过滤
+	suggestTermScanSize = 10000
+)
+
+type SuggestReq struct {
+	Q        string                 `json:"q"`        // 输入中的查询，最后一个词作为前缀补全
+	Limit    int                    `json:"limit"`    // 每种补全最多返回的数量，默认10
+	Channels []*pluginproto.Channel `json:"channels"` // 补全内容限制在这些频道内
+
+	joinedAt map[string]uint32 // 用户加入频道的时间，只补全加入之后的消息，key为channelKey
+}
+
+type SuggestTerm struct {
+	Text  string `json:"text"`  // 补全的内容
+	Count int    `json:"count"` // 出现的消息数量
+}
+
+type SuggestResp struct {
+	Terms   []*SuggestTerm `json:"terms"`   // 消息内容中的词，按照出现次数降序
+	Uids    []*SuggestTerm `json:"uids"`    // 发送者，按照消息数量降序
+	History []string       `json:"history"` // 用户最近的搜索
+}
+
+// Check 校验请求参数，参数错误返回BadRequestError
+func (r SuggestReq) Check() error {
+	if strings.TrimSpace(r.Q) == "" {
+		return newBadRequest("q is empty")
+	}
+	if r.Limit < 0 || r.Limit > maxSuggestLimit {
+		return newBadRequest("limit must be between 0 and %d", maxSuggestLimit)
+	}
+	return nil
+}
+
+func (r SuggestReq) limit() int {
+	if r.Limit <= 0 {
+		return defaultSuggestLimit
+	}
+	return r.Limit
+}
+
+// 需要补全的前缀（最后一个词）
+func (r SuggestReq) prefix() string {
+	words := strings.Fields(r.Q)
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
+
+// Suggest 在指定频道内补全消息内容中的词和发送者
+func (s *Search) Suggest(req SuggestReq) (*SuggestResp, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+	resp := &SuggestResp{
+		Terms:   make([]*SuggestTerm, 0),
+		Uids:    make([]*SuggestTerm, 0),
+		History: make([]string, 0),
+	}
+	if len(req.Channels) == 0 {
+		return resp, nil
+	}
+	prefix := req.prefix()
+	channelsQuery := newChannelsQuery(req.Channels, req.joinedAt)
+
+	// 消息内容中的词（gse分词后的词）
+	lowerPrefix := strings.ToLower(prefix)
+	contentQuery := bleve.NewPrefixQuery(lowerPrefix)
+	contentQuery.SetField("payload.content")
+	terms, err := s.suggestTerms(bleve.NewConjunctionQuery(channelsQuery, contentQuery), "payload.content", suggestTermScanSize, func(term string) bool {
+		return strings.HasPrefix(strings.ToLower(term), lowerPrefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Terms = trimSuggestTerms(terms, req.limit())
+
+	// 发送者
+	uidQuery := bleve.NewPrefixQuery(prefix)
+	uidQuery.SetField("from_uid")
+	uids, err := s.suggestTerms(bleve.NewConjunctionQuery(channelsQuery, uidQuery), "from_uid", req.limit(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Uids = trimSuggestTerms(uids, req.limit())
+	return resp, nil
+}
+
+// 统计命中消息中字段的词
+func (s *Search) suggestTerms(q query.Query, field string, size int, filter func(term string) bool) ([]*SuggestTerm, error) {
+	searchRequest := bleve.NewSearchRequest(q)
+	searchRequest.Size = 0
+	searchRequest.AddFacet(field, bleve.NewFacetRequest(field, size))
+	searchResult, err := s.msgIndex.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	terms := make([]*SuggestTerm, 0)
+	facetResult := searchResult.Facets[field]
+	if facetResult == nil {
+		return terms, nil
+	}
+	for _, t := range facetResult.Terms.Terms() {
+		if filter != nil && !filter(t.Term) {
+			continue
+		}
+		terms = append(terms, &SuggestTerm{
+			Text:  t.Term,
+			Count: t.Count,
+		})
+	}
+	return terms, nil
+}
+
+// SuggestHistory 用户最近搜索中以q开头的内容
+func (s *Search) SuggestHistory(uid string, q string, limit int) ([]string, error) {
+	histories, err := s.SearchHistories(uid)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultSuggestLimit
+	}
+	lowerQ := strings.ToLower(strings.TrimSpace(q))
+	result := make([]string, 0)
+	for _, h := range histories {
+		if len(result) >= limit {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(h.Q), lowerQ) {
+			result = append(result, h.Q)
+		}
+	}
+	return result, nil
+}
+
+// MergeSuggestResps 合并各节点的补全结果，相同的内容数量相加
+func MergeSuggestResps(req SuggestReq, resps []*SuggestResp) *SuggestResp {
+	result := &SuggestResp{
+		History: make([]string, 0),
+	}
+	terms := make([][]*SuggestTerm, 0, len(resps))
+	uids := make([][]*SuggestTerm, 0, len(resps))
+	for _, resp := range resps {
+		terms = append(terms, resp.Terms)
+		uids = append(uids, resp.Uids)
+	}
+	result.Terms = trimSuggestTerms(mergeSuggestTerms(terms), req.limit())
+	result.Uids = trimSuggestTerms(mergeSuggestTerms(uids), req.limit())
+	return result
+}
+
+func mergeSuggestTerms(list [][]*SuggestTerm) []*SuggestTerm {
+	termMap := make(map[string]*SuggestTerm)
+	merged := make([]*SuggestTerm, 0)
+	for _, terms := range list {
+		for _, t := range terms {
+			exist := termMap[t.Text]
+			if exist == nil {
+				exist = &SuggestTerm{Text: t.Text}
+				termMap[t.Text] = exist
+				merged = append(merged, exist)
+			}
+			exist.Count += t.Count
+		}
+	}
+	return merged
+}
+
+// 按照数量降序，截取前limit个
+func trimSuggestTerms(terms []*SuggestTerm, limit int) []*SuggestTerm {
+	sort.SliceStable(terms, func(i, j int) bool {
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Text < terms[j].Text
+	})
+	if len(terms) > limit {
+		terms = terms[:limit]
+	}
+	return terms
+}
@@ -0,0 +1,135 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestSuggestReqCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     SuggestReq
+		wantErr bool
+	}{
+		{"q", SuggestReq{Q: "rel"}, false},
+		{"empty q", SuggestReq{Q: " "}, true},
+		{"negative limit", SuggestReq{Q: "rel", Limit: -1}, true},
+		{"limit too large", SuggestReq{Q: "rel", Limit: maxSuggestLimit + 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 补全结果的内容和数量
+func suggestCounts(terms []*SuggestTerm) map[string]int {
+	counts := make(map[string]int, len(terms))
+	for _, term := range terms {
+		counts[term.Text] = term.Count
+	}
+	return counts
+}
+
+func TestSuggest(t *testing.T) {
+	s := newTestSearch(t)
+	indexTestMessages(t, s, 0,
+		newTestMessage("c1", 2, 1, "alice", "release notes"),
+		newTestMessage("c1", 2, 2, "alex", "Release day"),
+		newTestMessage("c1", 2, 3, "alice", "relax"),
+		newTestMessage("c1", 2, 4, "bob", "lunch"),
+	)
+	indexTestMessages(t, s, 0, newTestMessage("c2", 2, 1, "alan", "release relay"))
+	c1 := []*pluginproto.Channel{{ChannelId: "c1", ChannelType: 2}}
+
+	tests := []struct {
+		name      string
+		req       SuggestReq
+		wantTerms map[string]int
+		wantUids  map[string]int
+	}{
+		{
+			name:      "last word is the prefix",
+			req:       SuggestReq{Q: "notes REL", Channels: c1},
+			wantTerms: map[string]int{"release": 2, "relax": 1},
+			wantUids:  map[string]int{},
+		},
+		{
+			name:      "uids",
+			req:       SuggestReq{Q: "al", Channels: c1},
+			wantTerms: map[string]int{},
+			wantUids:  map[string]int{"alice": 2, "alex": 1},
+		},
+		{
+			name:      "limit",
+			req:       SuggestReq{Q: "rel", Limit: 1, Channels: c1},
+			wantTerms: map[string]int{"release": 2},
+			wantUids:  map[string]int{},
+		},
+		{
+			name:      "without channels",
+			req:       SuggestReq{Q: "rel"},
+			wantTerms: map[string]int{},
+			wantUids:  map[string]int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Suggest(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := suggestCounts(resp.Terms); !reflect.DeepEqual(got, tt.wantTerms) {
+				t.Errorf("Suggest() terms = %v, want %v", got, tt.wantTerms)
+			}
+			if got := suggestCounts(resp.Uids); !reflect.DeepEqual(got, tt.wantUids) {
+				t.Errorf("Suggest() uids = %v, want %v", got, tt.wantUids)
+			}
+		})
+	}
+}
+
+func TestSuggestHistory(t *testing.T) {
+	s := newTestSearch(t)
+	for _, q := range []string{"release notes", "lunch", "Release day"} {
+		if err := s.AddSearchHistory("u1", q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.SuggestHistory("u1", "rel", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Release day", "release notes"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SuggestHistory() = %v, want %v", got, want)
+	}
+	if got, _ = s.SuggestHistory("u1", "rel", 1); len(got) != 1 {
+		t.Errorf("SuggestHistory() with limit 1 = %v", got)
+	}
+	if got, _ = s.SuggestHistory("u2", "rel", 0); len(got) != 0 {
+		t.Errorf("SuggestHistory() of another user = %v", got)
+	}
+}
+
+func TestMergeSuggestResps(t *testing.T) {
+	resps := []*SuggestResp{
+		{Terms: []*SuggestTerm{{Text: "release", Count: 2}, {Text: "relax", Count: 1}}, Uids: []*SuggestTerm{{Text: "alice", Count: 1}}},
+		{Terms: []*SuggestTerm{{Text: "relay", Count: 2}, {Text: "relax", Count: 3}}, Uids: []*SuggestTerm{{Text: "alan", Count: 1}}},
+	}
+	merged := MergeSuggestResps(SuggestReq{Q: "rel", Limit: 2}, resps)
+	var texts []string
+	for _, term := range merged.Terms {
+		texts = append(texts, term.Text)
+	}
+	if want := []string{"relax", "relay"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("merged terms = %v, want %v", texts, want)
+	}
+	if got, want := suggestCounts(merged.Uids), map[string]int{"alice": 1, "alan": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged uids = %v, want %v", got, want)
+	}
+}
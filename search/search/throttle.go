@@ -0,0 +1,49 @@
+package search
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	throttleMinDelay = time.Millisecond * 500 // 服务端第一次出错后的等待时间
+	throttleMaxDelay = time.Second * 30       // 最长的等待时间
+)
+
+// 拉取消息的自适应限速，服务端出错时等待时间加倍，成功后减半，直到不再等待
+type throttle struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// 拉取前需要等待的时间
+func (t *throttle) current() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delay
+}
+
+// 拉取失败，返回新的等待时间
+func (t *throttle) failure() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.delay < throttleMinDelay {
+		t.delay = throttleMinDelay
+	} else {
+		t.delay *= 2
+	}
+	if t.delay > throttleMaxDelay {
+		t.delay = throttleMaxDelay
+	}
+	return t.delay
+}
+
+// 拉取成功
+func (t *throttle) success() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delay /= 2
+	if t.delay < throttleMinDelay {
+		t.delay = 0
+	}
+}
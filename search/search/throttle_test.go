@@ -0,0 +1,83 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/WuKongIM/go-pdk/pdk/pluginproto"
+)
+
+func TestThrottle(t *testing.T) {
+	var th throttle
+	want := []time.Duration{throttleMinDelay, 2 * throttleMinDelay, 4 * throttleMinDelay}
+	for i, d := range want {
+		if got := th.failure(); got != d {
+			t.Errorf("failure() %d = %v, want %v", i+1, got, d)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		th.failure()
+	}
+	if got := th.current(); got != throttleMaxDelay {
+		t.Errorf("current() = %v after many failures, want %v", got, throttleMaxDelay)
+	}
+
+	// 成功后减半，小于最小等待时间后不再等待
+	th = throttle{delay: 4 * throttleMinDelay}
+	th.success()
+	if got := th.current(); got != 2*throttleMinDelay {
+		t.Errorf("current() = %v after success, want %v", got, 2*throttleMinDelay)
+	}
+	th.success()
+	th.success()
+	if got := th.current(); got != 0 {
+		t.Errorf("current() = %v, want 0", got)
+	}
+}
+
+func TestHandleIndexThrottle(t *testing.T) {
+	s := newTestSearch(t)
+	b := newBucket(0, s, 4)
+	s.buckets = []*bucket{b}
+	s.MakeIndex("c1", 2)
+
+	old := getChannelMessages
+	defer func() { getChannelMessages = old }()
+	getChannelMessages = func(req *pluginproto.ChannelMessageBatchReq) (*pluginproto.ChannelMessageBatchResp, error) {
+		return nil, errors.New("server busy")
+	}
+	b.handleIndex([]indexReq{b.dequeue(<-b.indexChan)})
+
+	// 出错后频道保留在db中稍后重试，之后的拉取需要等待
+	if got := s.throttle.current(); got != throttleMinDelay {
+		t.Errorf("throttle = %v after an error, want %v", got, throttleMinDelay)
+	}
+	if !b.needReplay.Load() {
+		t.Errorf("needReplay = false after an error")
+	}
+	if got := pendingChannels(t, s); !reflect.DeepEqual(got, []string{"c1:2"}) {
+		t.Errorf("pending channels = %v, want [c1:2]", got)
+	}
+	if metrics := s.runtimeStatus(); metrics.GetMessagesRequests != 1 || metrics.GetMessagesErrors != 1 {
+		t.Errorf("get messages requests = %d errors = %d, want 1 1", metrics.GetMessagesRequests, metrics.GetMessagesErrors)
+	}
+
+	calls := stubChannelMessages(t, newTestMessage("c1", 2, 1, "u1", "hello"))
+	start := time.Now()
+	b.replayPending()
+	b.handleIndex([]indexReq{b.dequeue(<-b.indexChan)})
+	if cost := time.Since(start); cost < throttleMinDelay {
+		t.Errorf("handleIndex() cost = %v, want waiting at least %v", cost, throttleMinDelay)
+	}
+	if *calls != 1 {
+		t.Errorf("get messages calls = %d, want 1", *calls)
+	}
+	if got := s.throttle.current(); got != 0 {
+		t.Errorf("throttle = %v after success, want 0", got)
+	}
+	if got := pendingChannels(t, s); len(got) != 0 {
+		t.Errorf("pending channels = %v after success, want none", got)
+	}
+}